@@ -1,100 +1,180 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/acm"
-	"os"
 	"time"
 )
 
-func amcService() *acm.ACM {
-	// ACM needs to do stuff in us-east-1 for cloudfront to work
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String("us-east-1")}))
-	return acm.New(sess)
-}
-
-func getAcmCertificateARN(domain string) *string {
+func getAcmCertificateARN(domain string) (*string, error) {
 	service := amcService()
-	listResult, err := service.ListCertificates(&acm.ListCertificatesInput{})
-	dieOnError(err, "Failed to load acm certificates")
-
-	for _, certSummary := range listResult.CertificateSummaryList {
-		if *certSummary.DomainName == domain {
-			return certSummary.CertificateArn
+	var certificateArn *string
+	err := service.ListCertificatesPages(&acm.ListCertificatesInput{}, func(page *acm.ListCertificatesOutput, lastPage bool) bool {
+		for _, certSummary := range page.CertificateSummaryList {
+			if *certSummary.DomainName == domain {
+				certificateArn = certSummary.CertificateArn
+				return false
+			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, wrapAWSError(err, "load acm certificates")
 	}
-
-	return nil
+	return certificateArn, nil
 }
 
-func createACMCertificate(domain string) *string {
+func createACMCertificate(domain string) (*string, error) {
 	service := amcService()
 	requestResult, err := service.RequestCertificate(&acm.RequestCertificateInput{
 		DomainName:              &domain,
 		SubjectAlternativeNames: aws.StringSlice([]string{"*." + domain}),
 		ValidationMethod:        aws.String("DNS"),
 	})
-	dieOnError(err, "Failed to request ACM certificate")
-	setACMDNS(*requestResult.CertificateArn, domain)
-
-	// TODO: wait until the acm cert lists as validated (might need to re-trigger something?)
-	return requestResult.CertificateArn
+	if err != nil {
+		return nil, wrapAWSError(err, "request ACM certificate")
+	}
+	return requestResult.CertificateArn, nil
 }
 
-func getCertificateValidation(certificateARN string) *acm.DomainValidation {
+func describeACMCertificate(certificateARN string) (*acm.CertificateDetail, error) {
 	service := amcService()
 	describeResult, err := service.DescribeCertificate(&acm.DescribeCertificateInput{
 		CertificateArn: &certificateARN,
 	})
-	dieOnError(err, "Failed to describe ACM certificate")
-	return describeResult.Certificate.DomainValidationOptions[0]
+	if err != nil {
+		return nil, wrapAWSError(err, "describe ACM certificate")
+	}
+	return describeResult.Certificate, nil
 }
 
-func setACMDNS(certificateARN string, domain string) {
+// Returns the validation info for the certificate's main domain.  Right after
+// the certificate's requested, ACM may not have filled this in yet, in which
+// case the ValidationStatus is nil.
+func getCertificateValidation(certificateARN string) (*acm.DomainValidation, error) {
+	certificate, err := describeACMCertificate(certificateARN)
+	if err != nil {
+		return nil, err
+	}
+	if len(certificate.DomainValidationOptions) == 0 {
+		return &acm.DomainValidation{}, nil
+	}
+	return certificate.DomainValidationOptions[0], nil
+}
 
+// Right after certificate creation, validation status seems to be nil, and so
+// can the record to validate with be.  Waits a bit for ACM to fill them in.
+func waitForValidationDetails(certificateARN string) (*acm.DomainValidation, error) {
 	var domainValidation *acm.DomainValidation
-	// Right after certificate creation, validation status seems to be nil.  Wait a bit.
+	var err error
 	for i := 0; i < 5; i++ {
-		domainValidation := getCertificateValidation(certificateARN)
-		if domainValidation.ValidationStatus != nil {
-			break
-		} else {
-			time.Sleep(5 * time.Second)
+		domainValidation, err = getCertificateValidation(certificateARN)
+		if err != nil {
+			return nil, err
+		}
+		if domainValidation.ValidationStatus != nil && domainValidation.ResourceRecord != nil {
+			return domainValidation, nil
 		}
+		sleep(5 * time.Second)
 	}
-	// TODO: read up on go memory management so I don't have to do this again here to avoid segfaults
-	domainValidation = getCertificateValidation(certificateARN)
+	if domainValidation.ValidationStatus == nil {
+		return nil, errors.New("ACM never reported a validation status for " + certificateARN)
+	}
+	// Without a record there's nothing to validate with.  Once the certificate's
+	// validated (or failed), the record doesn't matter.
+	if *domainValidation.ValidationStatus == "PENDING_VALIDATION" && domainValidation.ResourceRecord == nil {
+		return nil, errors.New("ACM never reported a validation record for " + certificateARN)
+	}
+	return domainValidation, nil
+}
 
-	if *(domainValidation.ValidationStatus) == "PENDING_VALIDATION" {
-		log("not yet valid; creating validation dns records...")
-		dns := domainValidation.ResourceRecord
-		// If the dns record already exists, we're just waiting for validation so don't try to recreate it.
-		if !dnsRecordExists(getHostedZone(domain), *dns.Name, *dns.Type) {
-			createDNSRecord(domain, *dns.Name, *dns.Type, dns.Value, nil)
+// Waits for a pending certificate to either pass or fail validation.
+func waitForACMValidation(certificateARN string) error {
+	log("waiting for validation (takes up to a few hours - feel free to ctrl-c and restart scarr later)...")
+	sleep(5 * time.Second)
+
+	maxTries := 60 * 3
+	for i := 0; i < maxTries; i++ {
+		domainValidation, err := getCertificateValidation(certificateARN)
+		if err != nil {
+			return err
+		}
+		// An empty status means ACM hasn't reported one (again); keep waiting
+		status := aws.StringValue(domainValidation.ValidationStatus)
+		if status == "FAILED" {
+			return errors.New("ACM certificate validation failed")
+		}
+		if status != "" && status != "PENDING_VALIDATION" {
+			logln("Certificate validated")
+			return nil
 		}
+		sleep(60 * time.Second)
+	}
+	return errors.New("timed out waiting for ACM certificate to validate")
+}
 
-		log("waiting for validation (takes up to a few hours - feel free to ctrl-c and restart scarr later)...")
-		time.Sleep(5 * time.Second)
+// Gets a certificate validated, using ensureRecord to set up the validation
+// dns record if it's still pending.
+func validateACMCertificate(certificateARN string, ensureRecord func(*acm.ResourceRecord) error) error {
+	domainValidation, err := waitForValidationDetails(certificateARN)
+	if err != nil {
+		return err
+	}
 
-		maxTries := 60 * 3
-		for i := 0; i < maxTries; i++ {
-			if *getCertificateValidation(certificateARN).ValidationStatus != "PENDING_VALIDATION" {
-				setACMDNS(certificateARN, domain)
-				break
-			}
-			if i == (maxTries - 1) {
-				logln("\nTimed out waiting for ACM certificate to validate.")
-				os.Exit(1)
-			}
-			time.Sleep(60 * time.Second)
+	status := aws.StringValue(domainValidation.ValidationStatus)
+	if status == "PENDING_VALIDATION" {
+		if err = ensureRecord(domainValidation.ResourceRecord); err != nil {
+			return err
 		}
-	} else if *domainValidation.ValidationStatus == "FAILED" {
-		logln("Err!  Cert validation failed!")
-		os.Exit(1)
-	} else {
-		log("Certificate validated")
+		return waitForACMValidation(certificateARN)
+	} else if status == "FAILED" {
+		return errors.New("ACM certificate validation failed")
 	}
 
+	log("Certificate validated")
+	return nil
+}
+
+func setACMDNS(certificateARN string, domain string) error {
+	return validateACMCertificate(certificateARN, func(dns *acm.ResourceRecord) error {
+		log("not yet valid; creating validation dns records...")
+		hostedZoneID, err := getHostedZone(domain)
+		if err != nil {
+			return err
+		}
+		// If the dns record already exists, we're just waiting for validation so don't try to recreate it.
+		exists, err := dnsRecordExists(hostedZoneID, aws.StringValue(dns.Name), aws.StringValue(dns.Type))
+		if err != nil || exists {
+			return err
+		}
+		return createDNSRecord(domain, aws.StringValue(dns.Name), aws.StringValue(dns.Type), dns.Value, nil)
+	})
+}
+
+// Like setACMDNS, but for domains whose DNS isn't in route53 (-skip-dns).
+// Prints the validation record for the user to create at their DNS provider,
+// then waits for it to show up.
+func waitForExternalACMValidation(certificateARN string) error {
+	return validateACMCertificate(certificateARN, func(dns *acm.ResourceRecord) error {
+		name, value := aws.StringValue(dns.Name), aws.StringValue(dns.Value)
+		if cnameMatches(name, value) {
+			return nil
+		}
+		// Printed even with -silent, since validation can't finish without it
+		fmt.Println("\nCreate this record at your DNS provider to validate the certificate:")
+		fmt.Println("  " + name + "  " + aws.StringValue(dns.Type) + "  " + value)
+		return waitForPublicDNS("the validation record", func() bool {
+			return cnameMatches(name, value)
+		})
+	})
+}
+
+func deleteACMCertificate(certificateARN string) error {
+	service := amcService()
+	_, err := service.DeleteCertificate(&acm.DeleteCertificateInput{
+		CertificateArn: &certificateARN,
+	})
+	return wrapAWSError(err, "delete ACM certificate")
 }
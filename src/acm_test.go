@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetACMDNSWithoutValidationRecord(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	fake.addZone("example.com")
+	cert := fake.addCert("example.com", "PENDING_VALIDATION")
+	cert.record = nil
+
+	err := setACMDNS(cert.arn, "example.com")
+	if err == nil || !strings.Contains(err.Error(), "never reported a validation record") {
+		t.Fatalf("expected an error about the missing validation record, got %v", err)
+	}
+	expectCalls(t, fake, map[string]int{"route53.ChangeResourceRecordSets": 0})
+}
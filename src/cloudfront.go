@@ -1,59 +1,99 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudfront"
-	"os"
 	"time"
 )
 
-func cloudFrontService() *cloudfront.CloudFront {
-	sess := session.Must(session.NewSession(&aws.Config{}))
-	return cloudfront.New(sess)
-}
-
-// Returns cloudfrontDomain, distId
-func getCloudfront(s3Domain string) (*string, *string) {
+// Finds the distribution with any of the given origins.  Returns
+// cloudfrontDomain, distId
+func getCloudfront(originDomains []string) (*string, *string, error) {
 	service := cloudFrontService()
-	result, err := service.ListDistributions(&cloudfront.ListDistributionsInput{})
-	dieOnError(err, "Failed getting distribution list")
-	if *result.DistributionList.IsTruncated {
-		// If you have over 1k distributions
-		fmt.Println("TODO: handle paginated result lists for cloudfront")
-		os.Exit(1)
-	}
-
-	for _, dist := range result.DistributionList.Items {
-		for _, origin := range dist.Origins.Items {
-			if *origin.DomainName == s3Domain {
-				// s3Url looks like:
-				// voyage-found.s3-website-us-west-1.amazonaws.com
-				return dist.DomainName, dist.Id
+	var cloudfrontDomain, distributionID *string
+	err := service.ListDistributionsPages(&cloudfront.ListDistributionsInput{}, func(page *cloudfront.ListDistributionsOutput, lastPage bool) bool {
+		for _, dist := range page.DistributionList.Items {
+			for _, origin := range dist.Origins.Items {
+				for _, originDomain := range originDomains {
+					// originDomain looks like:
+					// voyage-found.s3-website-us-west-1.amazonaws.com
+					if *origin.DomainName == originDomain {
+						cloudfrontDomain, distributionID = dist.DomainName, dist.Id
+						return false
+					}
+				}
 			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, wrapAWSError(err, "get distribution list")
 	}
-	return nil, nil
+	return cloudfrontDomain, distributionID, nil
 }
 
-func createCloudFront(s3Domain string, bucketName string, certificateArn string, domain string) *string {
+// The distribution's ARN, which is what the bucket policy for a private origin
+// trusts.
+func getDistributionARN(distributionID string) (string, error) {
+	service := cloudFrontService()
+	result, err := service.GetDistribution(&cloudfront.GetDistributionInput{
+		Id: &distributionID,
+	})
+	if err != nil {
+		return "", wrapAWSError(err, "get distribution")
+	}
+	return *result.Distribution.ARN, nil
+}
 
-	// Taking a break from this function to go set up ACM, since we'll need that ID
+// Returns the distribution's status, either "InProgress" or "Deployed".
+func getCloudfrontStatus(distributionID string) (string, error) {
 	service := cloudFrontService()
+	result, err := service.GetDistribution(&cloudfront.GetDistributionInput{
+		Id: &distributionID,
+	})
+	if err != nil {
+		return "", wrapAWSError(err, "get distribution")
+	}
+	return *result.Distribution.Status, nil
+}
+
+// The distribution config scarr wants for the site.  functionARN is the viewer
+// request function to attach, or "" for none.  originAccessControlID is only
+// used with a private origin.  responseHeadersPolicyID is "" unless the site
+// sets securityHeaders.
+func buildDistributionConfig(config configType, certificateArn string, functionARN string, originAccessControlID string, responseHeadersPolicyID string) *cloudfront.DistributionConfig {
+	bucketName := getBucketName(config)
+	s3Domain := getOriginDomain(config)
 	originID := "S3-" + bucketName
-	// s3Domain := bucketName + ".s3.amazonaws.com"
 
+	siteDomains := getSiteDomains(config)
 	aliases := cloudfront.Aliases{
-		Items:    aws.StringSlice([]string{domain}),
-		Quantity: aws.Int64(1),
+		Items:    aws.StringSlice(siteDomains),
+		Quantity: aws.Int64(int64(len(siteDomains))),
+	}
+
+	functionAssociations := cloudfront.FunctionAssociations{Quantity: aws.Int64(0)}
+	if functionARN != "" {
+		functionAssociations.Items = []*cloudfront.FunctionAssociation{
+			{
+				EventType:   aws.String("viewer-request"),
+				FunctionARN: &functionARN,
+			},
+		}
+		functionAssociations.Quantity = aws.Int64(1)
+	}
+
+	// CORS preflight requests are OPTIONS requests
+	allowedMethods := []string{"GET", "HEAD"}
+	if usesCORS(config) {
+		allowedMethods = append(allowedMethods, "OPTIONS")
 	}
 
 	defaultCacheBehavior := cloudfront.DefaultCacheBehavior{
 		AllowedMethods: &cloudfront.AllowedMethods{
-			Items:    aws.StringSlice([]string{"GET", "HEAD"}),
-			Quantity: aws.Int64(2),
+			Items:    aws.StringSlice(allowedMethods),
+			Quantity: aws.Int64(int64(len(allowedMethods))),
 			CachedMethods: &cloudfront.CachedMethods{
 				Items:    aws.StringSlice([]string{"GET", "HEAD"}),
 				Quantity: aws.Int64(2),
@@ -66,16 +106,20 @@ func createCloudFront(s3Domain string, bucketName string, certificateArn string,
 			},
 			QueryString: aws.Bool(false),
 		},
-		MinTTL:         aws.Int64(0),
-		TargetOriginId: &originID,
+		FunctionAssociations: &functionAssociations,
+		MinTTL:               aws.Int64(0),
+		TargetOriginId:       &originID,
 		TrustedSigners: &cloudfront.TrustedSigners{
 			Enabled:  aws.Bool(false),
 			Quantity: aws.Int64(0),
 		},
 		ViewerProtocolPolicy: aws.String("redirect-to-https"),
 	}
+	if responseHeadersPolicyID != "" {
+		defaultCacheBehavior.ResponseHeadersPolicyId = &responseHeadersPolicyID
+	}
 
-	// Custom-style origin.
+	// Custom-style origin, for the bucket's (http-only) website endpoint.
 	origin := cloudfront.Origin{
 		CustomOriginConfig: &cloudfront.CustomOriginConfig{
 			HTTPPort:             aws.Int64(80),
@@ -85,15 +129,18 @@ func createCloudFront(s3Domain string, bucketName string, certificateArn string,
 		DomainName: &s3Domain,
 		Id:         &originID,
 	}
-	// S3-style origin
-	// origin := cloudfront.Origin{
-	// 	S3OriginConfig: &cloudfront.S3OriginConfig{
-	// 		// Empty for now.  Allows people to access s3 resources directly (which we don't care about)
-	// 		OriginAccessIdentity: aws.String(""),
-	// 	},
-	// 	DomainName: &s3Domain,
-	// 	Id:         &originID,
-	// }
+	if usesPrivateOrigin(config) {
+		// S3-style origin.  Cloudfront signs its requests with the origin
+		// access control instead of using the legacy origin access identity.
+		origin = cloudfront.Origin{
+			S3OriginConfig: &cloudfront.S3OriginConfig{
+				OriginAccessIdentity: aws.String(""),
+			},
+			OriginAccessControlId: &originAccessControlID,
+			DomainName:            &s3Domain,
+			Id:                    &originID,
+		}
+	}
 
 	origins := cloudfront.Origins{
 		Items:    []*cloudfront.Origin{&origin},
@@ -108,14 +155,15 @@ func createCloudFront(s3Domain string, bucketName string, certificateArn string,
 
 	callerReference := time.Now().Format(time.RFC850)
 
-	config := cloudfront.DistributionConfig{
+	return &cloudfront.DistributionConfig{
 		Aliases:              &aliases,
 		CallerReference:      &callerReference,
 		Comment:              aws.String("Created by Scarr.io"),
 		DefaultCacheBehavior: &defaultCacheBehavior,
 		CacheBehaviors:       &cloudfront.CacheBehaviors{Quantity: aws.Int64(0)},
 		Enabled:              aws.Bool(true),
-		CustomErrorResponses: &cloudfront.CustomErrorResponses{Quantity: aws.Int64(0)},
+		IsIPV6Enabled:        aws.Bool(true),
+		CustomErrorResponses: buildCustomErrorResponses(config),
 		PriceClass:           aws.String("PriceClass_All"),
 		Restrictions: &cloudfront.Restrictions{
 			GeoRestriction: &cloudfront.GeoRestriction{
@@ -126,26 +174,84 @@ func createCloudFront(s3Domain string, bucketName string, certificateArn string,
 		Origins:           &origins,
 		ViewerCertificate: &certificate,
 	}
-	createResult, err := service.CreateDistribution(&cloudfront.CreateDistributionInput{DistributionConfig: &config})
+}
 
+// Returns the new distribution's domain and ID.
+func createCloudFront(config configType, certificateArn string, functionARN string, originAccessControlID string, responseHeadersPolicyID string) (*string, *string, error) {
+	service := cloudFrontService()
+	createResult, err := service.CreateDistribution(&cloudfront.CreateDistributionInput{
+		DistributionConfig: buildDistributionConfig(config, certificateArn, functionARN, originAccessControlID, responseHeadersPolicyID),
+	})
 	if err != nil {
-		awserror := err.(awserr.Error)
-		fmt.Println("code=", awserror.Code())
-		fmt.Println(awserror.Message())
+		return nil, nil, wrapAWSError(err, "create cloudfront distribution")
 	}
 
-	dieOnError(err, "Failed to create cloudfront distribution")
-
 	log("Waiting for distribution to finish (20-40 minutes)...")
-	service.WaitUntilDistributionDeployed(&cloudfront.GetDistributionInput{
+	err = service.WaitUntilDistributionDeployed(&cloudfront.GetDistributionInput{
 		Id: createResult.Distribution.Id,
 	})
+	if err != nil {
+		return nil, nil, wrapAWSError(err, "wait for distribution to deploy")
+	}
+	logln(" done")
+	return createResult.Distribution.DomainName, createResult.Distribution.Id, nil
+}
+
+// Returns the distribution's current config and the ETag needed to update it.
+func getDistributionConfig(distributionID string) (*cloudfront.DistributionConfig, *string, error) {
+	service := cloudFrontService()
+	result, err := service.GetDistributionConfig(&cloudfront.GetDistributionConfigInput{
+		Id: &distributionID,
+	})
+	if err != nil {
+		return nil, nil, wrapAWSError(err, "get distribution config")
+	}
+	return result.DistributionConfig, result.ETag, nil
+}
+
+// Fetches the distribution's config, lets update change it, and if update
+// reports a change, saves it and waits for the change to deploy.  Returns
+// whether anything changed.
+func updateCloudFront(distributionID string, update func(*cloudfront.DistributionConfig) (bool, error)) (bool, error) {
+	distributionConfig, etag, err := getDistributionConfig(distributionID)
+	if err != nil {
+		return false, err
+	}
+	changed, err := update(distributionConfig)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	service := cloudFrontService()
+	_, err = service.UpdateDistribution(&cloudfront.UpdateDistributionInput{
+		Id:                 &distributionID,
+		IfMatch:            etag,
+		DistributionConfig: distributionConfig,
+	})
+	if err != nil {
+		return false, wrapAWSError(err, "update distribution")
+	}
+
+	log("Waiting for the distribution update to finish (5-20 minutes)...")
+	err = service.WaitUntilDistributionDeployed(&cloudfront.GetDistributionInput{
+		Id: &distributionID,
+	})
+	if err != nil {
+		return false, wrapAWSError(err, "wait for distribution to deploy")
+	}
 	logln(" done")
-	return createResult.Distribution.DomainName
+	return true, nil
 }
 
-func createCloudfrontInvalidation(s3Url string, paths []string) {
-	_, distributionID := getCloudfront(s3Url)
+// Returns the invalidation's ID.
+func createCloudfrontInvalidation(originDomains []string, paths []string) (string, error) {
+	_, distributionID, err := getCloudfront(originDomains)
+	if err != nil {
+		return "", err
+	}
+	if distributionID == nil {
+		return "", errors.New("no cloudfront distribution found for " + originDomains[0])
+	}
 	service := cloudFrontService()
 	callerReference := time.Now().Format(time.RFC850)
 	log("Invalidating cache...")
@@ -159,12 +265,65 @@ func createCloudfrontInvalidation(s3Url string, paths []string) {
 			},
 		},
 	})
-	dieOnError(err, "Failed to create Invalidation")
+	if err != nil {
+		return "", wrapAWSError(err, "create invalidation")
+	}
 
 	log("waiting (5-10 minutes)...")
-	service.WaitUntilInvalidationCompleted(&cloudfront.GetInvalidationInput{
+	err = service.WaitUntilInvalidationCompleted(&cloudfront.GetInvalidationInput{
 		DistributionId: distributionID,
 		Id:             invalidationResult.Invalidation.Id,
 	})
+	if err != nil {
+		return "", wrapAWSError(err, "wait for invalidation")
+	}
 	logln(" done")
+	return *invalidationResult.Invalidation.Id, nil
+}
+
+// Disables a distribution and waits for that to finish deploying, which
+// cloudfront requires before a distribution can be deleted.
+func disableCloudFront(distributionID string) error {
+	service := cloudFrontService()
+	configResult, err := service.GetDistributionConfig(&cloudfront.GetDistributionConfigInput{
+		Id: &distributionID,
+	})
+	if err != nil {
+		return wrapAWSError(err, "get distribution config")
+	}
+
+	if *configResult.DistributionConfig.Enabled {
+		configResult.DistributionConfig.Enabled = aws.Bool(false)
+		_, err = service.UpdateDistribution(&cloudfront.UpdateDistributionInput{
+			Id:                 &distributionID,
+			IfMatch:            configResult.ETag,
+			DistributionConfig: configResult.DistributionConfig,
+		})
+		if err != nil {
+			return wrapAWSError(err, "disable distribution")
+		}
+	}
+
+	log("waiting for the distribution to finish disabling (20-40 minutes)...")
+	err = service.WaitUntilDistributionDeployed(&cloudfront.GetDistributionInput{
+		Id: &distributionID,
+	})
+	return wrapAWSError(err, "wait for distribution to disable")
+}
+
+func deleteCloudFront(distributionID string) error {
+	service := cloudFrontService()
+	// Deleting needs the ETag from after the disable finished
+	distribution, err := service.GetDistribution(&cloudfront.GetDistributionInput{
+		Id: &distributionID,
+	})
+	if err != nil {
+		return wrapAWSError(err, "get distribution")
+	}
+
+	_, err = service.DeleteDistribution(&cloudfront.DeleteDistributionInput{
+		Id:      &distributionID,
+		IfMatch: distribution.ETag,
+	})
+	return wrapAWSError(err, "delete distribution")
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// scarr.yml's compress block.  Files with one of the given extensions and at
+// least minSize bytes get compressed before upload and stored with a
+// Content-Encoding header.
+type compressConfigType struct {
+	// Only "gzip" (the default) for now.  S3 stores one version of each
+	// object and cloudfront can't fall back to an uncompressed one, so the
+	// encoding has to be one every client accepts.
+	Encoding   string   `yaml:"encoding"`
+	Extensions []string `yaml:"extensions"`
+	MinSize    int64    `yaml:"minSize"`
+}
+
+func validateCompressConfig(config compressConfigType) error {
+	switch config.Encoding {
+	case "", "gzip":
+		return nil
+	case "br":
+		// Clients that don't send Accept-Encoding: br would get bodies they
+		// can't decode
+		return newConfigError(nil, "compress encoding br isn't supported, since every visitor would get brotli whether their client accepts it or not; use gzip")
+	}
+	return newConfigError(nil, "unknown compress encoding "+config.Encoding+" (expected gzip)")
+}
+
+// The Content-Encoding compressed files get stored with.
+const compressionEncoding = "gzip"
+
+func shouldCompress(path string, size int64, config compressConfigType) bool {
+	if size < config.MinSize {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, compressExt := range config.Extensions {
+		compressExt = strings.ToLower(compressExt)
+		if !strings.HasPrefix(compressExt, ".") {
+			compressExt = "." + compressExt
+		}
+		if ext == compressExt {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads and gzips a file.  The encoder produces the same output for the same
+// input, so the result's md5 is stable across deploys.
+func compressFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffer := &bytes.Buffer{}
+	writer, _ := gzip.NewWriterLevel(buffer, gzip.BestCompression)
+	if _, err = io.Copy(writer, file); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCompressConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		encoding string
+		err      string
+	}{
+		{name: "default", encoding: ""},
+		{name: "gzip", encoding: "gzip"},
+		{name: "brotli", encoding: "br", err: "br isn't supported"},
+		{name: "unknown", encoding: "deflate", err: "unknown compress encoding"},
+	}
+	for _, c := range cases {
+		err := validateCompressConfig(compressConfigType{Encoding: c.encoding})
+		if c.err == "" && err != nil {
+			t.Errorf("%v: expected no error, got %v", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%v: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/publicsuffix"
 	"gopkg.in/yaml.v2"
 )
 
@@ -30,48 +36,136 @@ type configType struct {
 	Region        string             `yaml:"region"`
 	DomainContact contactDetailsType `yaml:"domainContact"`
 	Exclude       []string           `yaml:"exclude"`
+	Prune         bool               `yaml:"prune"`
+	Headers       []headerRuleType   `yaml:"headers"`
+	Compress      compressConfigType `yaml:"compress"`
+	// Past this many changed paths, invalidate /* instead of each path
+	InvalidationThreshold int                 `yaml:"invalidationThreshold"`
+	Endpoints             endpointsConfigType `yaml:"endpoints"`
+	Redirects             redirectsConfigType `yaml:"redirects"`
+	// "website" (the default) or "private"; see origin.go
+	Origin string           `yaml:"origin"`
+	Errors errorsConfigType `yaml:"errors"`
+	// Serve index.html for unknown paths, for apps with client-side routing
+	SPA             bool                       `yaml:"spa"`
+	SecurityHeaders *securityHeadersConfigType `yaml:"securityHeaders"`
+	Releases        releasesConfigType         `yaml:"releases"`
 }
 
-func dieOnError(err error, message string) {
-	if err != nil {
-		fmt.Println(message, err)
-		os.Exit(1)
-	}
-}
+// CloudFront allows 3000 in-progress path invalidations per distribution and
+// charges for anything over 1000 a month, so default to something well below.
+const defaultInvalidationThreshold = 100
 
-func confirm(message string) bool {
+func confirm(message string) (bool, error) {
 	fmt.Print(message + " [y/N]")
 
 	reader := bufio.NewReader(os.Stdin)
 	text, err := reader.ReadString('\n')
 	fmt.Println("")
-	dieOnError(err, "Failed reading y/n input")
-	return "y" == strings.TrimSpace(strings.ToLower(text))
+	if err != nil {
+		return false, fmt.Errorf("failed reading y/n input: %w", err)
+	}
+	return "y" == strings.TrimSpace(strings.ToLower(text)), nil
 }
 
-func getConfig() configType {
-	yamlFile, err := ioutil.ReadFile("scarr.yml")
-	dieOnError(err, "Error reading scarr.yml")
+// Catches mistakes in scarr.yml before we've touched anything on AWS.
+func validateConfig(config configType) error {
+	if config.Domain == "" || !strings.Contains(config.Domain, ".") {
+		return newConfigError(nil, "domain in scarr.yml must be a full domain name (eg example.com)")
+	}
+	if _, err := publicsuffix.EffectiveTLDPlusOne(config.Domain); err != nil {
+		return newConfigError(err, "domain in scarr.yml must be a domain you can register, not a public suffix like co.uk")
+	}
+	if config.Name == "" {
+		return newConfigError(nil, "name in scarr.yml is required")
+	}
+	if config.Region == "" {
+		return newConfigError(nil, "region in scarr.yml is required")
+	}
+	for _, exclude := range config.Exclude {
+		if _, err := regexp.Compile(exclude); err != nil {
+			return newConfigError(err, "invalid exclude regex "+exclude)
+		}
+	}
+	for _, rule := range config.Headers {
+		if err := validateHeaderRule(rule); err != nil {
+			return err
+		}
+	}
+	if err := validateCompressConfig(config.Compress); err != nil {
+		return err
+	}
+	if err := validateRedirectsConfig(config.Redirects, getSiteDomains(config), !usesPrivateOrigin(config)); err != nil {
+		return err
+	}
+	if !usesPrivateOrigin(config) && len(config.Redirects.Rules) > maxRoutingRules {
+		return newConfigError(nil, fmt.Sprintf("s3 websites allow at most %v redirect rules; use origin: private for more", maxRoutingRules))
+	}
+	if err := validateOrigin(config.Origin); err != nil {
+		return err
+	}
+	if err := validateErrorsConfig(config.Errors, config.SPA); err != nil {
+		return err
+	}
+	if err := validateSecurityHeadersConfig(config.SecurityHeaders); err != nil {
+		return err
+	}
+	if err := validateReleasesConfig(config); err != nil {
+		return err
+	}
+	return validateEndpoints(config.Endpoints)
+}
 
+func getConfig() (configType, error) {
 	var config configType
+	yamlFile, err := ioutil.ReadFile("scarr.yml")
+	if err != nil {
+		return config, newConfigError(err, "error reading scarr.yml")
+	}
+
 	err = yaml.Unmarshal(yamlFile, &config)
-	dieOnError(err, "Error parsing scarr.yml")
+	if err != nil {
+		return config, newConfigError(err, "error parsing scarr.yml")
+	}
 
-	return config
+	fileRules, err := readRedirectsFile(redirectsFileName)
+	if err != nil {
+		return config, err
+	}
+	config.Redirects.Rules = append(config.Redirects.Rules, fileRules...)
+
+	if config.InvalidationThreshold <= 0 {
+		config.InvalidationThreshold = defaultInvalidationThreshold
+	}
+
+	if err = validateConfig(config); err != nil {
+		return config, err
+	}
+	endpoints = config.Endpoints
+	return config, nil
 }
 
-// Gets the root domain (eg foo.com from bar.foo.com).
+// Gets the root (registrable) domain, eg foo.com from bar.foo.com or
+// foo.co.uk from bar.foo.co.uk.  Uses the public suffix list compiled into the
+// binary, so it works offline.
 func getRootDomain(domain string) string {
-	domainParts := strings.Split(domain, ".")
-	return domainParts[len(domainParts)-2] + "." + domainParts[len(domainParts)-1]
+	rootDomain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		// Only happens for a bare public suffix, which validateConfig rejects
+		return domain
+	}
+	return rootDomain
 }
 
-func ensureDomainRegistered(config configType, autoRegister bool) {
+func ensureDomainRegistered(config configType, autoRegister bool) error {
 	// We can't register a subdomain, so let's check registration on the main domain instead
 	domain := getRootDomain(config.Domain)
 	log("Checking domain " + domain + " registration...")
 
-	domainDetail := getDomainDetails(domain)
+	domainDetail, err := getDomainDetails(domain)
+	if err != nil {
+		return err
+	}
 	if domainDetail == nil {
 		logln("\nNot registered in our Route53")
 
@@ -81,7 +175,10 @@ func ensureDomainRegistered(config configType, autoRegister bool) {
 		// 	return
 		// }
 
-		domainAvailability := getDomainAvailability(domain)
+		domainAvailability, err := getDomainAvailability(domain)
+		if err != nil {
+			return err
+		}
 		if domainAvailability {
 			logln(`
 But it *is* available to register.  For current prices, see the document linked at:
@@ -90,28 +187,88 @@ https://aws.amazon.com/route53/pricing/
 			if strings.HasSuffix(domain, ".com") {
 				logln("(As of April 2018, .com TLDs were $12/yr)")
 			}
-			if autoRegister || confirm("Register that domain?") {
-				registerDomain(domain, config.DomainContact)
+			shouldRegister := autoRegister
+			if !shouldRegister {
+				if shouldRegister, err = confirm("Register that domain?"); err != nil {
+					return err
+				}
+			}
+			if shouldRegister {
+				return registerDomain(domain, config.DomainContact)
 			}
 		} else {
 			fmt.Println(`
 Unfortunately that domain is not available to register.  Maybe it's still
 registering from the last time you ran scarr?  If so, try again in a few.
-If you own that domain through a different registrar, transfer it to
-route53.  Alternately, use both --skip-dns and --skip-domain to bypass
-this (you'll have to manage your own domain + dns setup then)
-(//TODO: implement those flags)`)
-			os.Exit(1)
+If you own that domain through a different registrar, either transfer it
+to route53 or run deploy with -skip-domain.  If its DNS is hosted outside
+route53 too, add -skip-dns and scarr will print the records to create.`)
+			return errors.New("domain " + domain + " is not available to register")
 		}
 	} else {
 		logln("Looks good!")
 	}
+	return nil
+}
+
+// Makes sure there's a hosted zone to put the domain's records in.  A domain
+// that was just transferred in from another registrar (or registered
+// elsewhere) won't have one yet, so create it and point the domain at it.
+func ensureHostedZone(domain string) error {
+	rootDomain := getRootDomain(domain)
+	logf("Checking hosted zone for %v...", rootDomain)
+	hostedZoneID, err := findHostedZone(domain)
+	if err != nil {
+		return err
+	}
+	if hostedZoneID != "" {
+		logln(" already exists.")
+		return nil
+	}
+
+	log(" doesn't exist; creating...")
+	_, nameServers, err := createHostedZone(rootDomain)
+	if err != nil {
+		return err
+	}
+	logln(" done")
+
+	domainDetail, err := getDomainDetails(rootDomain)
+	if err != nil {
+		return err
+	}
+	if domainDetail != nil {
+		log("Pointing " + rootDomain + " at the new zone's name servers...")
+		if err = updateDomainNameservers(rootDomain, nameServers); err != nil {
+			return err
+		}
+		logln(" done")
+		return nil
+	}
+
+	// Printed even with -silent, since nothing will resolve until it's done
+	fmt.Println("\n" + rootDomain + " isn't registered through route53, so set its name servers at your registrar to:")
+	for _, nameServer := range nameServers {
+		fmt.Println("  " + nameServer)
+	}
+	fmt.Println("Certificate validation will wait until that change has propagated.")
+	return nil
 }
-func ensureS3BucketExists(s3BucketName string, region string) {
+
+// Any bucket but a private one is set up as a website with the given config.
+// A private bucket blocks public access, but not until the distribution reads
+// it through the REST endpoint (see ensurePrivateOrigin).
+func ensureS3BucketExists(s3BucketName string, region string, private bool, website *s3.WebsiteConfiguration) error {
 	logf("Checking bucket %v...", s3BucketName)
-	if !bucketExists(s3BucketName, region) {
+	exists, err := bucketExists(s3BucketName, region)
+	if err != nil {
+		return err
+	}
+	if !exists {
 		log(" bucket doesn't exist; creating it now...")
-		createBucket(s3BucketName, region)
+		if err = createBucket(s3BucketName, region); err != nil {
+			return err
+		}
 	} else {
 		log(" bucket already exists.")
 	}
@@ -122,64 +279,279 @@ func ensureS3BucketExists(s3BucketName string, region string) {
 	// 	os.Exit(1)
 	// }
 	logln(" done")
-	ensureBucketIsWebsite(s3BucketName, region)
+	if private {
+		return nil
+	}
+	return ensureBucketIsWebsite(s3BucketName, region, website)
 }
 
-func ensureACMCertificate(domain string) string {
+func ensureACMCertificate(domain string, skipDNS bool) (string, error) {
 	logf("Checking ACM cert for %v...", domain)
-	certificateArn := getAcmCertificateARN(domain)
+	certificateArn, err := getAcmCertificateARN(domain)
+	if err != nil {
+		return "", err
+	}
 	if certificateArn == nil {
 		log("doesn't exist; creating...")
-		certificateArn = createACMCertificate(domain)
+		if certificateArn, err = createACMCertificate(domain); err != nil {
+			return "", err
+		}
 	} else {
-		// Ensure it's DNS is set up
 		log("already exists; ensuring it's validated...")
-		setACMDNS(*certificateArn, domain)
+	}
+
+	// Ensure its DNS is set up
+	if skipDNS {
+		err = waitForExternalACMValidation(*certificateArn)
+	} else {
+		err = setACMDNS(*certificateArn, domain)
+	}
+	if err != nil {
+		return "", err
 	}
 	logln(" done")
-	return *certificateArn
+	return *certificateArn, nil
 }
-func ensureCloudFrontExists(certificateArn string, s3Url string, s3Bucket string, domain string) string {
-	cloudfrontDomain, _ := getCloudfront(s3Url)
+
+// Creates the distribution, or if it exists, fixes any drift from scarr's
+// config (see reconcileCloudFront).  Returns the distribution's domain and ID.
+func ensureCloudFrontExists(config configType, certificateArn string, functionARN string, originAccessControlID string, responseHeadersPolicyID string, autoApprove bool) (string, string, error) {
+	cloudfrontDomain, distributionID, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return "", "", err
+	}
 	if cloudfrontDomain == nil {
 		logln("CloudFront distribution does not exist; creating")
-		cloudfrontDomain = createCloudFront(s3Url, s3Bucket, certificateArn, domain)
+		cloudfrontDomain, distributionID, err = createCloudFront(config, certificateArn, functionARN, originAccessControlID, responseHeadersPolicyID)
+		if err != nil {
+			return "", "", err
+		}
+		return *cloudfrontDomain, *distributionID, nil
 	}
-	return *cloudfrontDomain
+
+	desired := buildDistributionConfig(config, certificateArn, functionARN, originAccessControlID, responseHeadersPolicyID)
+	if usesReleases(config) {
+		if err = keepLiveRelease(desired, *distributionID); err != nil {
+			return "", "", err
+		}
+	}
+	if _, err = reconcileCloudFront(*distributionID, desired, autoApprove); err != nil {
+		return "", "", err
+	}
+	return *cloudfrontDomain, *distributionID, nil
 }
-func ensureDomainPointingToCloudfront(cloudfrontDomain string, mainDomain string) {
-	hostedZoneID := getHostedZone(mainDomain)
-	if dnsRecordExists(hostedZoneID, mainDomain, "A") {
-		logln("Domain has a (hopefully-correct) alias already configured")
-	} else {
-		logln("Creating A-record alias to domain")
-		createAliasRecord(mainDomain, mainDomain, cloudfrontDomain)
+
+// Creates a viewer request function if the site needs one (see
+// buildViewerRequestCode).  Returns its ARN, or "" if there isn't one.
+func ensureViewerRequestFunction(config configType) (string, error) {
+	code := buildViewerRequestCode(config)
+	if code == "" {
+		return "", nil
+	}
+	name := getFunctionName(config)
+	logf("Checking cloudfront function %v...", name)
+	functionARN, err := ensureCloudFrontFunction(name, code)
+	if err != nil {
+		return "", err
+	}
+	logln(" done")
+	return functionARN, nil
+}
+
+func ensureDomainPointingToCloudfront(cloudfrontDomain string, domains []string) error {
+	for _, domain := range domains {
+		hostedZoneID, err := getHostedZone(domain)
+		if err != nil {
+			return err
+		}
+		// Checked per type, so sites deployed before scarr made AAAA records
+		// get one
+		for _, recordType := range aliasRecordTypes {
+			exists, err := dnsRecordExists(hostedZoneID, domain, recordType)
+			if err != nil {
+				return err
+			}
+			if exists {
+				logln(domain + " has a (hopefully-correct) " + recordType + " alias already configured")
+			} else {
+				logln("Creating " + recordType + "-record alias for " + domain)
+				if err = createAliasRecord(domain, domain, recordType, cloudfrontDomain); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Converts changed bucket keys into cloudfront invalidation paths.  Index files
+// also get their directory forms invalidated, since that's how they're usually
+// requested (eg docs/index.html -> /docs/index.html, /docs/, and /docs).  If
+// that's more than threshold paths, just invalidates everything instead.
+func getInvalidationPaths(changedFiles []string, threshold int) []string {
+	seen := map[string]bool{}
+	paths := []string{}
+	add := func(p string) {
+		escaped := (&url.URL{Path: p}).EscapedPath()
+		if !seen[escaped] {
+			seen[escaped] = true
+			paths = append(paths, escaped)
+		}
+	}
+
+	for _, key := range changedFiles {
+		add("/" + key)
+		if path.Base(key) == "index.html" {
+			dir := strings.TrimSuffix(key, "index.html")
+			add("/" + dir)
+			if dir != "" {
+				add("/" + strings.TrimSuffix(dir, "/"))
+			}
+		}
+	}
+
+	if len(paths) > threshold {
+		return []string{"/*"}
+	}
+	return paths
+}
+
+// Returns the invalidation's ID, or "" if nothing needed invalidating.
+func invalidateCloudfront(originDomains []string, pathsToInvalidate []string, threshold int) (string, error) {
+	if len(pathsToInvalidate) == 0 {
+		logln("No files changed; skipping cache invalidation")
+		return "", nil
 	}
+	return createCloudfrontInvalidation(originDomains, getInvalidationPaths(pathsToInvalidate, threshold))
+}
+
+func getBucketName(config configType) string {
+	return config.Name + "-bucket"
+}
 
-	// TODO: set up an alias or redirect from www to apex
+// The bucket's website endpoint, which is what cloudfront uses as its origin.
+func getS3WebsiteDomain(bucket string, region string) string {
+	return bucket + ".s3-website-" + region + ".amazonaws.com"
 }
 
-func invalidateCloudfront(s3Domain string, pathsToInvalidate []string) {
-	// TODO: actually invalidate what's passed in
-	createCloudfrontInvalidation(s3Domain, []string{"/*"})
+// Runs each setup step in order, stopping at the first one that fails.
+// skipDomain assumes the domain's registered somewhere; skipDNS leaves dns
+// records to the user, for a domain whose DNS isn't in route53.  autoApprove
+// updates a drifted distribution without asking.
+func setUpInfrastructure(config configType, autoRegister bool, autoApprove bool, skipDomain bool, skipDNS bool) error {
+	s3Bucket := getBucketName(config)
+
+	if !skipDomain {
+		if err := ensureDomainRegistered(config, autoRegister); err != nil {
+			return err
+		}
+	}
+	if !skipDNS {
+		if err := ensureHostedZone(config.Domain); err != nil {
+			return err
+		}
+	}
+	certArn, err := ensureACMCertificate(config.Domain, skipDNS)
+	if err != nil {
+		return err
+	}
+	private := usesPrivateOrigin(config)
+	if err = ensureS3BucketExists(s3Bucket, config.Region, private, buildWebsiteConfiguration(config)); err != nil {
+		return err
+	}
+	originAccessControlID := ""
+	if private {
+		if originAccessControlID, err = ensureOriginAccessControl(config); err != nil {
+			return err
+		}
+		// When switching an existing site over, the distribution has to be
+		// able to read the bucket before it's moved to the REST endpoint
+		_, existingID, err := getCloudfront(getOriginDomains(config))
+		if err != nil {
+			return err
+		}
+		if existingID != nil {
+			if err = ensureDistributionCanReadBucket(s3Bucket, config.Region, *existingID); err != nil {
+				return err
+			}
+		}
+	}
+	functionARN, err := ensureViewerRequestFunction(config)
+	if err != nil {
+		return err
+	}
+	responseHeadersPolicyID, err := ensureResponseHeadersPolicy(config)
+	if err != nil {
+		return err
+	}
+	cloudfrontDomain, distributionID, err := ensureCloudFrontExists(config, certArn, functionARN, originAccessControlID, responseHeadersPolicyID, autoApprove)
+	if err != nil {
+		return err
+	}
+	if private {
+		if err = ensurePrivateOrigin(config, distributionID); err != nil {
+			return err
+		}
+	}
+	if skipDNS {
+		for _, domain := range getSiteDomains(config) {
+			if err = ensureExternalDomainPointingToCloudfront(cloudfrontDomain, domain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ensureDomainPointingToCloudfront(cloudfrontDomain, getSiteDomains(config))
 }
 
-func runDeploy(skipSetup bool, autoRegister bool) {
+func runDeploy(skipSetup bool, autoRegister bool, autoApprove bool, skipDomain bool, skipDNS bool, prune bool, concurrency int) error {
 	logln("Deploying")
-	config := getConfig()
-	s3Bucket := config.Name + "-bucket"
-	s3Url := s3Bucket + ".s3-website-" + config.Region + ".amazonaws.com"
+	config, err := getConfig()
+	if err != nil {
+		return err
+	}
+	s3Bucket := getBucketName(config)
 
 	if !skipSetup {
-		ensureDomainRegistered(config, autoRegister)
-		certArn := ensureACMCertificate(config.Domain)
-		ensureS3BucketExists(s3Bucket, config.Region)
-		cloudfrontDomain := ensureCloudFrontExists(certArn, s3Url, s3Bucket, config.Domain)
-		ensureDomainPointingToCloudfront(cloudfrontDomain, config.Domain)
+		if err = setUpInfrastructure(config, autoRegister, autoApprove, skipDomain, skipDNS); err != nil {
+			return err
+		}
+	}
+
+	localFiles, err := getLocalFiles(config)
+	if err != nil {
+		return err
+	}
+	var releaseID string
+	var changedFiles []string
+	var failures []uploadFailure
+	if usesReleases(config) {
+		releaseID, changedFiles, failures, err = deployRelease(config, localFiles, concurrency)
+	} else {
+		changedFiles, failures, err = s3Sync(config, s3Bucket, localFiles, prune || config.Prune, concurrency)
+	}
+	if err != nil {
+		return err
+	}
+	// Still invalidate whatever did make it up, so the cache matches the bucket
+	invalidationID, err := invalidateCloudfront(getOriginDomains(config), changedFiles, config.InvalidationThreshold)
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		// Report it as the first failure's kind (eg transient) so the exit
+		// code reflects it
+		return fmt.Errorf("%v files failed to upload: %w", len(failures), failures[0].err)
 	}
 
-	changedFiles := s3Sync(config.Region, s3Bucket, &config.Exclude)
-	invalidateCloudfront(s3Url, changedFiles)
+	manifest, err := buildDeployManifest(config, releaseID, invalidationID, localFiles)
+	if err != nil {
+		return err
+	}
+	if err = writeDeployManifest(config, manifest); err != nil {
+		return err
+	}
 
 	logf("Deployed to https://%v", config.Domain)
+	return nil
 }
@@ -0,0 +1,1008 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const testConfig = `domain: example.com
+name: example
+region: us-west-2
+exclude:
+  - "^scarr.yml$"
+`
+
+var testSite = map[string]string{
+	"index.html":       "<h1>home</h1>",
+	"about/index.html": "<h1>about</h1>",
+	"style.css":        "h1 { color: red }",
+}
+
+// Writes the given files (plus testConfig as scarr.yml, unless files has its
+// own) to a temp dir and makes it the working directory, since that's where
+// deploy looks.  Returns a func that undoes all that.
+func useSite(t *testing.T, files map[string]string) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "scarr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files["scarr.yml"]; !ok {
+		files["scarr.yml"] = testConfig
+	}
+	for name, content := range files {
+		writeSiteFile(t, dir, name, content)
+	}
+	oldDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(oldDir)
+		os.RemoveAll(dir)
+	}
+}
+
+// Feeds answers to confirm's prompts until the returned function is called.
+func answerPrompts(t *testing.T, answers string) func() {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.WriteString(answers)
+	writer.Close()
+	original := os.Stdin
+	os.Stdin = reader
+	return func() {
+		os.Stdin = original
+		reader.Close()
+	}
+}
+
+// Runs run with stdout going to a buffer, and returns what it printed.
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := os.Stdout
+	os.Stdout = writer
+	err = run()
+	os.Stdout = original
+	writer.Close()
+	output, readErr := ioutil.ReadAll(reader)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(output), err
+}
+
+func writeSiteFile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func copySite() map[string]string {
+	files := map[string]string{}
+	for name, content := range testSite {
+		files[name] = content
+	}
+	return files
+}
+
+// The bucket's keys, minus scarr's own under .scarr/.
+func bucketKeys(fake *fakeAWS, bucket string) []string {
+	keys := []string{}
+	for key := range fake.buckets[bucket].objects {
+		if !isScarrKey(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func expectCalls(t *testing.T, fake *fakeAWS, expected map[string]int) {
+	t.Helper()
+	for call, count := range expected {
+		if actual := fake.callCount(call); actual != count {
+			t.Errorf("expected %v %v time(s), got %v", call, count, actual)
+		}
+	}
+}
+
+// Sets up everything a previous deploy would have, minus the files.
+func seedInfrastructure(fake *fakeAWS) {
+	fake.registered["example.com"] = true
+	zone := fake.addZone("example.com")
+	cert := fake.addCert("example.com", "ISSUED")
+	zone.records = append(zone.records, &route53.ResourceRecordSet{
+		Name:            cert.record.Name,
+		Type:            cert.record.Type,
+		TTL:             aws.Int64(300),
+		ResourceRecords: []*route53.ResourceRecord{{Value: cert.record.Value}},
+	})
+	fake.buckets["example-bucket"] = &fakeBucket{website: true, objects: map[string]fakeObject{}}
+	config := configType{Domain: "example.com", Name: "example", Region: "us-west-2"}
+	distribution := fake.addDistribution(buildDistributionConfig(config, cert.arn, "", "", ""))
+	for _, recordType := range aliasRecordTypes {
+		zone.records = append(zone.records, &route53.ResourceRecordSet{
+			Name: aws.String("example.com."),
+			Type: aws.String(recordType),
+			AliasTarget: &route53.AliasTarget{
+				DNSName:      distribution.DomainName,
+				HostedZoneId: aws.String("Z2FDTNDATAQYW2"),
+			},
+		})
+	}
+}
+
+func TestDeployFreshAccount(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCalls(t, fake, map[string]int{
+		"route53domains.RegisterDomain":    1,
+		"acm.RequestCertificate":           1,
+		"s3.CreateBucket":                  1,
+		"s3.PutBucketWebsite":              1,
+		"cloudfront.CreateDistribution":    1,
+		"cloudfront.CreateInvalidation":    1,
+		"s3.Upload":                        3,
+		"route53.ChangeResourceRecordSets": 3,
+	})
+
+	for _, recordType := range aliasRecordTypes {
+		if !fake.hasRecord("example.com", recordType) {
+			t.Errorf("expected an %v alias record for example.com", recordType)
+		}
+	}
+	if fake.certs[0].status != "ISSUED" {
+		t.Errorf("expected certificate to be validated, got %v", fake.certs[0].status)
+	}
+	if !fake.buckets["example-bucket"].website {
+		t.Error("expected bucket to be configured as a website")
+	}
+
+	expectedKeys := []string{"about/index.html", "index.html", "style.css"}
+	if keys := bucketKeys(fake, "example-bucket"); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("expected bucket to contain %v, got %v", expectedKeys, keys)
+	}
+	uploaded := fake.buckets["example-bucket"].objects["style.css"]
+	if *uploaded.input.ContentType != "text/css" {
+		t.Errorf("expected style.css to be uploaded as css, got %v", *uploaded.input.ContentType)
+	}
+
+	invalidated := append([]string{}, fake.invalidations[0]...)
+	sort.Strings(invalidated)
+	expectedPaths := []string{"/", "/about", "/about/", "/about/index.html", "/index.html", "/style.css"}
+	if !reflect.DeepEqual(invalidated, expectedPaths) {
+		t.Errorf("expected invalidation of %v, got %v", expectedPaths, invalidated)
+	}
+}
+
+func TestDeployPartiallySetUpAccount(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	// Domain's registered and the cert was requested, but the last deploy
+	// died before validating it or making anything else.
+	fake.registered["example.com"] = true
+	fake.addZone("example.com")
+	fake.addCert("example.com", "PENDING_VALIDATION")
+
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCalls(t, fake, map[string]int{
+		"route53domains.CheckDomainAvailability": 0,
+		"route53domains.RegisterDomain":          0,
+		"acm.RequestCertificate":                 0,
+		"s3.CreateBucket":                        1,
+		"cloudfront.CreateDistribution":          1,
+		"s3.Upload":                              3,
+		"cloudfront.CreateInvalidation":          1,
+	})
+	if len(fake.certs) != 1 || fake.certs[0].status != "ISSUED" {
+		t.Error("expected the existing certificate to be validated")
+	}
+	for _, recordType := range aliasRecordTypes {
+		if !fake.hasRecord("example.com", recordType) {
+			t.Errorf("expected an %v alias record for example.com", recordType)
+		}
+	}
+}
+
+func TestDeployFullySetUpAccount(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	defer useSite(t, files)()
+
+	seedInfrastructure(fake)
+	// style.css is already up to date, index.html is stale, about/index.html
+	// is missing and old.html has since been deleted locally.
+	fake.putObject("example-bucket", "style.css", []byte(files["style.css"]), s3manager.UploadInput{})
+	fake.putObject("example-bucket", "index.html", []byte("<h1>old home</h1>"), s3manager.UploadInput{})
+	fake.putObject("example-bucket", "old.html", []byte("old"), s3manager.UploadInput{})
+
+	if err := runDeploy(false, false, false, false, false, true, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCalls(t, fake, map[string]int{
+		"route53domains.RegisterDomain":    0,
+		"acm.RequestCertificate":           0,
+		"s3.CreateBucket":                  0,
+		"s3.PutBucketWebsite":              0,
+		"cloudfront.CreateDistribution":    0,
+		"route53.ChangeResourceRecordSets": 0,
+		"s3.Upload":                        2,
+		"s3.DeleteObjects":                 1,
+		"cloudfront.CreateInvalidation":    1,
+	})
+
+	expectedKeys := []string{"about/index.html", "index.html", "style.css"}
+	if keys := bucketKeys(fake, "example-bucket"); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("expected bucket to contain %v, got %v", expectedKeys, keys)
+	}
+	if body := string(fake.buckets["example-bucket"].objects["index.html"].body); body != files["index.html"] {
+		t.Errorf("expected index.html to be updated, got %v", body)
+	}
+
+	invalidated := append([]string{}, fake.invalidations[0]...)
+	sort.Strings(invalidated)
+	expectedPaths := []string{"/", "/about", "/about/", "/about/index.html", "/index.html", "/old.html"}
+	if !reflect.DeepEqual(invalidated, expectedPaths) {
+		t.Errorf("expected invalidation of %v, got %v", expectedPaths, invalidated)
+	}
+}
+
+func TestDeployNothingChanged(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	uploads := fake.callCount("s3.Upload")
+
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if fake.callCount("s3.Upload") != uploads {
+		t.Error("expected a second deploy not to upload anything")
+	}
+	expectCalls(t, fake, map[string]int{
+		"route53domains.RegisterDomain": 1,
+		"acm.RequestCertificate":        1,
+		"cloudfront.CreateDistribution": 1,
+		"cloudfront.CreateInvalidation": 1,
+	})
+}
+
+func TestDeployUnavailableDomain(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	fake.unavailable["example.com"] = true
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err == nil {
+		t.Fatal("expected deploy to fail when the domain can't be registered")
+	}
+	expectCalls(t, fake, map[string]int{
+		"route53domains.RegisterDomain": 0,
+		"acm.RequestCertificate":        0,
+		"s3.CreateBucket":               0,
+		"cloudfront.CreateDistribution": 0,
+	})
+}
+
+func TestDeployFindsResourcesOnLaterPages(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	// Lots of unrelated stuff in the account pushes ours past the first page
+	for i := 0; i < 5; i++ {
+		other := fmt.Sprintf("other%v.com", i)
+		fake.addZone(other)
+		fake.addCert(other, "ISSUED")
+		fake.addDistribution(&cloudfront.DistributionConfig{
+			Enabled: aws.Bool(true),
+			Origins: &cloudfront.Origins{
+				Quantity: aws.Int64(1),
+				Items:    []*cloudfront.Origin{{DomainName: aws.String(getS3WebsiteDomain(other, "us-west-2"))}},
+			},
+		})
+	}
+	seedInfrastructure(fake)
+	zone := fake.zones[len(fake.zones)-1]
+	for i := 0; i < 5; i++ {
+		zone.records = append([]*route53.ResourceRecordSet{{
+			Name: aws.String(fmt.Sprintf("host%v.example.com.", i)),
+			Type: aws.String("A"),
+		}}, zone.records...)
+	}
+
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"acm.RequestCertificate":           0,
+		"cloudfront.CreateDistribution":    0,
+		"route53.ChangeResourceRecordSets": 0,
+	})
+	if fake.callCount("route53.ListHostedZones") < 2 || fake.callCount("acm.ListCertificates") < 2 ||
+		fake.callCount("cloudfront.ListDistributions") < 2 || fake.callCount("route53.ListResourceRecordSets") < 2 {
+		t.Error("expected lookups to go through more than one page")
+	}
+}
+
+func TestDeployCreatesMissingHostedZone(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	// Registered (eg just transferred in), but with no hosted zone
+	fake.registered["example.com"] = true
+	fake.domainNameServers["example.com"] = []string{"ns1.oldregistrar.com"}
+
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"route53.CreateHostedZone":               1,
+		"route53domains.UpdateDomainNameservers": 1,
+		"cloudfront.CreateDistribution":          1,
+	})
+	if len(fake.zones) != 1 || fake.zones[0].name != "example.com." {
+		t.Fatalf("expected a hosted zone for example.com, got %v", fake.zones)
+	}
+	if !reflect.DeepEqual(fake.domainNameServers["example.com"], fake.zones[0].nameServers) {
+		t.Errorf("expected the domain to use the new zone's name servers, got %v", fake.domainNameServers["example.com"])
+	}
+	if !fake.hasRecord("example.com", "A") {
+		t.Error("expected an alias record in the new zone")
+	}
+}
+
+func TestEnsureHostedZoneForExternalDomain(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+
+	// Registered somewhere other than route53
+	fake.unavailable["example.com"] = true
+
+	if err := ensureHostedZone("www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"route53.CreateHostedZone":               1,
+		"route53domains.UpdateDomainNameservers": 0,
+	})
+	if len(fake.zones) != 1 || fake.zones[0].name != "example.com." {
+		t.Errorf("expected a hosted zone for example.com, got %v", fake.zones)
+	}
+}
+
+func TestDeployExternalDNS(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	// Registered and hosted elsewhere.  The records scarr prints "get created"
+	// the first time it waits for them.
+	fake.unavailable["example.com"] = true
+	sleep = func(time.Duration) {
+		for _, cert := range fake.certs {
+			fake.addPublicCNAME(*cert.record.Name, *cert.record.Value)
+		}
+		for _, distribution := range fake.distributions {
+			fake.addPublicCNAME("example.com", *distribution.distribution.DomainName)
+		}
+	}
+
+	if err := runDeploy(false, false, false, true, true, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"route53domains.GetDomainDetail":   0,
+		"route53.ListHostedZones":          0,
+		"route53.CreateHostedZone":         0,
+		"route53.ChangeResourceRecordSets": 0,
+		"acm.RequestCertificate":           1,
+		"cloudfront.CreateDistribution":    1,
+		"s3.Upload":                        3,
+	})
+	if fake.certs[0].status != "ISSUED" {
+		t.Errorf("expected certificate to be validated, got %v", fake.certs[0].status)
+	}
+}
+
+func TestDeployWWWRedirect(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "redirects:\n  www: apex\n"
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"cloudfront.CreateFunction":     1,
+		"cloudfront.PublishFunction":    1,
+		"cloudfront.CreateDistribution": 1,
+		"cloudfront.UpdateDistribution": 0,
+	})
+
+	function := fake.functions["example-viewer-request"]
+	if function == nil || function.liveCode == nil {
+		t.Fatal("expected a published viewer request function")
+	}
+	if code := string(function.liveCode); !strings.Contains(code, `if (host === "www.example.com")`) ||
+		!strings.Contains(code, `redirect(301, "https://example.com" + request.uri`) {
+		t.Errorf("expected the function to redirect www to the apex, got %v", code)
+	}
+
+	var distributionConfig *cloudfront.DistributionConfig
+	for _, distribution := range fake.distributions {
+		distributionConfig = distribution.distribution.DistributionConfig
+	}
+	aliases := aws.StringValueSlice(distributionConfig.Aliases.Items)
+	if !reflect.DeepEqual(aliases, []string{"example.com", "www.example.com"}) {
+		t.Errorf("expected both domains as aliases, got %v", aliases)
+	}
+	associations := distributionConfig.DefaultCacheBehavior.FunctionAssociations
+	if *associations.Quantity != 1 || *associations.Items[0].FunctionARN != function.arn {
+		t.Errorf("expected the function to be attached to the distribution, got %v", associations)
+	}
+	for _, domain := range []string{"example.com", "www.example.com"} {
+		for _, recordType := range aliasRecordTypes {
+			if !fake.hasRecord(domain, recordType) {
+				t.Errorf("expected an %v alias record for %v", recordType, domain)
+			}
+		}
+	}
+}
+
+func TestDeployAddsWWWRedirectToExistingSite(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "redirects:\n  www: www-primary\n"
+	defer useSite(t, files)()
+
+	seedInfrastructure(fake)
+
+	if err := runDeploy(false, false, true, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"cloudfront.CreateFunction":        1,
+		"cloudfront.CreateDistribution":    0,
+		"cloudfront.UpdateDistribution":    1,
+		"route53.ChangeResourceRecordSets": 2,
+	})
+	for _, recordType := range aliasRecordTypes {
+		if !fake.hasRecord("www.example.com", recordType) {
+			t.Errorf("expected an %v alias record for www.example.com", recordType)
+		}
+	}
+	if code := string(fake.functions["example-viewer-request"].liveCode); !strings.Contains(code, `if (host === "example.com")`) {
+		t.Errorf("expected the function to redirect the apex to www, got %v", code)
+	}
+
+	// Nothing left to change the second time around
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"cloudfront.UpdateFunction":     0,
+		"cloudfront.UpdateDistribution": 1,
+	})
+}
+
+func TestDeployAddsIPv6ToExistingSite(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	// Deployed by a version of scarr from before IPv6 support
+	seedInfrastructure(fake)
+	for _, distribution := range fake.distributions {
+		distribution.distribution.DistributionConfig.IsIPV6Enabled = aws.Bool(false)
+	}
+	zone := fake.zones[0]
+	zone.records = zone.records[:zone.find("example.com.", "AAAA")]
+
+	if err := runDeploy(false, false, true, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"cloudfront.CreateDistribution":    0,
+		"cloudfront.UpdateDistribution":    1,
+		"route53.ChangeResourceRecordSets": 1,
+	})
+	for _, distribution := range fake.distributions {
+		if !*distribution.distribution.DistributionConfig.IsIPV6Enabled {
+			t.Error("expected IPv6 to be enabled on the distribution")
+		}
+	}
+	if !fake.hasRecord("example.com", "AAAA") {
+		t.Error("expected an AAAA alias record for example.com")
+	}
+}
+
+func TestDeployReconcilesDrift(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	// Someone's been poking at the distribution in the console
+	seedInfrastructure(fake)
+	var distributionConfig *cloudfront.DistributionConfig
+	for _, distribution := range fake.distributions {
+		distributionConfig = distribution.distribution.DistributionConfig
+	}
+	distributionConfig.PriceClass = aws.String("PriceClass_100")
+	distributionConfig.ViewerCertificate.MinimumProtocolVersion = aws.String("SSLv3")
+	distributionConfig.Aliases.Items = append(distributionConfig.Aliases.Items, aws.String("old.example.com"))
+	distributionConfig.Aliases.Quantity = aws.Int64(2)
+	comment := "edited by hand"
+	distributionConfig.Comment = &comment
+
+	// Without -yes there's no one to approve the update
+	if err := runDeploy(false, false, false, false, false, false, 4); err == nil {
+		t.Fatal("expected deploy to refuse to update the distribution without approval")
+	}
+	expectCalls(t, fake, map[string]int{"cloudfront.UpdateDistribution": 0})
+
+	if err := runDeploy(false, false, true, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{"cloudfront.UpdateDistribution": 1})
+	for _, distribution := range fake.distributions {
+		distributionConfig = distribution.distribution.DistributionConfig
+	}
+	if *distributionConfig.PriceClass != "PriceClass_All" || *distributionConfig.ViewerCertificate.MinimumProtocolVersion != "TLSv1" {
+		t.Errorf("expected the price class and TLS version to be reset, got %v", distributionConfig)
+	}
+	if aliases := aws.StringValueSlice(distributionConfig.Aliases.Items); !reflect.DeepEqual(aliases, []string{"example.com"}) {
+		t.Errorf("expected the extra alias to be removed, got %v", aliases)
+	}
+	if *distributionConfig.Comment != comment {
+		t.Errorf("expected settings scarr doesn't manage to be left alone, got comment %v", *distributionConfig.Comment)
+	}
+}
+
+func TestDeployHeaderRules(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "headers:\n  - glob: \"*.css\"\n    cacheControl: max-age=31536000\n"
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if cacheControl := fake.buckets["example-bucket"].objects["style.css"].input.CacheControl; aws.StringValue(cacheControl) != "max-age=31536000" {
+		t.Errorf("expected style.css to get the rule's cache-control, got %v", cacheControl)
+	}
+
+	// Removing the last rule strips the header from the unchanged file
+	files["scarr.yml"] = testConfig
+	defer useSite(t, files)()
+	uploads := fake.callCount("s3.Upload")
+	heads := fake.callCount("s3.HeadObject")
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded := fake.callCount("s3.Upload") - uploads; uploaded != 1 {
+		t.Errorf("expected only style.css to be re-uploaded, got %v uploads", uploaded)
+	}
+	if cacheControl := fake.buckets["example-bucket"].objects["style.css"].input.CacheControl; cacheControl != nil {
+		t.Errorf("expected style.css's cache-control to be removed, got %v", *cacheControl)
+	}
+	// The first deploy's manifest knows every file's headers
+	if headed := fake.callCount("s3.HeadObject") - heads; headed != 0 {
+		t.Errorf("expected no HEAD requests with a manifest to go by, got %v", headed)
+	}
+
+	// An object modified since the last manifest (eg by a deploy that failed
+	// partway) gets checked with a HEAD
+	style := fake.buckets["example-bucket"].objects["style.css"]
+	fake.putObject("example-bucket", "style.css", style.body, s3manager.UploadInput{CacheControl: aws.String("no-cache")})
+	uploads = fake.callCount("s3.Upload")
+	heads = fake.callCount("s3.HeadObject")
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if headed := fake.callCount("s3.HeadObject") - heads; headed != 1 {
+		t.Errorf("expected only style.css to be checked with a HEAD, got %v", headed)
+	}
+	if uploaded := fake.callCount("s3.Upload") - uploads; uploaded != 1 {
+		t.Errorf("expected only style.css to be re-uploaded, got %v uploads", uploaded)
+	}
+	if cacheControl := fake.buckets["example-bucket"].objects["style.css"].input.CacheControl; cacheControl != nil {
+		t.Errorf("expected style.css's cache-control to be removed, got %v", *cacheControl)
+	}
+}
+
+func TestDeployPrivateOrigin(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "origin: private\n"
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"s3.PutBucketWebsite":                  0,
+		"s3.PutPublicAccessBlock":              1,
+		"cloudfront.CreateOriginAccessControl": 1,
+		"cloudfront.CreateDistribution":        1,
+		"s3.PutBucketPolicy":                   1,
+		"s3.Upload":                            3,
+	})
+
+	bucket := fake.buckets["example-bucket"]
+	if block := bucket.publicAccessBlock; block == nil || !*block.BlockPublicAcls || !*block.RestrictPublicBuckets {
+		t.Errorf("expected the bucket to block public access, got %v", block)
+	}
+	for key, object := range bucket.objects {
+		if object.input.GrantRead != nil {
+			t.Errorf("expected %v to be uploaded without a public-read grant", key)
+		}
+	}
+
+	var distribution *cloudfront.Distribution
+	for _, fakeDistribution := range fake.distributions {
+		distribution = fakeDistribution.distribution
+	}
+	origin := distribution.DistributionConfig.Origins.Items[0]
+	if *origin.DomainName != "example-bucket.s3.us-west-2.amazonaws.com" || origin.S3OriginConfig == nil || origin.CustomOriginConfig != nil {
+		t.Errorf("expected an s3 REST origin, got %v", origin)
+	}
+	if fake.originAccessControls[aws.StringValue(origin.OriginAccessControlId)] != "example-oac" {
+		t.Errorf("expected the origin to use the origin access control, got %v", origin.OriginAccessControlId)
+	}
+	if !strings.Contains(bucket.policy, `"AWS:SourceArn":"`+*distribution.ARN+`"`) {
+		t.Errorf("expected the bucket policy to only trust the distribution, got %v", bucket.policy)
+	}
+	if code := string(fake.functions["example-viewer-request"].liveCode); !strings.Contains(code, "request.uri += 'index.html'") {
+		t.Errorf("expected the function to serve index documents, got %v", code)
+	}
+
+	// A second deploy finds everything in place
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"s3.PutPublicAccessBlock":              1,
+		"cloudfront.CreateOriginAccessControl": 1,
+		"cloudfront.UpdateDistribution":        0,
+		"s3.PutBucketPolicy":                   1,
+	})
+}
+
+func TestDeploySwitchesToPrivateOrigin(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "origin: private\n"
+	defer useSite(t, files)()
+
+	seedInfrastructure(fake)
+
+	if err := runDeploy(false, false, true, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"s3.CreateBucket":               0,
+		"s3.PutPublicAccessBlock":       1,
+		"cloudfront.CreateDistribution": 0,
+		"cloudfront.UpdateDistribution": 1,
+		"s3.PutBucketPolicy":            1,
+	})
+	for _, distribution := range fake.distributions {
+		origin := distribution.distribution.DistributionConfig.Origins.Items[0]
+		if *origin.DomainName != "example-bucket.s3.us-west-2.amazonaws.com" || aws.StringValue(origin.OriginAccessControlId) == "" {
+			t.Errorf("expected the distribution to switch to the private origin, got %v", origin)
+		}
+	}
+
+	// The site stays up throughout: cloudfront can read the bucket before it
+	// moves to the REST endpoint, and public access is only blocked after
+	policy, update, block := callIndex(fake, "s3.PutBucketPolicy"), callIndex(fake, "cloudfront.UpdateDistribution"), callIndex(fake, "s3.PutPublicAccessBlock")
+	if !(policy < update && update < block) {
+		t.Errorf("expected the bucket policy, then the distribution update, then the public access block, got %v", fake.calls)
+	}
+}
+
+// The position of the first call to the given "service.Operation", or -1.
+func callIndex(fake *fakeAWS, call string) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for i, c := range fake.calls {
+		if c == call {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestDeploySwitchToPrivateOriginDeclined(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "origin: private\n"
+	defer useSite(t, files)()
+	seedInfrastructure(fake)
+
+	// Answer no to updating the distribution
+	defer answerPrompts(t, "n\n")()
+
+	err := runDeploy(false, false, false, false, false, false, 4)
+	if err == nil || !strings.Contains(err.Error(), "website endpoint") {
+		t.Errorf("expected the deploy to stop before syncing, got %v", err)
+	}
+	// Still on the website endpoint, so the bucket has to stay public, and
+	// nothing gets uploaded without a public-read grant
+	expectCalls(t, fake, map[string]int{
+		"cloudfront.UpdateDistribution": 0,
+		"s3.PutPublicAccessBlock":       0,
+		"s3.Upload":                     0,
+	})
+}
+
+func TestDeployErrorPages(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + `errors:
+  notFoundPage: 404.html
+  responses:
+    - status: 500
+      page: /500.html
+      responseCode: 503
+      ttl: 0
+`
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if document := fake.buckets["example-bucket"].errorDocument; document != "404.html" {
+		t.Errorf("expected the bucket's error document to be 404.html, got %q", document)
+	}
+	var distribution *cloudfront.Distribution
+	for _, fakeDistribution := range fake.distributions {
+		distribution = fakeDistribution.distribution
+	}
+	expected := "404 /404.html (404) ttl 10, 500 /500.html (503) ttl 0"
+	if described := describeErrorResponses(distribution.DistributionConfig); described != expected {
+		t.Errorf("expected error responses %v, got %v", expected, described)
+	}
+
+	// Switching to a single page app swaps the responses for the fallback
+	files["scarr.yml"] = testConfig + "spa: true\n"
+	defer useSite(t, files)()
+	if err := runDeploy(false, false, true, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{"cloudfront.UpdateDistribution": 1})
+	expected = "403 /index.html (200) ttl 10, 404 /index.html (200) ttl 10"
+	if described := describeErrorResponses(distribution.DistributionConfig); described != expected {
+		t.Errorf("expected error responses %v, got %v", expected, described)
+	}
+}
+
+func TestDeployRedirectRules(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "redirects:\n  - from: /blog/*\n    to: /posts/*\n"
+	files["_redirects"] = "/about/* /team/* 302\n"
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expected := "blog/  301 https example.com posts/ \nabout/  302 https example.com team/ "
+	if described := describeRoutingRules(fake.buckets["example-bucket"].routingRules); described != expected {
+		t.Errorf("expected routing rules %q, got %q", expected, described)
+	}
+	if _, ok := fake.buckets["example-bucket"].objects["_redirects"]; ok {
+		t.Error("expected the _redirects file not to be uploaded")
+	}
+
+	// Nothing to change the second time around
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{"s3.PutBucketWebsite": 1})
+}
+
+func TestDeployRedirectRulesPrivateOrigin(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "origin: private\nredirects:\n  - from: /blog/*\n    to: /posts/*\n    status: 308\n"
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	code := string(fake.functions["example-viewer-request"].liveCode)
+	if !strings.Contains(code, `if (request.uri.indexOf("/blog/") === 0) {
+        return redirect(308, "/posts/" + request.uri.substring(6) + querystring(request));`) {
+		t.Errorf("expected the function to redirect /blog/*, got %v", code)
+	}
+}
+
+func TestDeploySecurityHeaders(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	files := copySite()
+	files["scarr.yml"] = testConfig + "securityHeaders: default\n"
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	var distribution *cloudfront.Distribution
+	for _, fakeDistribution := range fake.distributions {
+		distribution = fakeDistribution.distribution
+	}
+	policyID := aws.StringValue(distribution.DistributionConfig.DefaultCacheBehavior.ResponseHeadersPolicyId)
+	if policy := fake.responseHeadersPolicies[policyID]; policy == nil || *policy.Name != "example-headers" {
+		t.Fatalf("expected the distribution to use the example-headers policy, got %v", policyID)
+	}
+
+	// Nothing to change the second time around
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"cloudfront.CreateResponseHeadersPolicy": 1,
+		"cloudfront.UpdateResponseHeadersPolicy": 0,
+		"cloudfront.UpdateDistribution":          0,
+	})
+
+	// Adding cors updates the policy, and the distribution so preflight
+	// requests get through
+	files["scarr.yml"] = testConfig + "securityHeaders:\n  cors:\n    allowOrigins: [\"https://app.example.com\"]\n"
+	defer useSite(t, files)()
+	if err := runDeploy(false, false, true, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls(t, fake, map[string]int{
+		"cloudfront.UpdateResponseHeadersPolicy": 1,
+		"cloudfront.UpdateDistribution":          1,
+	})
+	if fake.responseHeadersPolicies[policyID].CorsConfig == nil {
+		t.Errorf("expected the policy to have cors settings")
+	}
+	if methods := describeAllowedMethods(distribution.DistributionConfig); methods != "GET, HEAD, OPTIONS" {
+		t.Errorf("expected OPTIONS to be allowed, got %v", methods)
+	}
+}
+
+func TestGetInvalidationPaths(t *testing.T) {
+	cases := []struct {
+		name      string
+		changed   []string
+		threshold int
+		expected  []string
+	}{
+		{name: "plain files", changed: []string{"style.css", "img/logo.png"}, threshold: 100, expected: []string{"/style.css", "/img/logo.png"}},
+		{name: "root index", changed: []string{"index.html"}, threshold: 100, expected: []string{"/index.html", "/"}},
+		{name: "directory index", changed: []string{"docs/index.html"}, threshold: 100, expected: []string{"/docs/index.html", "/docs/", "/docs"}},
+		{name: "escaped", changed: []string{"my file.html"}, threshold: 100, expected: []string{"/my%20file.html"}},
+		{name: "at the threshold", changed: []string{"a", "b", "c"}, threshold: 3, expected: []string{"/a", "/b", "/c"}},
+		// The directory paths count towards the threshold too
+		{name: "over the threshold", changed: []string{"a", "docs/index.html"}, threshold: 3, expected: []string{"/*"}},
+	}
+	for _, c := range cases {
+		if paths := getInvalidationPaths(c.changed, c.threshold); !reflect.DeepEqual(paths, c.expected) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.expected, paths)
+		}
+	}
+}
+
+func TestDefaultInvalidationThreshold(t *testing.T) {
+	defer useSite(t, copySite())()
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.InvalidationThreshold != 100 {
+		t.Fatalf("expected the threshold to default to 100, got %v", config.InvalidationThreshold)
+	}
+
+	changed := []string{}
+	for i := 0; i < 100; i++ {
+		changed = append(changed, fmt.Sprintf("page%v.html", i))
+	}
+	if paths := getInvalidationPaths(changed, config.InvalidationThreshold); len(paths) != 100 {
+		t.Errorf("expected 100 paths to be invalidated one by one, got %v paths", len(paths))
+	}
+	changed = append(changed, "page100.html")
+	if paths := getInvalidationPaths(changed, config.InvalidationThreshold); !reflect.DeepEqual(paths, []string{"/*"}) {
+		t.Errorf("expected 101 paths to fall back to /*, got %v paths", len(paths))
+	}
+}
+
+func TestDeployCompress(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	seedInfrastructure(fake)
+	files := copySite()
+	files["scarr.yml"] = testConfig + "compress:\n  extensions: [css]\n"
+	defer useSite(t, files)()
+
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	style := fake.buckets["example-bucket"].objects["style.css"]
+	if aws.StringValue(style.input.ContentEncoding) != "gzip" || aws.StringValue(style.input.ContentType) != "text/css" {
+		t.Errorf("expected style.css to be stored gzipped as text/css, got %v and %v", style.input.ContentEncoding, style.input.ContentType)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(style.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := ioutil.ReadAll(reader); err != nil || string(body) != files["style.css"] {
+		t.Errorf("expected style.css's body to decompress to the original, got %q (%v)", body, err)
+	}
+	if index := fake.buckets["example-bucket"].objects["index.html"]; index.input.ContentEncoding != nil {
+		t.Errorf("expected index.html not to be compressed, got %v", *index.input.ContentEncoding)
+	}
+
+	// Compressed files compare by their compressed hash, so nothing changed
+	uploads := fake.callCount("s3.Upload")
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded := fake.callCount("s3.Upload") - uploads; uploaded != 0 {
+		t.Errorf("expected nothing to be re-uploaded, got %v uploads", uploaded)
+	}
+}
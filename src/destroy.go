@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// A dns record and the hosted zone it's in.
+type zoneRecord struct {
+	hostedZoneID string
+	record       *route53.ResourceRecordSet
+}
+
+// Everything destroy found that deploy created.  Nil/empty fields weren't found
+// and get skipped.
+type destroyTargets struct {
+	hostedZoneID     string
+	aliasRecords     []zoneRecord
+	distributionID   *string
+	cloudfrontDomain *string
+	functionName     string
+	// The origin access control, for a private origin
+	originAccessControlID   string
+	responseHeadersPolicyID string
+	bucket                  string
+	certificateArn          *string
+	validationRecord        *route53.ResourceRecordSet
+}
+
+func findDestroyTargets(config configType) (destroyTargets, error) {
+	targets := destroyTargets{}
+	s3Bucket := getBucketName(config)
+
+	var err error
+	if targets.hostedZoneID, err = findHostedZone(config.Domain); err != nil {
+		return targets, err
+	}
+	for _, domain := range getSiteDomains(config) {
+		hostedZoneID, err := findHostedZone(domain)
+		if err != nil {
+			return targets, err
+		}
+		if hostedZoneID == "" {
+			continue
+		}
+		for _, recordType := range aliasRecordTypes {
+			aliasRecord, err := getDNSRecord(hostedZoneID, domain, recordType)
+			if err != nil {
+				return targets, err
+			}
+			if aliasRecord != nil {
+				targets.aliasRecords = append(targets.aliasRecords, zoneRecord{hostedZoneID, aliasRecord})
+			}
+		}
+	}
+
+	if targets.cloudfrontDomain, targets.distributionID, err = getCloudfront(getOriginDomains(config)); err != nil {
+		return targets, err
+	}
+
+	// Looked up even if the config no longer needs one, in case it used to
+	functionName := getFunctionName(config)
+	function, _, err := describeCloudFrontFunction(functionName)
+	if err != nil {
+		return targets, err
+	}
+	if function != nil {
+		targets.functionName = functionName
+	}
+	// Likewise for the origin access control
+	if targets.originAccessControlID, err = findOriginAccessControl(getOriginAccessControlName(config)); err != nil {
+		return targets, err
+	}
+	// And the response headers policy
+	if targets.responseHeadersPolicyID, err = findResponseHeadersPolicy(getResponseHeadersPolicyName(config)); err != nil {
+		return targets, err
+	}
+
+	exists, err := bucketExists(s3Bucket, config.Region)
+	if err != nil {
+		return targets, err
+	}
+	if exists {
+		targets.bucket = s3Bucket
+	}
+
+	if targets.certificateArn, err = getAcmCertificateARN(config.Domain); err != nil {
+		return targets, err
+	}
+	if targets.certificateArn != nil && targets.hostedZoneID != "" {
+		validation, err := getCertificateValidation(*targets.certificateArn)
+		if err != nil {
+			return targets, err
+		}
+		if validation.ResourceRecord != nil {
+			dns := validation.ResourceRecord
+			if targets.validationRecord, err = getDNSRecord(targets.hostedZoneID, *dns.Name, *dns.Type); err != nil {
+				return targets, err
+			}
+		}
+	}
+	return targets, nil
+}
+
+func describeDestroyTargets(targets destroyTargets) []string {
+	descriptions := []string{}
+	for _, alias := range targets.aliasRecords {
+		descriptions = append(descriptions, "Route53 "+*alias.record.Type+" record "+*alias.record.Name)
+	}
+	if targets.distributionID != nil {
+		descriptions = append(descriptions, "CloudFront distribution "+*targets.distributionID+" ("+*targets.cloudfrontDomain+")")
+	}
+	if targets.functionName != "" {
+		descriptions = append(descriptions, "CloudFront function "+targets.functionName)
+	}
+	if targets.originAccessControlID != "" {
+		descriptions = append(descriptions, "CloudFront origin access control "+targets.originAccessControlID)
+	}
+	if targets.responseHeadersPolicyID != "" {
+		descriptions = append(descriptions, "CloudFront response headers policy "+targets.responseHeadersPolicyID)
+	}
+	if targets.bucket != "" {
+		descriptions = append(descriptions, "S3 bucket "+targets.bucket+" and everything in it")
+	}
+	if targets.validationRecord != nil {
+		descriptions = append(descriptions, "Route53 "+*targets.validationRecord.Type+" record "+*targets.validationRecord.Name+" (ACM validation)")
+	}
+	if targets.certificateArn != nil {
+		descriptions = append(descriptions, "ACM certificate "+*targets.certificateArn)
+	}
+	return descriptions
+}
+
+// Tears down everything deploy set up, except for the domain registration and
+// hosted zone.
+func runDestroy(autoApprove bool) error {
+	config, err := getConfig()
+	if err != nil {
+		return err
+	}
+
+	log("Looking for resources to delete...")
+	targets, err := findDestroyTargets(config)
+	if err != nil {
+		return err
+	}
+	logln(" done")
+
+	descriptions := describeDestroyTargets(targets)
+	if len(descriptions) == 0 {
+		logln("Nothing to delete")
+		return nil
+	}
+
+	// Always show what's about to go, even with -silent
+	fmt.Println("This will permanently delete:")
+	for _, description := range descriptions {
+		fmt.Println("  - " + description)
+	}
+	fmt.Println("The domain " + getRootDomain(config.Domain) + " and its hosted zone will not be touched.")
+	if !autoApprove {
+		confirmed, err := confirm("Delete all of the above?")
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			return errors.New("aborted")
+		}
+	}
+
+	for _, alias := range targets.aliasRecords {
+		log("Deleting alias record " + *alias.record.Name + "...")
+		if err = deleteDNSRecord(alias.hostedZoneID, alias.record); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+	if targets.distributionID != nil {
+		log("Disabling cloudfront distribution...")
+		if err = disableCloudFront(*targets.distributionID); err != nil {
+			return err
+		}
+		log(" deleting...")
+		if err = deleteCloudFront(*targets.distributionID); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+	if targets.functionName != "" {
+		// Like the certificate, this has to wait for the distribution to go
+		log("Deleting cloudfront function...")
+		if err = deleteCloudFrontFunction(targets.functionName); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+	if targets.originAccessControlID != "" {
+		log("Deleting origin access control...")
+		if err = deleteOriginAccessControl(targets.originAccessControlID); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+	if targets.responseHeadersPolicyID != "" {
+		log("Deleting response headers policy...")
+		if err = deleteResponseHeadersPolicy(targets.responseHeadersPolicyID); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+	if targets.bucket != "" {
+		log("Emptying bucket " + targets.bucket + "...")
+		if err = emptyBucket(targets.bucket, config.Region); err != nil {
+			return err
+		}
+		log(" deleting...")
+		if err = deleteBucket(targets.bucket, config.Region); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+	if targets.validationRecord != nil {
+		log("Deleting certificate validation record...")
+		if err = deleteDNSRecord(targets.hostedZoneID, targets.validationRecord); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+	if targets.certificateArn != nil {
+		// The certificate can only go once the distribution using it is gone
+		log("Deleting ACM certificate...")
+		if err = deleteACMCertificate(*targets.certificateArn); err != nil {
+			return err
+		}
+		logln(" done")
+	}
+
+	logln("Destroyed " + config.Name)
+	return nil
+}
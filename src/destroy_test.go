@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDestroy(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	seedInfrastructure(fake)
+	defer useSite(t, copySite())()
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runDestroy(true); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.distributions) != 0 || len(fake.buckets) != 0 || len(fake.certs) != 0 {
+		t.Errorf("expected the distribution, bucket, and certificate to be gone, got %v, %v, and %v", len(fake.distributions), len(fake.buckets), len(fake.certs))
+	}
+	// Cloudfront only deletes disabled distributions, so it has to be
+	// disabled first
+	if update, remove := callIndex(fake, "cloudfront.UpdateDistribution"), callIndex(fake, "cloudfront.DeleteDistribution"); update == -1 || update > remove {
+		t.Errorf("expected the distribution to be disabled before it's deleted, got calls %v", fake.calls)
+	}
+
+	// The domain and its hosted zone stay, minus the records scarr made
+	if !fake.registered["example.com"] {
+		t.Error("expected the domain to stay registered")
+	}
+	if len(fake.zones) != 1 || fake.zones[0].name != "example.com." {
+		t.Fatalf("expected the hosted zone to stay, got %v", fake.zones)
+	}
+	for _, record := range fake.zones[0].records {
+		t.Errorf("expected scarr's records to be deleted, got %v %v", *record.Name, *record.Type)
+	}
+}
+
+func TestDestroyDeclined(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	seedInfrastructure(fake)
+	defer useSite(t, copySite())()
+	defer answerPrompts(t, "n\n")()
+
+	err := runDestroy(false)
+	if err == nil || !strings.Contains(err.Error(), "aborted") {
+		t.Fatalf("expected declining to abort, got %v", err)
+	}
+	for _, call := range fake.calls {
+		if strings.Contains(call, ".Delete") || call == "cloudfront.UpdateDistribution" || call == "route53.ChangeResourceRecordSets" {
+			t.Errorf("expected nothing to change after declining, got %v", call)
+		}
+	}
+	if len(fake.distributions) != 1 || len(fake.buckets) != 1 || len(fake.certs) != 1 {
+		t.Error("expected everything to be left in place")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Public DNS lookups, for when the domain's DNS lives outside route53 (see
+// -skip-dns).  Package variables so tests can fake them.
+var lookupCNAME = net.LookupCNAME
+var lookupHost = net.LookupHost
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Whether the name is a CNAME for target.
+func cnameMatches(name string, target string) bool {
+	cname, err := lookupCNAME(name)
+	return err == nil && normalizeDNSName(cname) == normalizeDNSName(target)
+}
+
+// Whether the domain resolves to the target, either through a CNAME or
+// through the ALIAS/ANAME-style flattening most DNS providers offer for apex
+// domains (in which case it shares at least one address with the target).
+func domainPointsAt(domain string, target string) bool {
+	if cnameMatches(domain, target) {
+		return true
+	}
+	domainAddresses, err := lookupHost(domain)
+	if err != nil {
+		return false
+	}
+	targetAddresses, err := lookupHost(target)
+	if err != nil {
+		return false
+	}
+	for _, domainAddress := range domainAddresses {
+		for _, targetAddress := range targetAddresses {
+			if domainAddress == targetAddress {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Polls public DNS until check passes.  DNS changes at another provider can
+// take a while to show up, so this waits up to a few hours.
+func waitForPublicDNS(description string, check func() bool) error {
+	log("waiting for " + description + " to show up in public DNS (feel free to ctrl-c and restart scarr later)...")
+	maxTries := 60 * 3
+	for i := 0; i < maxTries; i++ {
+		if check() {
+			logln(" found")
+			return nil
+		}
+		sleep(60 * time.Second)
+	}
+	return errors.New("timed out waiting for " + description + " to show up in public DNS")
+}
+
+// For -skip-dns: prints the record that points the domain at cloudfront and
+// waits for it to be set up.
+func ensureExternalDomainPointingToCloudfront(cloudfrontDomain string, domain string) error {
+	if domainPointsAt(domain, cloudfrontDomain) {
+		logln(domain + " already points at " + cloudfrontDomain)
+		return nil
+	}
+
+	// Printed even with -silent, since the deploy can't finish without it
+	fmt.Println("\nPoint " + domain + " at cloudfront by creating this record at your DNS provider:")
+	fmt.Println("  " + domain + "  CNAME  " + cloudfrontDomain)
+	fmt.Println("(For an apex domain, use your provider's ALIAS, ANAME or CNAME-flattening record instead.)")
+	return waitForPublicDNS("the "+domain+" record", func() bool {
+		return domainPointsAt(domain, cloudfrontDomain)
+	})
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+// Distributions get edited in the console, and scarr's own defaults change
+// between versions, so on every deploy the existing distribution gets compared
+// against what buildDistributionConfig would create.  Only the settings below
+// are compared; everything else (including the defaults AWS fills in) is left
+// alone.
+
+// One distribution setting scarr manages.
+type distributionSetting struct {
+	name string
+	// Renders the setting for comparison and display
+	describe func(*cloudfront.DistributionConfig) string
+	// Copies the setting from desired into current
+	apply func(current *cloudfront.DistributionConfig, desired *cloudfront.DistributionConfig)
+}
+
+// A setting whose current value doesn't match scarr's.
+type distributionChange struct {
+	setting string
+	from    string
+	to      string
+}
+
+func (change distributionChange) String() string {
+	return change.setting + ": " + change.from + " -> " + change.to
+}
+
+func describeValue(value interface{}) string {
+	switch v := value.(type) {
+	case *string:
+		if v == nil || *v == "" {
+			return "(none)"
+		}
+		return *v
+	case *bool:
+		return fmt.Sprint(aws.BoolValue(v))
+	case *int64:
+		return fmt.Sprint(aws.Int64Value(v))
+	}
+	return fmt.Sprint(value)
+}
+
+func describeList(items []string) string {
+	if len(items) == 0 {
+		return "(none)"
+	}
+	sorted := append([]string{}, items...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
+
+func describeAliases(config *cloudfront.DistributionConfig) string {
+	if config.Aliases == nil {
+		return describeList(nil)
+	}
+	return describeList(aws.StringValueSlice(config.Aliases.Items))
+}
+
+func describeOrigins(config *cloudfront.DistributionConfig) string {
+	if config.Origins == nil {
+		return describeList(nil)
+	}
+	origins := []string{}
+	for _, origin := range config.Origins.Items {
+		description := aws.StringValue(origin.DomainName) + aws.StringValue(origin.OriginPath)
+		if origin.CustomOriginConfig != nil {
+			description += " (" + aws.StringValue(origin.CustomOriginConfig.OriginProtocolPolicy) + ")"
+		}
+		if aws.StringValue(origin.OriginAccessControlId) != "" {
+			description += " (origin access control " + *origin.OriginAccessControlId + ")"
+		}
+		origins = append(origins, description)
+	}
+	return describeList(origins)
+}
+
+func describeFunctionAssociations(config *cloudfront.DistributionConfig) string {
+	associations := []string{}
+	if config.DefaultCacheBehavior != nil && config.DefaultCacheBehavior.FunctionAssociations != nil {
+		for _, association := range config.DefaultCacheBehavior.FunctionAssociations.Items {
+			associations = append(associations, aws.StringValue(association.EventType)+"="+aws.StringValue(association.FunctionARN))
+		}
+	}
+	return describeList(associations)
+}
+
+func describeErrorResponses(config *cloudfront.DistributionConfig) string {
+	responses := []string{}
+	if config.CustomErrorResponses != nil {
+		for _, response := range config.CustomErrorResponses.Items {
+			description := fmt.Sprint(aws.Int64Value(response.ErrorCode))
+			if aws.StringValue(response.ResponsePagePath) != "" {
+				description += " " + *response.ResponsePagePath + " (" + aws.StringValue(response.ResponseCode) + ")"
+			}
+			responses = append(responses, description+fmt.Sprintf(" ttl %v", aws.Int64Value(response.ErrorCachingMinTTL)))
+		}
+	}
+	return describeList(responses)
+}
+
+func describeAllowedMethods(config *cloudfront.DistributionConfig) string {
+	if config.DefaultCacheBehavior == nil || config.DefaultCacheBehavior.AllowedMethods == nil {
+		return describeList(nil)
+	}
+	return describeList(aws.StringValueSlice(config.DefaultCacheBehavior.AllowedMethods.Items))
+}
+
+// The config's default cache behavior and viewer certificate, or empty ones if
+// they're missing.  AWS always returns both, but a hand-built config might not
+// have them.
+func cacheBehavior(config *cloudfront.DistributionConfig) *cloudfront.DefaultCacheBehavior {
+	if config.DefaultCacheBehavior == nil {
+		return &cloudfront.DefaultCacheBehavior{}
+	}
+	return config.DefaultCacheBehavior
+}
+
+func viewerCertificate(config *cloudfront.DistributionConfig) *cloudfront.ViewerCertificate {
+	if config.ViewerCertificate == nil {
+		return &cloudfront.ViewerCertificate{}
+	}
+	return config.ViewerCertificate
+}
+
+// Copies a field of the default cache behavior, creating current's if it
+// somehow doesn't have one.
+func applyCacheBehavior(current *cloudfront.DistributionConfig, desired *cloudfront.DistributionConfig, copy func(current *cloudfront.DefaultCacheBehavior, desired *cloudfront.DefaultCacheBehavior)) {
+	if current.DefaultCacheBehavior == nil {
+		current.DefaultCacheBehavior = desired.DefaultCacheBehavior
+		return
+	}
+	copy(current.DefaultCacheBehavior, desired.DefaultCacheBehavior)
+}
+
+var managedDistributionSettings = []distributionSetting{
+	{
+		name:     "enabled",
+		describe: func(c *cloudfront.DistributionConfig) string { return describeValue(c.Enabled) },
+		apply:    func(current, desired *cloudfront.DistributionConfig) { current.Enabled = desired.Enabled },
+	},
+	{
+		name:     "aliases",
+		describe: describeAliases,
+		apply:    func(current, desired *cloudfront.DistributionConfig) { current.Aliases = desired.Aliases },
+	},
+	{
+		name:     "origin",
+		describe: describeOrigins,
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			current.Origins = desired.Origins
+			// The cache behavior has to point at one of the origins
+			applyCacheBehavior(current, desired, func(current, desired *cloudfront.DefaultCacheBehavior) {
+				current.TargetOriginId = desired.TargetOriginId
+			})
+		},
+	},
+	{
+		name: "certificate",
+		describe: func(c *cloudfront.DistributionConfig) string {
+			return describeValue(viewerCertificate(c).ACMCertificateArn)
+		},
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			current.ViewerCertificate = desired.ViewerCertificate
+		},
+	},
+	{
+		name: "ssl support method",
+		describe: func(c *cloudfront.DistributionConfig) string {
+			return describeValue(viewerCertificate(c).SSLSupportMethod)
+		},
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			current.ViewerCertificate = desired.ViewerCertificate
+		},
+	},
+	{
+		name: "minimum TLS version",
+		describe: func(c *cloudfront.DistributionConfig) string {
+			return describeValue(viewerCertificate(c).MinimumProtocolVersion)
+		},
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			current.ViewerCertificate = desired.ViewerCertificate
+		},
+	},
+	{
+		name:     "price class",
+		describe: func(c *cloudfront.DistributionConfig) string { return describeValue(c.PriceClass) },
+		apply:    func(current, desired *cloudfront.DistributionConfig) { current.PriceClass = desired.PriceClass },
+	},
+	{
+		name:     "ipv6",
+		describe: func(c *cloudfront.DistributionConfig) string { return describeValue(c.IsIPV6Enabled) },
+		apply:    func(current, desired *cloudfront.DistributionConfig) { current.IsIPV6Enabled = desired.IsIPV6Enabled },
+	},
+	{
+		name: "viewer protocol policy",
+		describe: func(c *cloudfront.DistributionConfig) string {
+			return describeValue(cacheBehavior(c).ViewerProtocolPolicy)
+		},
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			applyCacheBehavior(current, desired, func(current, desired *cloudfront.DefaultCacheBehavior) {
+				current.ViewerProtocolPolicy = desired.ViewerProtocolPolicy
+			})
+		},
+	},
+	{
+		name:     "allowed methods",
+		describe: describeAllowedMethods,
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			applyCacheBehavior(current, desired, func(current, desired *cloudfront.DefaultCacheBehavior) {
+				current.AllowedMethods = desired.AllowedMethods
+			})
+		},
+	},
+	{
+		name:     "compression",
+		describe: func(c *cloudfront.DistributionConfig) string { return describeValue(cacheBehavior(c).Compress) },
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			applyCacheBehavior(current, desired, func(current, desired *cloudfront.DefaultCacheBehavior) {
+				current.Compress = desired.Compress
+			})
+		},
+	},
+	{
+		name: "response headers policy",
+		describe: func(c *cloudfront.DistributionConfig) string {
+			return describeValue(cacheBehavior(c).ResponseHeadersPolicyId)
+		},
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			applyCacheBehavior(current, desired, func(current, desired *cloudfront.DefaultCacheBehavior) {
+				current.ResponseHeadersPolicyId = desired.ResponseHeadersPolicyId
+			})
+		},
+	},
+	{
+		name:     "error responses",
+		describe: describeErrorResponses,
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			current.CustomErrorResponses = desired.CustomErrorResponses
+		},
+	},
+	{
+		name:     "functions",
+		describe: describeFunctionAssociations,
+		apply: func(current, desired *cloudfront.DistributionConfig) {
+			applyCacheBehavior(current, desired, func(current, desired *cloudfront.DefaultCacheBehavior) {
+				current.FunctionAssociations = desired.FunctionAssociations
+			})
+		},
+	},
+}
+
+// Lists every managed setting where current differs from desired.
+func diffDistributionConfig(current *cloudfront.DistributionConfig, desired *cloudfront.DistributionConfig) []distributionChange {
+	changes := []distributionChange{}
+	for _, setting := range managedDistributionSettings {
+		from, to := setting.describe(current), setting.describe(desired)
+		if from != to {
+			changes = append(changes, distributionChange{setting: setting.name, from: from, to: to})
+		}
+	}
+	return changes
+}
+
+// Copies every managed setting that differs from desired into current.
+func applyDistributionChanges(current *cloudfront.DistributionConfig, desired *cloudfront.DistributionConfig) {
+	for _, setting := range managedDistributionSettings {
+		if setting.describe(current) != setting.describe(desired) {
+			setting.apply(current, desired)
+		}
+	}
+}
+
+// Brings an existing distribution back in line with desired, after showing
+// what's different and (unless autoApprove) asking first.  Declining leaves
+// the distribution alone and isn't an error.  Returns whether it changed
+// anything.
+func reconcileCloudFront(distributionID string, desired *cloudfront.DistributionConfig, autoApprove bool) (bool, error) {
+	return updateCloudFront(distributionID, func(current *cloudfront.DistributionConfig) (bool, error) {
+		changes := diffDistributionConfig(current, desired)
+		if len(changes) == 0 {
+			logln("CloudFront distribution " + distributionID + " matches scarr's config")
+			return false, nil
+		}
+
+		// Always shown, even with -silent, since it's about to change
+		fmt.Println("CloudFront distribution " + distributionID + " doesn't match scarr's config:")
+		for _, change := range changes {
+			fmt.Println("  " + change.String())
+		}
+		if !autoApprove {
+			confirmed, err := confirm("Update the distribution to match?")
+			if err != nil {
+				return false, fmt.Errorf("distribution %v needs updating; run deploy with -yes to update it without a prompt: %w", distributionID, err)
+			}
+			if !confirmed {
+				logln("Leaving the distribution as is")
+				return false, nil
+			}
+		}
+		applyDistributionChanges(current, desired)
+		return true, nil
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDiffDistributionConfig(t *testing.T) {
+	config := configType{
+		Domain:    "example.com",
+		Name:      "example",
+		Region:    "us-west-2",
+		Redirects: redirectsConfigType{WWW: "apex"},
+	}
+	desired := buildDistributionConfig(config, "arn:cert", "", "", "")
+
+	// What AWS hands back has extra defaults filled in, and aliases in its own
+	// order; none of that is drift
+	current := buildDistributionConfig(config, "arn:cert", "", "", "")
+	current.Aliases.Items = []*string{aws.String("www.example.com"), aws.String("example.com")}
+	current.DefaultCacheBehavior.SmoothStreaming = aws.Bool(false)
+	current.ViewerCertificate.CertificateSource = aws.String("acm")
+	current.HttpVersion = aws.String("http2")
+	if changes := diffDistributionConfig(current, desired); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+
+	current.ViewerCertificate.ACMCertificateArn = aws.String("arn:old-cert")
+	current.DefaultCacheBehavior.ViewerProtocolPolicy = aws.String("allow-all")
+	changes := diffDistributionConfig(current, desired)
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", changes)
+	}
+	if changes[0].String() != "certificate: arn:old-cert -> arn:cert" {
+		t.Errorf("unexpected certificate change %v", changes[0])
+	}
+	if changes[1].String() != "viewer protocol policy: allow-all -> redirect-to-https" {
+		t.Errorf("unexpected viewer protocol policy change %v", changes[1])
+	}
+
+	applyDistributionChanges(current, desired)
+	if changes := diffDistributionConfig(current, desired); len(changes) != 0 {
+		t.Errorf("expected applying the changes to fix them, got %v", changes)
+	}
+	if *current.HttpVersion != "http2" {
+		t.Error("expected unmanaged settings to be left alone")
+	}
+}
+
+func TestDiffDistributionConfigFunctions(t *testing.T) {
+	config := configType{Domain: "example.com", Name: "example", Region: "us-west-2"}
+	current := buildDistributionConfig(config, "arn:cert", "", "", "")
+	desired := buildDistributionConfig(config, "arn:cert", "arn:function", "", "")
+
+	changes := diffDistributionConfig(current, desired)
+	if len(changes) != 1 || changes[0].String() != "functions: (none) -> viewer-request=arn:function" {
+		t.Errorf("expected the function to be added, got %v", changes)
+	}
+}
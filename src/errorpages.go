@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+// scarr.yml's errors block: what visitors see when something goes wrong.
+type errorsConfigType struct {
+	// A page (eg 404.html) served with a 404 for any path that doesn't exist
+	NotFoundPage string                    `yaml:"notFoundPage"`
+	Responses    []errorResponseConfigType `yaml:"responses"`
+}
+
+// One custom error response: when the origin returns Status, serve Page
+// instead, with ResponseCode (defaults to Status), and cache that for TTL
+// seconds (defaults to cloudfront's 10).
+type errorResponseConfigType struct {
+	Status       int64  `yaml:"status"`
+	Page         string `yaml:"page"`
+	ResponseCode int64  `yaml:"responseCode"`
+	TTL          *int64 `yaml:"ttl"`
+}
+
+// The statuses cloudfront lets you customize, and the codes it can respond with.
+var errorResponseStatuses = map[int64]bool{400: true, 403: true, 404: true, 405: true, 414: true, 416: true, 500: true, 501: true, 502: true, 503: true, 504: true}
+var errorResponseCodes = map[int64]bool{200: true, 400: true, 403: true, 404: true, 405: true, 414: true, 416: true, 500: true, 501: true, 502: true, 503: true, 504: true}
+
+// With spa on, paths that don't exist get the app's index.html (with a 200) so
+// client-side routes work on deep links.  The bucket's REST endpoint reports
+// missing objects as 403 without ListBucket, so both get the fallback.
+var spaFallbackStatuses = []int64{403, 404}
+
+func validateErrorsConfig(config errorsConfigType, spa bool) error {
+	claimed := map[int64]bool{}
+	if spa {
+		if config.NotFoundPage != "" {
+			return newConfigError(nil, "errors notFoundPage can't be used with spa: true, which serves index.html for missing pages")
+		}
+		for _, status := range spaFallbackStatuses {
+			claimed[status] = true
+		}
+	}
+	if config.NotFoundPage != "" {
+		claimed[404] = true
+	}
+	for _, response := range config.Responses {
+		if !errorResponseStatuses[response.Status] {
+			return newConfigError(nil, fmt.Sprintf("errors responses can't customize status %v (cloudfront allows 400, 403, 404, 405, 414, 416, and 500-504)", response.Status))
+		}
+		if claimed[response.Status] {
+			return newConfigError(nil, fmt.Sprintf("status %v has more than one error response (check notFoundPage and spa too)", response.Status))
+		}
+		claimed[response.Status] = true
+		if response.ResponseCode != 0 && !errorResponseCodes[response.ResponseCode] {
+			return newConfigError(nil, fmt.Sprintf("errors responses can't respond with %v", response.ResponseCode))
+		}
+		if response.ResponseCode != 0 && response.Page == "" {
+			return newConfigError(nil, fmt.Sprintf("the error response for %v needs a page to go with its responseCode", response.Status))
+		}
+		if response.TTL != nil && *response.TTL < 0 {
+			return newConfigError(nil, fmt.Sprintf("the error response for %v has a negative ttl", response.Status))
+		}
+	}
+	return nil
+}
+
+// Cloudfront wants paths to error pages to start with a /; scarr.yml accepts
+// them either way.
+func errorPagePath(page string) string {
+	if page == "" || strings.HasPrefix(page, "/") {
+		return page
+	}
+	return "/" + page
+}
+
+// Every custom error response the distribution should have: spa's fallbacks,
+// then notFoundPage's, then the configured responses.
+func getErrorResponses(config configType) []errorResponseConfigType {
+	responses := []errorResponseConfigType{}
+	if config.SPA {
+		for _, status := range spaFallbackStatuses {
+			responses = append(responses, errorResponseConfigType{Status: status, Page: "/index.html", ResponseCode: 200})
+		}
+	}
+	if config.Errors.NotFoundPage != "" {
+		responses = append(responses, errorResponseConfigType{Status: 404, Page: config.Errors.NotFoundPage, ResponseCode: 404})
+	}
+	return append(responses, config.Errors.Responses...)
+}
+
+func buildCustomErrorResponses(config configType) *cloudfront.CustomErrorResponses {
+	items := []*cloudfront.CustomErrorResponse{}
+	for _, response := range getErrorResponses(config) {
+		item := &cloudfront.CustomErrorResponse{
+			ErrorCode:          aws.Int64(response.Status),
+			ErrorCachingMinTTL: response.TTL,
+		}
+		if response.Page != "" {
+			responseCode := response.ResponseCode
+			if responseCode == 0 {
+				responseCode = response.Status
+			}
+			item.ResponsePagePath = aws.String(errorPagePath(response.Page))
+			item.ResponseCode = aws.String(fmt.Sprint(responseCode))
+		}
+		if item.ErrorCachingMinTTL == nil {
+			item.ErrorCachingMinTTL = aws.Int64(10)
+		}
+		items = append(items, item)
+	}
+	return &cloudfront.CustomErrorResponses{
+		Items:    items,
+		Quantity: aws.Int64(int64(len(items))),
+	}
+}
+
+// The bucket's website error document (a key, so no leading slash), or "" to
+// leave it alone.
+func getErrorDocument(config configType) string {
+	return strings.TrimPrefix(config.Errors.NotFoundPage, "/")
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateErrorsConfig(t *testing.T) {
+	ttl := int64(-1)
+	cases := []struct {
+		name   string
+		config errorsConfigType
+		spa    bool
+		err    string
+	}{
+		{name: "empty"},
+		{name: "spa", spa: true},
+		{name: "not found page", config: errorsConfigType{NotFoundPage: "404.html"}},
+		{
+			name:   "spa and not found page",
+			config: errorsConfigType{NotFoundPage: "404.html"},
+			spa:    true,
+			err:    "can't be used with spa",
+		},
+		{
+			name:   "uncustomizable status",
+			config: errorsConfigType{Responses: []errorResponseConfigType{{Status: 418, Page: "teapot.html"}}},
+			err:    "can't customize status 418",
+		},
+		{
+			name:   "status claimed twice",
+			config: errorsConfigType{NotFoundPage: "404.html", Responses: []errorResponseConfigType{{Status: 404, Page: "missing.html"}}},
+			err:    "more than one error response",
+		},
+		{
+			name:   "status claimed by spa",
+			config: errorsConfigType{Responses: []errorResponseConfigType{{Status: 403, Page: "forbidden.html"}}},
+			spa:    true,
+			err:    "more than one error response",
+		},
+		{
+			name:   "bad response code",
+			config: errorsConfigType{Responses: []errorResponseConfigType{{Status: 500, Page: "500.html", ResponseCode: 302}}},
+			err:    "can't respond with 302",
+		},
+		{
+			name:   "response code without page",
+			config: errorsConfigType{Responses: []errorResponseConfigType{{Status: 500, ResponseCode: 503}}},
+			err:    "needs a page",
+		},
+		{
+			name:   "negative ttl",
+			config: errorsConfigType{Responses: []errorResponseConfigType{{Status: 500, TTL: &ttl}}},
+			err:    "negative ttl",
+		},
+	}
+	for _, c := range cases {
+		err := validateErrorsConfig(c.config, c.spa)
+		if c.err == "" && err != nil {
+			t.Errorf("%v: expected no error, got %v", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%v: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
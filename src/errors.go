@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Exit codes main uses for each kind of failure.
+const (
+	exitCodeGeneral   = 1
+	exitCodeConfig    = 2
+	exitCodeAuth      = 3
+	exitCodeTransient = 4
+)
+
+// A failed AWS call.  Wraps the SDK's awserr.Error, so callers can check the
+// AWS error code with Code() or errors.As.
+type awsError struct {
+	// What scarr was trying to do, eg "create bucket"
+	Op  string
+	Err awserr.Error
+}
+
+func (e *awsError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *awsError) Unwrap() error {
+	return e.Err
+}
+
+func (e *awsError) Code() string {
+	return e.Err.Code()
+}
+
+// A problem with scarr.yml or the command line, which retrying won't fix.
+type configError struct {
+	Message string
+	Err     error
+}
+
+func (e *configError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.Err
+}
+
+func newConfigError(err error, message string) error {
+	return &configError{Message: message, Err: err}
+}
+
+// Tags an error from an AWS call with what we were trying to do.  Returns nil
+// for a nil err, so it can wrap calls directly.
+func wrapAWSError(err error, op string) error {
+	if err == nil {
+		return nil
+	}
+	if sdkError, ok := err.(awserr.Error); ok {
+		return &awsError{Op: op, Err: sdkError}
+	}
+	return fmt.Errorf("%v: %w", op, err)
+}
+
+// Returns the AWS error code for err, or "" if it isn't (or doesn't wrap) an
+// AWS error.
+func awsErrorCode(err error) string {
+	var sdkError awserr.Error
+	if errors.As(err, &sdkError) {
+		return sdkError.Code()
+	}
+	return ""
+}
+
+var authErrorCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"AuthFailure":                 true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidAccessKeyId":          true,
+	"InvalidClientTokenId":        true,
+	"MissingAuthenticationToken":  true,
+	"NoCredentialProviders":       true,
+	"SignatureDoesNotMatch":       true,
+	"UnrecognizedClientException": true,
+}
+
+func isAuthError(err error) bool {
+	return authErrorCodes[awsErrorCode(err)]
+}
+
+// Throttling, timeouts, connection failures and 5xxs: worth retrying later.
+func isTransientError(err error) bool {
+	var sdkError awserr.Error
+	if !errors.As(err, &sdkError) {
+		return false
+	}
+	if request.IsErrorRetryable(sdkError) || request.IsErrorThrottle(sdkError) {
+		return true
+	}
+	var requestFailure awserr.RequestFailure
+	return errors.As(err, &requestFailure) && requestFailure.StatusCode() >= 500
+}
+
+// Picks the exit code for an error that made it all the way up to main.
+func exitCodeFor(err error) int {
+	var configErr *configError
+	switch {
+	case errors.As(err, &configErr):
+		return exitCodeConfig
+	case isAuthError(err):
+		return exitCodeAuth
+	case isTransientError(err):
+		return exitCodeTransient
+	}
+	return exitCodeGeneral
+}
@@ -0,0 +1,1337 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53domains"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// An in-memory stand-in for the bits of AWS scarr uses.  Each fake service
+// below is a thin view onto the same fakeAWS, so eg registering a domain
+// creates a hosted zone that route53 then lists.
+
+type fakeObject struct {
+	body     []byte
+	etag     string
+	modified time.Time
+	input    s3manager.UploadInput
+}
+
+type fakeBucket struct {
+	website           bool
+	errorDocument     string
+	routingRules      []*s3.RoutingRule
+	publicAccessBlock *s3.PublicAccessBlockConfiguration
+	policy            string
+	objects           map[string]fakeObject
+}
+
+type fakeZone struct {
+	id          string
+	name        string
+	nameServers []string
+	private     bool
+	records     []*route53.ResourceRecordSet
+}
+
+type fakeCert struct {
+	arn    string
+	domain string
+	status string
+	record *acm.ResourceRecord
+}
+
+type fakeDistribution struct {
+	distribution *cloudfront.Distribution
+	etag         int
+}
+
+type fakeFunction struct {
+	arn  string
+	code []byte
+	// nil until the function's published
+	liveCode []byte
+	etag     int
+}
+
+type fakeAWS struct {
+	mu sync.Mutex
+	// Every call made, as "service.Operation", in order
+	calls []string
+	// Domains registered in this account, and ones nobody can register
+	registered  map[string]bool
+	unavailable map[string]bool
+	// Name servers set on registered domains
+	domainNameServers map[string][]string
+	zones             []*fakeZone
+	certs             []*fakeCert
+	buckets           map[string]*fakeBucket
+	// Keyed by distribution ID
+	distributions map[string]*fakeDistribution
+	functions     map[string]*fakeFunction
+	// Origin access control names, keyed by ID
+	originAccessControls map[string]string
+	// Response headers policy configs, keyed by ID
+	responseHeadersPolicies map[string]*cloudfront.ResponseHeadersPolicyConfig
+	invalidations           [][]string
+	nextID                  int
+	// How many items each page of a list call returns
+	pageSize int
+	// CNAMEs visible in public DNS, eg ones set up at another DNS provider
+	publicCNAMEs map[string]string
+	// S3's clock, which ticks a second on every write so objects' LastModified
+	// always tells them apart
+	clock time.Time
+	// Keys whose uploads fail
+	failUploads map[string]bool
+	// Bucket names that belong to another account
+	foreignBuckets map[string]bool
+}
+
+func newFakeAWS() *fakeAWS {
+	return &fakeAWS{
+		registered:              map[string]bool{},
+		unavailable:             map[string]bool{},
+		domainNameServers:       map[string][]string{},
+		buckets:                 map[string]*fakeBucket{},
+		distributions:           map[string]*fakeDistribution{},
+		functions:               map[string]*fakeFunction{},
+		originAccessControls:    map[string]string{},
+		responseHeadersPolicies: map[string]*cloudfront.ResponseHeadersPolicyConfig{},
+		// Small, so every test goes through multiple pages
+		pageSize:       2,
+		publicCNAMEs:   map[string]string{},
+		clock:          time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC),
+		failUploads:    map[string]bool{},
+		foreignBuckets: map[string]bool{},
+	}
+}
+
+// Splits count items into [start, end) pages of pageSize.  There's always at
+// least one page, even if it's empty.
+func (f *fakeAWS) pages(count int) [][2]int {
+	pages := [][2]int{}
+	for start := 0; start == 0 || start < count; start += f.pageSize {
+		end := start + f.pageSize
+		if end > count {
+			end = count
+		}
+		pages = append(pages, [2]int{start, end})
+	}
+	return pages
+}
+
+// Points the service constructors (plus sleep and public DNS lookups) at this
+// fake.  Returns a func that puts the real ones back.
+func (f *fakeAWS) install() func() {
+	oldS3, oldManager, oldCloudFront := s3Service, s3ManagerService, cloudFrontService
+	oldACM, oldRoute53, oldDomains, oldSleep := amcService, route53Service, route53DomainsService, sleep
+	oldLookupCNAME, oldLookupHost := lookupCNAME, lookupHost
+
+	s3Service = func(string) s3API { return fakeS3{f} }
+	s3ManagerService = func(string) s3UploaderAPI { return fakeS3{f} }
+	cloudFrontService = func() cloudFrontAPI { return fakeCloudFront{f} }
+	amcService = func() acmAPI { return fakeACM{f} }
+	route53Service = func() route53API { return fakeRoute53{f} }
+	route53DomainsService = func() route53DomainsAPI { return fakeRoute53Domains{f} }
+	sleep = func(time.Duration) {}
+	lookupCNAME = f.lookupCNAME
+	lookupHost = func(host string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return func() {
+		s3Service, s3ManagerService, cloudFrontService = oldS3, oldManager, oldCloudFront
+		amcService, route53Service, route53DomainsService, sleep = oldACM, oldRoute53, oldDomains, oldSleep
+		lookupCNAME, lookupHost = oldLookupCNAME, oldLookupHost
+	}
+}
+
+func (f *fakeAWS) lookupCNAME(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if target, ok := f.publicCNAMEs[normalizeDNSName(name)]; ok {
+		return target + ".", nil
+	}
+	return "", &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// Adds a CNAME to public DNS, as if someone set it up at their DNS provider.
+func (f *fakeAWS) addPublicCNAME(name string, target string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.publicCNAMEs[normalizeDNSName(name)] = normalizeDNSName(target)
+}
+
+func (f *fakeAWS) record(call string) {
+	f.calls = append(f.calls, call)
+}
+
+// How many times the given "service.Operation" was called.
+func (f *fakeAWS) callCount(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, c := range f.calls {
+		if c == call {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeAWS) newID(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%v%v", prefix, f.nextID)
+}
+
+func (f *fakeAWS) addZone(domain string) *fakeZone {
+	id := f.newID("Z")
+	zone := &fakeZone{
+		id:          "/hostedzone/" + id,
+		name:        domain + ".",
+		nameServers: []string{"ns-" + id + "-1.awsdns.com", "ns-" + id + "-2.awsdns.net"},
+	}
+	f.zones = append(f.zones, zone)
+	return zone
+}
+
+func (f *fakeAWS) zoneByID(id string) *fakeZone {
+	for _, zone := range f.zones {
+		if zone.id == id {
+			return zone
+		}
+	}
+	return nil
+}
+
+func (zone *fakeZone) find(name string, recordType string) int {
+	name = strings.TrimSuffix(name, ".") + "."
+	for i, recordSet := range zone.records {
+		if *recordSet.Name == name && *recordSet.Type == recordType {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether any zone has the given record, eg to see if a cert's validation
+// CNAME is in place.
+func (f *fakeAWS) hasRecord(name string, recordType string) bool {
+	for _, zone := range f.zones {
+		if zone.find(name, recordType) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeAWS) addCert(domain string, status string) *fakeCert {
+	id := f.newID("")
+	cert := &fakeCert{
+		arn:    "arn:aws:acm:us-east-1:123456789012:certificate/" + id,
+		domain: domain,
+		status: status,
+		record: &acm.ResourceRecord{
+			Name:  aws.String("_" + id + "." + domain + "."),
+			Type:  aws.String("CNAME"),
+			Value: aws.String("_" + id + ".acm-validations.aws."),
+		},
+	}
+	f.certs = append(f.certs, cert)
+	return cert
+}
+
+func (f *fakeAWS) addDistribution(config *cloudfront.DistributionConfig) *cloudfront.Distribution {
+	id := f.newID("E")
+	distribution := &cloudfront.Distribution{
+		Id:                 aws.String(id),
+		ARN:                aws.String("arn:aws:cloudfront::123456789012:distribution/" + id),
+		DomainName:         aws.String(strings.ToLower(id) + ".cloudfront.net"),
+		Status:             aws.String("Deployed"),
+		DistributionConfig: config,
+	}
+	f.distributions[id] = &fakeDistribution{distribution: distribution, etag: 1}
+	return distribution
+}
+
+func (f *fakeAWS) putObject(bucket string, key string, body []byte, input s3manager.UploadInput) {
+	sum := md5.Sum(body)
+	f.clock = f.clock.Add(time.Second)
+	f.buckets[bucket].objects[key] = fakeObject{
+		body:     body,
+		etag:     hex.EncodeToString(sum[:]),
+		modified: f.clock,
+		input:    input,
+	}
+}
+
+func notFound(code string, message string) error {
+	return awserr.NewRequestFailure(awserr.New(code, message, nil), 404, "fake-request")
+}
+
+// S3, including the upload manager
+
+type fakeS3 struct{ *fakeAWS }
+
+func (f fakeS3) bucket(name string) (*fakeBucket, error) {
+	bucket, ok := f.buckets[name]
+	if !ok {
+		return nil, notFound("NoSuchBucket", "The specified bucket does not exist")
+	}
+	return bucket, nil
+}
+
+func (f fakeS3) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.HeadBucket")
+	if f.foreignBuckets[*input.Bucket] {
+		return nil, awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), 403, "fake-request")
+	}
+	if _, ok := f.buckets[*input.Bucket]; !ok {
+		return nil, notFound("NotFound", "Not Found")
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f fakeS3) GetBucketAcl(input *s3.GetBucketAclInput) (*s3.GetBucketAclOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.GetBucketAcl")
+	if _, err := f.bucket(*input.Bucket); err != nil {
+		return nil, err
+	}
+	return &s3.GetBucketAclOutput{}, nil
+}
+
+func (f fakeS3) GetBucketWebsite(input *s3.GetBucketWebsiteInput) (*s3.GetBucketWebsiteOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.GetBucketWebsite")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !bucket.website {
+		return nil, notFound("NoSuchWebsiteConfiguration", "The specified bucket does not have a website configuration")
+	}
+	output := &s3.GetBucketWebsiteOutput{IndexDocument: &s3.IndexDocument{Suffix: aws.String("index.html")}}
+	if bucket.errorDocument != "" {
+		output.ErrorDocument = &s3.ErrorDocument{Key: aws.String(bucket.errorDocument)}
+	}
+	output.RoutingRules = bucket.routingRules
+	return output, nil
+}
+
+func (f fakeS3) PutBucketWebsite(input *s3.PutBucketWebsiteInput) (*s3.PutBucketWebsiteOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.PutBucketWebsite")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	bucket.website = true
+	bucket.errorDocument = ""
+	bucket.routingRules = input.WebsiteConfiguration.RoutingRules
+	if input.WebsiteConfiguration.ErrorDocument != nil {
+		bucket.errorDocument = *input.WebsiteConfiguration.ErrorDocument.Key
+	}
+	return &s3.PutBucketWebsiteOutput{}, nil
+}
+
+func (f fakeS3) GetPublicAccessBlock(input *s3.GetPublicAccessBlockInput) (*s3.GetPublicAccessBlockOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.GetPublicAccessBlock")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.publicAccessBlock == nil {
+		return nil, notFound("NoSuchPublicAccessBlockConfiguration", "The public access block configuration was not found")
+	}
+	return &s3.GetPublicAccessBlockOutput{PublicAccessBlockConfiguration: bucket.publicAccessBlock}, nil
+}
+
+func (f fakeS3) PutPublicAccessBlock(input *s3.PutPublicAccessBlockInput) (*s3.PutPublicAccessBlockOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.PutPublicAccessBlock")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	bucket.publicAccessBlock = input.PublicAccessBlockConfiguration
+	return &s3.PutPublicAccessBlockOutput{}, nil
+}
+
+func (f fakeS3) GetBucketPolicy(input *s3.GetBucketPolicyInput) (*s3.GetBucketPolicyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.GetBucketPolicy")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.policy == "" {
+		return nil, notFound("NoSuchBucketPolicy", "The bucket policy does not exist")
+	}
+	return &s3.GetBucketPolicyOutput{Policy: aws.String(bucket.policy)}, nil
+}
+
+func (f fakeS3) PutBucketPolicy(input *s3.PutBucketPolicyInput) (*s3.PutBucketPolicyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.PutBucketPolicy")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	bucket.policy = *input.Policy
+	return &s3.PutBucketPolicyOutput{}, nil
+}
+
+func (f fakeS3) CreateBucket(input *s3.CreateBucketInput) (*s3.CreateBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.CreateBucket")
+	if _, ok := f.buckets[*input.Bucket]; ok {
+		return nil, awserr.New("BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded", nil)
+	}
+	f.buckets[*input.Bucket] = &fakeBucket{objects: map[string]fakeObject{}}
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (f fakeS3) DeleteBucket(input *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.DeleteBucket")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if len(bucket.objects) > 0 {
+		return nil, awserr.New("BucketNotEmpty", "The bucket you tried to delete is not empty", nil)
+	}
+	delete(f.buckets, *input.Bucket)
+	return &s3.DeleteBucketOutput{}, nil
+}
+
+func (f fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	f.mu.Lock()
+	f.record("s3.ListObjectsV2")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	keys := []string{}
+	for key := range bucket.objects {
+		if input.Prefix == nil || strings.HasPrefix(key, *input.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pages := []*s3.ListObjectsV2Output{}
+	for _, bounds := range f.pages(len(keys)) {
+		page := &s3.ListObjectsV2Output{}
+		for _, key := range keys[bounds[0]:bounds[1]] {
+			object := bucket.objects[key]
+			page.Contents = append(page.Contents, &s3.Object{
+				Key:          aws.String(key),
+				ETag:         aws.String("\"" + object.etag + "\""),
+				Size:         aws.Int64(int64(len(object.body))),
+				LastModified: aws.Time(object.modified),
+			})
+		}
+		pages = append(pages, page)
+	}
+	f.mu.Unlock()
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.HeadObject")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := bucket.objects[*input.Key]
+	if !ok {
+		return nil, notFound("NotFound", "Not Found")
+	}
+	return &s3.HeadObjectOutput{
+		ETag:               aws.String("\"" + object.etag + "\""),
+		ContentLength:      aws.Int64(int64(len(object.body))),
+		ContentType:        object.input.ContentType,
+		ContentEncoding:    object.input.ContentEncoding,
+		CacheControl:       object.input.CacheControl,
+		ContentDisposition: object.input.ContentDisposition,
+		ContentLanguage:    object.input.ContentLanguage,
+		Metadata:           object.input.Metadata,
+	}, nil
+}
+
+func (f fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.GetObject")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := bucket.objects[*input.Key]
+	if !ok {
+		return nil, notFound("NoSuchKey", "The specified key does not exist.")
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(object.body)),
+		ETag:          aws.String("\"" + object.etag + "\""),
+		ContentLength: aws.Int64(int64(len(object.body))),
+		ContentType:   object.input.ContentType,
+	}, nil
+}
+
+func (f fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.PutObject")
+	if _, err := f.bucket(*input.Bucket); err != nil {
+		return nil, err
+	}
+	f.putObject(*input.Bucket, *input.Key, body, s3manager.UploadInput{ContentType: input.ContentType})
+	return &s3.PutObjectOutput{ETag: aws.String("\"" + f.buckets[*input.Bucket].objects[*input.Key].etag + "\"")}, nil
+}
+
+func (f fakeS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.CopyObject")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	source, err := url.PathUnescape(*input.CopySource)
+	if err != nil || !strings.HasPrefix(source, *input.Bucket+"/") {
+		return nil, awserr.New("InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey", nil)
+	}
+	object, ok := bucket.objects[strings.TrimPrefix(source, *input.Bucket+"/")]
+	if !ok {
+		return nil, notFound("NoSuchKey", "The specified key does not exist.")
+	}
+	// Without a MetadataDirective, the copy keeps the source's headers
+	copied := object.input
+	copied.Key = input.Key
+	f.putObject(*input.Bucket, *input.Key, object.body, copied)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f fakeS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.DeleteObjects")
+	bucket, err := f.bucket(*input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if len(input.Delete.Objects) > 1000 {
+		return nil, awserr.New("MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema", nil)
+	}
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		delete(bucket.objects, *object.Key)
+		output.Deleted = append(output.Deleted, &s3.DeletedObject{Key: object.Key})
+	}
+	return output, nil
+}
+
+func (f fakeS3) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("s3.Upload")
+	if _, err := f.bucket(*input.Bucket); err != nil {
+		return nil, err
+	}
+	if f.failUploads[*input.Key] {
+		return nil, awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error. Please try again.", nil), 500, "fake-request")
+	}
+	f.putObject(*input.Bucket, *input.Key, body, *input)
+	return &s3manager.UploadOutput{}, nil
+}
+
+// CloudFront
+
+type fakeCloudFront struct{ *fakeAWS }
+
+func (f fakeCloudFront) distribution(id string) (*fakeDistribution, error) {
+	distribution, ok := f.distributions[id]
+	if !ok {
+		return nil, notFound("NoSuchDistribution", "The specified distribution does not exist")
+	}
+	return distribution, nil
+}
+
+func (f fakeCloudFront) ListDistributionsPages(input *cloudfront.ListDistributionsInput, fn func(*cloudfront.ListDistributionsOutput, bool) bool) error {
+	f.mu.Lock()
+	ids := []string{}
+	for id := range f.distributions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	pages := []*cloudfront.ListDistributionsOutput{}
+	for i, bounds := range f.pages(len(ids)) {
+		f.record("cloudfront.ListDistributions")
+		list := &cloudfront.DistributionList{IsTruncated: aws.Bool(bounds[1] < len(ids))}
+		for _, id := range ids[bounds[0]:bounds[1]] {
+			distribution := f.distributions[id].distribution
+			list.Items = append(list.Items, &cloudfront.DistributionSummary{
+				Id:         distribution.Id,
+				DomainName: distribution.DomainName,
+				Status:     distribution.Status,
+				Enabled:    distribution.DistributionConfig.Enabled,
+				Origins:    distribution.DistributionConfig.Origins,
+			})
+		}
+		list.Quantity = aws.Int64(int64(len(list.Items)))
+		list.Marker = aws.String(fmt.Sprint(i))
+		pages = append(pages, &cloudfront.ListDistributionsOutput{DistributionList: list})
+	}
+	f.mu.Unlock()
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f fakeCloudFront) GetDistribution(input *cloudfront.GetDistributionInput) (*cloudfront.GetDistributionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.GetDistribution")
+	distribution, err := f.distribution(*input.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudfront.GetDistributionOutput{
+		Distribution: distribution.distribution,
+		ETag:         aws.String(fmt.Sprint(distribution.etag)),
+	}, nil
+}
+
+func (f fakeCloudFront) GetDistributionConfig(input *cloudfront.GetDistributionConfigInput) (*cloudfront.GetDistributionConfigOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.GetDistributionConfig")
+	distribution, err := f.distribution(*input.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudfront.GetDistributionConfigOutput{
+		DistributionConfig: distribution.distribution.DistributionConfig,
+		ETag:               aws.String(fmt.Sprint(distribution.etag)),
+	}, nil
+}
+
+func (f fakeCloudFront) CreateDistribution(input *cloudfront.CreateDistributionInput) (*cloudfront.CreateDistributionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.CreateDistribution")
+	distribution := f.addDistribution(input.DistributionConfig)
+	return &cloudfront.CreateDistributionOutput{Distribution: distribution, ETag: aws.String("1")}, nil
+}
+
+func (f fakeCloudFront) UpdateDistribution(input *cloudfront.UpdateDistributionInput) (*cloudfront.UpdateDistributionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.UpdateDistribution")
+	distribution, err := f.distribution(*input.Id)
+	if err != nil {
+		return nil, err
+	}
+	if input.IfMatch == nil || *input.IfMatch != fmt.Sprint(distribution.etag) {
+		return nil, awserr.New("PreconditionFailed", "The If-Match version is missing or not valid", nil)
+	}
+	distribution.etag++
+	distribution.distribution.DistributionConfig = input.DistributionConfig
+	return &cloudfront.UpdateDistributionOutput{
+		Distribution: distribution.distribution,
+		ETag:         aws.String(fmt.Sprint(distribution.etag)),
+	}, nil
+}
+
+func (f fakeCloudFront) DeleteDistribution(input *cloudfront.DeleteDistributionInput) (*cloudfront.DeleteDistributionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.DeleteDistribution")
+	distribution, err := f.distribution(*input.Id)
+	if err != nil {
+		return nil, err
+	}
+	if *distribution.distribution.DistributionConfig.Enabled {
+		return nil, awserr.New("DistributionNotDisabled", "The distribution you are trying to delete has not been disabled", nil)
+	}
+	delete(f.distributions, *input.Id)
+	return &cloudfront.DeleteDistributionOutput{}, nil
+}
+
+func (f fakeCloudFront) CreateInvalidation(input *cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.CreateInvalidation")
+	if _, err := f.distribution(*input.DistributionId); err != nil {
+		return nil, err
+	}
+	f.invalidations = append(f.invalidations, aws.StringValueSlice(input.InvalidationBatch.Paths.Items))
+	return &cloudfront.CreateInvalidationOutput{
+		Invalidation: &cloudfront.Invalidation{
+			Id:     aws.String(f.newID("I")),
+			Status: aws.String("InProgress"),
+		},
+	}, nil
+}
+
+func (f fakeCloudFront) WaitUntilDistributionDeployed(input *cloudfront.GetDistributionInput) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.WaitUntilDistributionDeployed")
+	return nil
+}
+
+func (f fakeCloudFront) WaitUntilInvalidationCompleted(input *cloudfront.GetInvalidationInput) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.WaitUntilInvalidationCompleted")
+	return nil
+}
+
+func (f fakeCloudFront) function(name string) (*fakeFunction, error) {
+	function, ok := f.functions[name]
+	if !ok {
+		return nil, notFound("NoSuchFunctionExists", "The function does not exist")
+	}
+	return function, nil
+}
+
+func (function *fakeFunction) summary(name string) *cloudfront.FunctionSummary {
+	return &cloudfront.FunctionSummary{
+		Name:             aws.String(name),
+		Status:           aws.String("UNASSOCIATED"),
+		FunctionConfig:   &cloudfront.FunctionConfig{Runtime: aws.String(functionRuntime)},
+		FunctionMetadata: &cloudfront.FunctionMetadata{FunctionARN: aws.String(function.arn)},
+	}
+}
+
+func (f fakeCloudFront) checkFunctionETag(function *fakeFunction, ifMatch *string) error {
+	if ifMatch == nil || *ifMatch != fmt.Sprint(function.etag) {
+		return awserr.New("PreconditionFailed", "The If-Match version is missing or not valid", nil)
+	}
+	return nil
+}
+
+func (f fakeCloudFront) CreateFunction(input *cloudfront.CreateFunctionInput) (*cloudfront.CreateFunctionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.CreateFunction")
+	name := *input.Name
+	if _, ok := f.functions[name]; ok {
+		return nil, awserr.New("FunctionAlreadyExists", "A function with the same name already exists", nil)
+	}
+	function := &fakeFunction{
+		arn:  "arn:aws:cloudfront::123456789012:function/" + name,
+		code: input.FunctionCode,
+		etag: 1,
+	}
+	f.functions[name] = function
+	return &cloudfront.CreateFunctionOutput{FunctionSummary: function.summary(name), ETag: aws.String("1")}, nil
+}
+
+func (f fakeCloudFront) DescribeFunction(input *cloudfront.DescribeFunctionInput) (*cloudfront.DescribeFunctionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.DescribeFunction")
+	function, err := f.function(*input.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudfront.DescribeFunctionOutput{
+		FunctionSummary: function.summary(*input.Name),
+		ETag:            aws.String(fmt.Sprint(function.etag)),
+	}, nil
+}
+
+func (f fakeCloudFront) GetFunction(input *cloudfront.GetFunctionInput) (*cloudfront.GetFunctionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.GetFunction")
+	function, err := f.function(*input.Name)
+	if err != nil {
+		return nil, err
+	}
+	code := function.code
+	if aws.StringValue(input.Stage) == "LIVE" {
+		if function.liveCode == nil {
+			return nil, notFound("NoSuchFunctionExists", "The function does not exist")
+		}
+		code = function.liveCode
+	}
+	return &cloudfront.GetFunctionOutput{FunctionCode: code, ETag: aws.String(fmt.Sprint(function.etag))}, nil
+}
+
+func (f fakeCloudFront) UpdateFunction(input *cloudfront.UpdateFunctionInput) (*cloudfront.UpdateFunctionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.UpdateFunction")
+	function, err := f.function(*input.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.checkFunctionETag(function, input.IfMatch); err != nil {
+		return nil, err
+	}
+	function.code = input.FunctionCode
+	function.etag++
+	return &cloudfront.UpdateFunctionOutput{
+		FunctionSummary: function.summary(*input.Name),
+		ETag:            aws.String(fmt.Sprint(function.etag)),
+	}, nil
+}
+
+func (f fakeCloudFront) PublishFunction(input *cloudfront.PublishFunctionInput) (*cloudfront.PublishFunctionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.PublishFunction")
+	function, err := f.function(*input.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.checkFunctionETag(function, input.IfMatch); err != nil {
+		return nil, err
+	}
+	function.liveCode = function.code
+	return &cloudfront.PublishFunctionOutput{FunctionSummary: function.summary(*input.Name)}, nil
+}
+
+func (f fakeCloudFront) DeleteFunction(input *cloudfront.DeleteFunctionInput) (*cloudfront.DeleteFunctionOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.DeleteFunction")
+	function, err := f.function(*input.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.checkFunctionETag(function, input.IfMatch); err != nil {
+		return nil, err
+	}
+	for _, distribution := range f.distributions {
+		associations := distribution.distribution.DistributionConfig.DefaultCacheBehavior.FunctionAssociations
+		if associations == nil {
+			continue
+		}
+		for _, association := range associations.Items {
+			if *association.FunctionARN == function.arn {
+				return nil, awserr.New("FunctionInUse", "Cannot delete function, it's in use by a distribution", nil)
+			}
+		}
+	}
+	delete(f.functions, *input.Name)
+	return &cloudfront.DeleteFunctionOutput{}, nil
+}
+
+func (f fakeCloudFront) ListOriginAccessControls(input *cloudfront.ListOriginAccessControlsInput) (*cloudfront.ListOriginAccessControlsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.ListOriginAccessControls")
+	ids := []string{}
+	for id := range f.originAccessControls {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start := 0
+	if input.Marker != nil {
+		fmt.Sscan(*input.Marker, &start)
+	}
+	end := start + f.pageSize
+	if end > len(ids) {
+		end = len(ids)
+	}
+	list := &cloudfront.OriginAccessControlList{
+		IsTruncated: aws.Bool(end < len(ids)),
+		NextMarker:  aws.String(fmt.Sprint(end)),
+	}
+	for _, id := range ids[start:end] {
+		list.Items = append(list.Items, &cloudfront.OriginAccessControlSummary{
+			Id:   aws.String(id),
+			Name: aws.String(f.originAccessControls[id]),
+		})
+	}
+	list.Quantity = aws.Int64(int64(len(list.Items)))
+	return &cloudfront.ListOriginAccessControlsOutput{OriginAccessControlList: list}, nil
+}
+
+func (f fakeCloudFront) CreateOriginAccessControl(input *cloudfront.CreateOriginAccessControlInput) (*cloudfront.CreateOriginAccessControlOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.CreateOriginAccessControl")
+	for _, name := range f.originAccessControls {
+		if name == *input.OriginAccessControlConfig.Name {
+			return nil, awserr.New("OriginAccessControlAlreadyExists", "An origin access control with the same name already exists", nil)
+		}
+	}
+	id := f.newID("OAC")
+	f.originAccessControls[id] = *input.OriginAccessControlConfig.Name
+	return &cloudfront.CreateOriginAccessControlOutput{
+		OriginAccessControl: &cloudfront.OriginAccessControl{
+			Id:                        aws.String(id),
+			OriginAccessControlConfig: input.OriginAccessControlConfig,
+		},
+		ETag: aws.String("1"),
+	}, nil
+}
+
+func (f fakeCloudFront) GetOriginAccessControl(input *cloudfront.GetOriginAccessControlInput) (*cloudfront.GetOriginAccessControlOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.GetOriginAccessControl")
+	name, ok := f.originAccessControls[*input.Id]
+	if !ok {
+		return nil, notFound("NoSuchOriginAccessControl", "The origin access control does not exist")
+	}
+	return &cloudfront.GetOriginAccessControlOutput{
+		OriginAccessControl: &cloudfront.OriginAccessControl{
+			Id:                        input.Id,
+			OriginAccessControlConfig: &cloudfront.OriginAccessControlConfig{Name: aws.String(name)},
+		},
+		ETag: aws.String("1"),
+	}, nil
+}
+
+func (f fakeCloudFront) DeleteOriginAccessControl(input *cloudfront.DeleteOriginAccessControlInput) (*cloudfront.DeleteOriginAccessControlOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.DeleteOriginAccessControl")
+	if _, ok := f.originAccessControls[*input.Id]; !ok {
+		return nil, notFound("NoSuchOriginAccessControl", "The origin access control does not exist")
+	}
+	if aws.StringValue(input.IfMatch) != "1" {
+		return nil, awserr.New("PreconditionFailed", "The If-Match version is missing or not valid", nil)
+	}
+	for _, distribution := range f.distributions {
+		for _, origin := range distribution.distribution.DistributionConfig.Origins.Items {
+			if aws.StringValue(origin.OriginAccessControlId) == *input.Id {
+				return nil, awserr.New("OriginAccessControlInUse", "Cannot delete the origin access control because it's in use", nil)
+			}
+		}
+	}
+	delete(f.originAccessControls, *input.Id)
+	return &cloudfront.DeleteOriginAccessControlOutput{}, nil
+}
+
+func (f fakeCloudFront) ListResponseHeadersPolicies(input *cloudfront.ListResponseHeadersPoliciesInput) (*cloudfront.ListResponseHeadersPoliciesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.ListResponseHeadersPolicies")
+	ids := []string{}
+	for id := range f.responseHeadersPolicies {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start := 0
+	if input.Marker != nil {
+		fmt.Sscan(*input.Marker, &start)
+	}
+	end := start + f.pageSize
+	if end > len(ids) {
+		end = len(ids)
+	}
+	list := &cloudfront.ResponseHeadersPolicyList{}
+	if end < len(ids) {
+		list.NextMarker = aws.String(fmt.Sprint(end))
+	}
+	for _, id := range ids[start:end] {
+		list.Items = append(list.Items, &cloudfront.ResponseHeadersPolicySummary{
+			Type: aws.String("custom"),
+			ResponseHeadersPolicy: &cloudfront.ResponseHeadersPolicy{
+				Id:                          aws.String(id),
+				ResponseHeadersPolicyConfig: f.responseHeadersPolicies[id],
+			},
+		})
+	}
+	list.Quantity = aws.Int64(int64(len(list.Items)))
+	return &cloudfront.ListResponseHeadersPoliciesOutput{ResponseHeadersPolicyList: list}, nil
+}
+
+func (f fakeCloudFront) CreateResponseHeadersPolicy(input *cloudfront.CreateResponseHeadersPolicyInput) (*cloudfront.CreateResponseHeadersPolicyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.CreateResponseHeadersPolicy")
+	for _, policy := range f.responseHeadersPolicies {
+		if *policy.Name == *input.ResponseHeadersPolicyConfig.Name {
+			return nil, awserr.New("ResponseHeadersPolicyAlreadyExists", "A response headers policy with this name already exists", nil)
+		}
+	}
+	id := f.newID("RHP")
+	f.responseHeadersPolicies[id] = input.ResponseHeadersPolicyConfig
+	return &cloudfront.CreateResponseHeadersPolicyOutput{
+		ResponseHeadersPolicy: &cloudfront.ResponseHeadersPolicy{
+			Id:                          aws.String(id),
+			ResponseHeadersPolicyConfig: input.ResponseHeadersPolicyConfig,
+		},
+		ETag: aws.String("1"),
+	}, nil
+}
+
+func (f fakeCloudFront) GetResponseHeadersPolicyConfig(input *cloudfront.GetResponseHeadersPolicyConfigInput) (*cloudfront.GetResponseHeadersPolicyConfigOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.GetResponseHeadersPolicyConfig")
+	policy, ok := f.responseHeadersPolicies[*input.Id]
+	if !ok {
+		return nil, notFound("NoSuchResponseHeadersPolicy", "The response headers policy does not exist")
+	}
+	return &cloudfront.GetResponseHeadersPolicyConfigOutput{
+		ResponseHeadersPolicyConfig: policy,
+		ETag:                        aws.String("1"),
+	}, nil
+}
+
+func (f fakeCloudFront) UpdateResponseHeadersPolicy(input *cloudfront.UpdateResponseHeadersPolicyInput) (*cloudfront.UpdateResponseHeadersPolicyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.UpdateResponseHeadersPolicy")
+	if _, ok := f.responseHeadersPolicies[*input.Id]; !ok {
+		return nil, notFound("NoSuchResponseHeadersPolicy", "The response headers policy does not exist")
+	}
+	if aws.StringValue(input.IfMatch) != "1" {
+		return nil, awserr.New("PreconditionFailed", "The If-Match version is missing or not valid", nil)
+	}
+	f.responseHeadersPolicies[*input.Id] = input.ResponseHeadersPolicyConfig
+	return &cloudfront.UpdateResponseHeadersPolicyOutput{ETag: aws.String("1")}, nil
+}
+
+func (f fakeCloudFront) DeleteResponseHeadersPolicy(input *cloudfront.DeleteResponseHeadersPolicyInput) (*cloudfront.DeleteResponseHeadersPolicyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("cloudfront.DeleteResponseHeadersPolicy")
+	if _, ok := f.responseHeadersPolicies[*input.Id]; !ok {
+		return nil, notFound("NoSuchResponseHeadersPolicy", "The response headers policy does not exist")
+	}
+	if aws.StringValue(input.IfMatch) != "1" {
+		return nil, awserr.New("PreconditionFailed", "The If-Match version is missing or not valid", nil)
+	}
+	for _, distribution := range f.distributions {
+		if aws.StringValue(distribution.distribution.DistributionConfig.DefaultCacheBehavior.ResponseHeadersPolicyId) == *input.Id {
+			return nil, awserr.New("ResponseHeadersPolicyInUse", "Cannot delete the response headers policy because it's in use", nil)
+		}
+	}
+	delete(f.responseHeadersPolicies, *input.Id)
+	return &cloudfront.DeleteResponseHeadersPolicyOutput{}, nil
+}
+
+// ACM.  Pending certificates validate as soon as their validation CNAME shows
+// up in route53.
+
+type fakeACM struct{ *fakeAWS }
+
+func (f fakeACM) cert(arn string) (*fakeCert, error) {
+	for _, cert := range f.certs {
+		if cert.arn == arn {
+			return cert, nil
+		}
+	}
+	return nil, notFound("ResourceNotFoundException", "Could not find certificate "+arn)
+}
+
+func (f fakeACM) ListCertificatesPages(input *acm.ListCertificatesInput, fn func(*acm.ListCertificatesOutput, bool) bool) error {
+	f.mu.Lock()
+	pages := []*acm.ListCertificatesOutput{}
+	for _, bounds := range f.pages(len(f.certs)) {
+		f.record("acm.ListCertificates")
+		page := &acm.ListCertificatesOutput{}
+		for _, cert := range f.certs[bounds[0]:bounds[1]] {
+			page.CertificateSummaryList = append(page.CertificateSummaryList, &acm.CertificateSummary{
+				CertificateArn: aws.String(cert.arn),
+				DomainName:     aws.String(cert.domain),
+			})
+		}
+		pages = append(pages, page)
+	}
+	f.mu.Unlock()
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f fakeACM) RequestCertificate(input *acm.RequestCertificateInput) (*acm.RequestCertificateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("acm.RequestCertificate")
+	cert := f.addCert(*input.DomainName, "PENDING_VALIDATION")
+	return &acm.RequestCertificateOutput{CertificateArn: aws.String(cert.arn)}, nil
+}
+
+func (f fakeACM) DescribeCertificate(input *acm.DescribeCertificateInput) (*acm.DescribeCertificateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("acm.DescribeCertificate")
+	cert, err := f.cert(*input.CertificateArn)
+	if err != nil {
+		return nil, err
+	}
+	// A nil record is one ACM hasn't filled in (yet)
+	if cert.record != nil {
+		publiclyValidated := f.publicCNAMEs[normalizeDNSName(*cert.record.Name)] == normalizeDNSName(*cert.record.Value)
+		if cert.status == "PENDING_VALIDATION" && (f.hasRecord(*cert.record.Name, *cert.record.Type) || publiclyValidated) {
+			cert.status = "ISSUED"
+		}
+	}
+	// Domain validations report SUCCESS rather than the certificate's ISSUED
+	validationStatus := cert.status
+	if validationStatus == "ISSUED" {
+		validationStatus = "SUCCESS"
+	}
+	return &acm.DescribeCertificateOutput{
+		Certificate: &acm.CertificateDetail{
+			CertificateArn: aws.String(cert.arn),
+			DomainName:     aws.String(cert.domain),
+			Status:         aws.String(cert.status),
+			DomainValidationOptions: []*acm.DomainValidation{
+				{
+					DomainName:       aws.String(cert.domain),
+					ValidationStatus: aws.String(validationStatus),
+					ResourceRecord:   cert.record,
+				},
+			},
+		},
+	}, nil
+}
+
+func (f fakeACM) DeleteCertificate(input *acm.DeleteCertificateInput) (*acm.DeleteCertificateOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("acm.DeleteCertificate")
+	for i, cert := range f.certs {
+		if cert.arn == *input.CertificateArn {
+			f.certs = append(f.certs[:i], f.certs[i+1:]...)
+			return &acm.DeleteCertificateOutput{}, nil
+		}
+	}
+	return nil, notFound("ResourceNotFoundException", "Could not find certificate "+*input.CertificateArn)
+}
+
+// Route53
+
+type fakeRoute53 struct{ *fakeAWS }
+
+func (f fakeRoute53) zone(id string) (*fakeZone, error) {
+	zone := f.zoneByID(id)
+	if zone == nil {
+		return nil, notFound("NoSuchHostedZone", "No hosted zone found with ID: "+id)
+	}
+	return zone, nil
+}
+
+func (f fakeRoute53) ListHostedZonesPages(input *route53.ListHostedZonesInput, fn func(*route53.ListHostedZonesOutput, bool) bool) error {
+	f.mu.Lock()
+	pages := []*route53.ListHostedZonesOutput{}
+	for _, bounds := range f.pages(len(f.zones)) {
+		f.record("route53.ListHostedZones")
+		page := &route53.ListHostedZonesOutput{IsTruncated: aws.Bool(bounds[1] < len(f.zones))}
+		for _, zone := range f.zones[bounds[0]:bounds[1]] {
+			page.HostedZones = append(page.HostedZones, &route53.HostedZone{
+				Id:     aws.String(zone.id),
+				Name:   aws.String(zone.name),
+				Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(zone.private)},
+			})
+		}
+		pages = append(pages, page)
+	}
+	f.mu.Unlock()
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// Ignores StartRecordName, which is fine since callers still check each record.
+func (f fakeRoute53) ListResourceRecordSetsPages(input *route53.ListResourceRecordSetsInput, fn func(*route53.ListResourceRecordSetsOutput, bool) bool) error {
+	f.mu.Lock()
+	zone, err := f.zone(*input.HostedZoneId)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	pages := []*route53.ListResourceRecordSetsOutput{}
+	for _, bounds := range f.pages(len(zone.records)) {
+		f.record("route53.ListResourceRecordSets")
+		pages = append(pages, &route53.ListResourceRecordSetsOutput{
+			ResourceRecordSets: append([]*route53.ResourceRecordSet{}, zone.records[bounds[0]:bounds[1]]...),
+			IsTruncated:        aws.Bool(bounds[1] < len(zone.records)),
+		})
+	}
+	f.mu.Unlock()
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f fakeRoute53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("route53.ChangeResourceRecordSets")
+	zone, err := f.zone(*input.HostedZoneId)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range input.ChangeBatch.Changes {
+		recordSet := *change.ResourceRecordSet
+		recordSet.Name = aws.String(strings.TrimSuffix(*recordSet.Name, ".") + ".")
+		existing := zone.find(*recordSet.Name, *recordSet.Type)
+		switch *change.Action {
+		case "CREATE":
+			if existing >= 0 {
+				return nil, awserr.New("InvalidChangeBatch", "Tried to create resource record set "+*recordSet.Name+" but it already exists", nil)
+			}
+			zone.records = append(zone.records, &recordSet)
+		case "UPSERT":
+			if existing >= 0 {
+				zone.records[existing] = &recordSet
+			} else {
+				zone.records = append(zone.records, &recordSet)
+			}
+		case "DELETE":
+			if existing < 0 {
+				return nil, awserr.New("InvalidChangeBatch", "Tried to delete resource record set "+*recordSet.Name+" but it was not found", nil)
+			}
+			zone.records = append(zone.records[:existing], zone.records[existing+1:]...)
+		}
+	}
+	return &route53.ChangeResourceRecordSetsOutput{
+		ChangeInfo: &route53.ChangeInfo{Id: aws.String(f.newID("C")), Status: aws.String("INSYNC")},
+	}, nil
+}
+
+func (f fakeRoute53) CreateHostedZone(input *route53.CreateHostedZoneInput) (*route53.CreateHostedZoneOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("route53.CreateHostedZone")
+	zone := f.addZone(strings.TrimSuffix(*input.Name, "."))
+	return &route53.CreateHostedZoneOutput{
+		HostedZone:    &route53.HostedZone{Id: aws.String(zone.id), Name: aws.String(zone.name)},
+		DelegationSet: &route53.DelegationSet{NameServers: aws.StringSlice(zone.nameServers)},
+	}, nil
+}
+
+// Route53 domains.  Registering a domain succeeds immediately and, like the
+// real thing, creates a hosted zone for it.
+
+type fakeRoute53Domains struct{ *fakeAWS }
+
+func (f fakeRoute53Domains) RegisterDomain(input *route53domains.RegisterDomainInput) (*route53domains.RegisterDomainOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("route53domains.RegisterDomain")
+	domain := *input.DomainName
+	if f.registered[domain] || f.unavailable[domain] {
+		return nil, awserr.New("DomainLimitExceeded", "Domain "+domain+" is not available", nil)
+	}
+	f.registered[domain] = true
+	f.domainNameServers[domain] = f.addZone(domain).nameServers
+	return &route53domains.RegisterDomainOutput{OperationId: aws.String(f.newID("op-"))}, nil
+}
+
+func (f fakeRoute53Domains) GetOperationDetail(input *route53domains.GetOperationDetailInput) (*route53domains.GetOperationDetailOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("route53domains.GetOperationDetail")
+	return &route53domains.GetOperationDetailOutput{
+		OperationId: input.OperationId,
+		Status:      aws.String("SUCCESSFUL"),
+	}, nil
+}
+
+func (f fakeRoute53Domains) GetDomainDetail(input *route53domains.GetDomainDetailInput) (*route53domains.GetDomainDetailOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("route53domains.GetDomainDetail")
+	domain := *input.DomainName
+	if !f.registered[domain] {
+		return nil, awserr.NewRequestFailure(
+			awserr.New("InvalidInput", "Domain "+domain+" not found in account 123456789012", nil),
+			400, "fake-request")
+	}
+	output := &route53domains.GetDomainDetailOutput{DomainName: aws.String(domain)}
+	for _, nameServer := range f.domainNameServers[domain] {
+		output.Nameservers = append(output.Nameservers, &route53domains.Nameserver{Name: aws.String(nameServer)})
+	}
+	return output, nil
+}
+
+func (f fakeRoute53Domains) CheckDomainAvailability(input *route53domains.CheckDomainAvailabilityInput) (*route53domains.CheckDomainAvailabilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("route53domains.CheckDomainAvailability")
+	availability := "AVAILABLE"
+	if f.registered[*input.DomainName] || f.unavailable[*input.DomainName] {
+		availability = "UNAVAILABLE"
+	}
+	return &route53domains.CheckDomainAvailabilityOutput{Availability: aws.String(availability)}, nil
+}
+
+func (f fakeRoute53Domains) UpdateDomainNameservers(input *route53domains.UpdateDomainNameserversInput) (*route53domains.UpdateDomainNameserversOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("route53domains.UpdateDomainNameservers")
+	domain := *input.DomainName
+	if !f.registered[domain] {
+		return nil, awserr.New("InvalidInput", "Domain "+domain+" not found in account 123456789012", nil)
+	}
+	nameServers := []string{}
+	for _, nameServer := range input.Nameservers {
+		nameServers = append(nameServers, *nameServer.Name)
+	}
+	f.domainNameServers[domain] = nameServers
+	return &route53domains.UpdateDomainNameserversOutput{OperationId: aws.String(f.newID("op-"))}, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+// Cloudfront only allows one function per event on a cache behavior, so
+// everything scarr needs to do on viewer requests (eg the www redirect) gets
+// compiled into a single generated CloudFront Function.
+
+const functionRuntime = "cloudfront-js-1.0"
+
+func getFunctionName(config configType) string {
+	return config.Name + "-viewer-request"
+}
+
+// Quotes a string for use in the function's javascript.
+func jsString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+const viewerRequestHelpers = `
+function redirect(status, location) {
+    return {
+        statusCode: status,
+        headers: { location: { value: location } }
+    };
+}
+
+function querystring(request) {
+    var parts = [];
+    for (var key in request.querystring) {
+        var param = request.querystring[key];
+        var values = param.multiValue ? param.multiValue : [param];
+        for (var i = 0; i < values.length; i++) {
+            parts.push(values[i].value === '' ? key : key + '=' + values[i].value);
+        }
+    }
+    return parts.length ? '?' + parts.join('&') : '';
+}
+`
+
+// Returns the viewer request function's source, or "" if the site doesn't need
+// one.
+func buildViewerRequestCode(config configType) string {
+	steps := []string{}
+	if usesWWWRedirect(config) {
+		canonical := getCanonicalDomain(config)
+		for _, domain := range getSiteDomains(config) {
+			if domain != canonical {
+				steps = append(steps, fmt.Sprintf(`    if (host === %v) {
+        return redirect(301, %v + request.uri + querystring(request));
+    }`, jsString(domain), jsString("https://"+canonical)))
+			}
+		}
+	}
+	if usesPrivateOrigin(config) {
+		steps = append(steps, buildRedirectRuleSteps(config)...)
+
+		// The REST endpoint doesn't do index documents like the website
+		// endpoint does, so serve index.html for directories here.  Every
+		// other path goes to the bucket as is: extensionless files (eg
+		// LICENSE, or .well-known/ files) are common enough that guessing
+		// they're directories would break them.
+		steps = append(steps, `    if (request.uri.charAt(request.uri.length - 1) === '/') {
+        request.uri += 'index.html';
+    }`)
+	}
+	if len(steps) == 0 {
+		return ""
+	}
+
+	return `// Generated by scarr; changes made here get overwritten on the next deploy.
+function handler(event) {
+    var request = event.request;
+    var host = request.headers.host ? request.headers.host.value.toLowerCase() : '';
+` + strings.Join(steps, "\n") + `
+    return request;
+}
+` + viewerRequestHelpers
+}
+
+func publishCloudFrontFunction(name string, etag *string) (string, error) {
+	service := cloudFrontService()
+	result, err := service.PublishFunction(&cloudfront.PublishFunctionInput{
+		Name:    &name,
+		IfMatch: etag,
+	})
+	if err != nil {
+		return "", wrapAWSError(err, "publish cloudfront function "+name)
+	}
+	return *result.FunctionSummary.FunctionMetadata.FunctionARN, nil
+}
+
+// Returns the function's live code, or nil if it doesn't exist or was never
+// published.
+func getLiveFunctionCode(name string) ([]byte, error) {
+	service := cloudFrontService()
+	result, err := service.GetFunction(&cloudfront.GetFunctionInput{
+		Name:  &name,
+		Stage: aws.String("LIVE"),
+	})
+	if err != nil {
+		if awsErrorCode(err) == "NoSuchFunctionExists" {
+			return nil, nil
+		}
+		return nil, wrapAWSError(err, "get cloudfront function "+name)
+	}
+	return result.FunctionCode, nil
+}
+
+// Returns the function's summary and ETag, or nil if it doesn't exist.
+func describeCloudFrontFunction(name string) (*cloudfront.FunctionSummary, *string, error) {
+	service := cloudFrontService()
+	result, err := service.DescribeFunction(&cloudfront.DescribeFunctionInput{
+		Name:  &name,
+		Stage: aws.String("DEVELOPMENT"),
+	})
+	if err != nil {
+		if awsErrorCode(err) == "NoSuchFunctionExists" {
+			return nil, nil, nil
+		}
+		return nil, nil, wrapAWSError(err, "describe cloudfront function "+name)
+	}
+	return result.FunctionSummary, result.ETag, nil
+}
+
+// Makes sure the named function exists with the given code live.  Returns its
+// ARN.
+func ensureCloudFrontFunction(name string, code string) (string, error) {
+	service := cloudFrontService()
+	functionConfig := &cloudfront.FunctionConfig{
+		Comment: aws.String("Created by scarr.io"),
+		Runtime: aws.String(functionRuntime),
+	}
+
+	summary, etag, err := describeCloudFrontFunction(name)
+	if err != nil {
+		return "", err
+	}
+	if summary == nil {
+		log(" doesn't exist; creating...")
+		createResult, err := service.CreateFunction(&cloudfront.CreateFunctionInput{
+			Name:           &name,
+			FunctionCode:   []byte(code),
+			FunctionConfig: functionConfig,
+		})
+		if err != nil {
+			return "", wrapAWSError(err, "create cloudfront function "+name)
+		}
+		return publishCloudFrontFunction(name, createResult.ETag)
+	}
+
+	liveCode, err := getLiveFunctionCode(name)
+	if err != nil {
+		return "", err
+	}
+	if string(liveCode) == code {
+		log(" up to date.")
+		return *summary.FunctionMetadata.FunctionARN, nil
+	}
+
+	log(" updating...")
+	updateResult, err := service.UpdateFunction(&cloudfront.UpdateFunctionInput{
+		Name:           &name,
+		IfMatch:        etag,
+		FunctionCode:   []byte(code),
+		FunctionConfig: functionConfig,
+	})
+	if err != nil {
+		return "", wrapAWSError(err, "update cloudfront function "+name)
+	}
+	return publishCloudFrontFunction(name, updateResult.ETag)
+}
+
+// Only works once no distribution uses the function anymore.
+func deleteCloudFrontFunction(name string) error {
+	_, etag, err := describeCloudFrontFunction(name)
+	if err != nil || etag == nil {
+		return err
+	}
+	service := cloudFrontService()
+	_, err = service.DeleteFunction(&cloudfront.DeleteFunctionInput{
+		Name:    &name,
+		IfMatch: etag,
+	})
+	return wrapAWSError(err, "delete cloudfront function "+name)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Runs the generated viewer request function under node against each uri,
+// returning what it rewrote the request's uri to, or its redirect's location.
+func runViewerRequestCode(t *testing.T, code string, uris []string) []string {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "scarr-function")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	encoded, _ := json.Marshal(uris)
+	harness := code + `
+var results = ` + string(encoded) + `.map(function (uri) {
+    var result = handler({ request: { uri: uri, querystring: {}, headers: { host: { value: 'example.com' } } } });
+    return result.statusCode ? result.statusCode + ' ' + result.headers.location.value : result.uri;
+});
+console.log(JSON.stringify(results));
+`
+	script := filepath.Join(dir, "function.js")
+	if err := ioutil.WriteFile(script, []byte(harness), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(node, script).Output()
+	if err != nil {
+		t.Fatalf("failed to run the function: %v", err)
+	}
+	results := []string{}
+	if err := json.Unmarshal(output, &results); err != nil {
+		t.Fatalf("unexpected function output %q: %v", output, err)
+	}
+	return results
+}
+
+func TestViewerRequestIndexDocuments(t *testing.T) {
+	for _, spa := range []bool{false, true} {
+		config := configType{Domain: "example.com", Name: "example", Origin: "private", SPA: spa}
+		cases := map[string]string{
+			"/":          "/index.html",
+			"/docs/":     "/docs/index.html",
+			"/docs":      "/docs",
+			"/style.css": "/style.css",
+			"/LICENSE":   "/LICENSE",
+			"/CNAME":     "/CNAME",
+			"/.well-known/apple-app-site-association": "/.well-known/apple-app-site-association",
+			"/.well-known/": "/.well-known/index.html",
+		}
+		uris := []string{}
+		for uri := range cases {
+			uris = append(uris, uri)
+		}
+		results := runViewerRequestCode(t, buildViewerRequestCode(config), uris)
+		for i, uri := range uris {
+			if results[i] != cases[uri] {
+				t.Errorf("spa %v: expected %v to become %v, got %v", spa, uri, cases[uri], results[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// One entry in scarr.yml's headers list.  Matches files by regex (path) or glob
+// (glob), and sets the given headers on every matching file.
+type headerRuleType struct {
+	Path               string            `yaml:"path"`
+	Glob               string            `yaml:"glob"`
+	CacheControl       string            `yaml:"cacheControl"`
+	ContentDisposition string            `yaml:"contentDisposition"`
+	ContentLanguage    string            `yaml:"contentLanguage"`
+	Metadata           map[string]string `yaml:"metadata"`
+}
+
+// The headers an object should be stored with, besides its content type.
+type objectHeaders struct {
+	cacheControl       string
+	contentDisposition string
+	contentLanguage    string
+	// Keys are lowercased and without the x-amz-meta- prefix
+	metadata map[string]string
+}
+
+func validateHeaderRule(rule headerRuleType) error {
+	if rule.Path != "" {
+		if _, err := regexp.Compile(rule.Path); err != nil {
+			return newConfigError(err, "invalid headers path regex "+rule.Path)
+		}
+	} else if rule.Glob != "" {
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			return newConfigError(err, "invalid headers glob "+rule.Glob)
+		}
+	} else {
+		return newConfigError(nil, "every headers rule needs a path or glob")
+	}
+	return nil
+}
+
+func headerRuleMatches(rule headerRuleType, key string) bool {
+	// Invalid regexes and globs were already rejected by validateConfig
+	if rule.Path != "" {
+		matched, _ := regexp.MatchString(rule.Path, key)
+		return matched
+	}
+	if rule.Glob != "" {
+		// Globs without a slash match the file name anywhere in the tree (eg
+		// *.html), and globs with one match the whole path (eg assets/*.js).
+		name := key
+		if !strings.Contains(rule.Glob, "/") {
+			name = path.Base(key)
+		}
+		matched, _ := path.Match(rule.Glob, name)
+		return matched
+	}
+	return false
+}
+
+// Works out the headers for a key by applying every matching rule in order, so
+// later rules override earlier ones.
+func getObjectHeaders(key string, rules []headerRuleType) objectHeaders {
+	headers := objectHeaders{metadata: map[string]string{}}
+	for _, rule := range rules {
+		if !headerRuleMatches(rule, key) {
+			continue
+		}
+		if rule.CacheControl != "" {
+			headers.cacheControl = rule.CacheControl
+		}
+		if rule.ContentDisposition != "" {
+			headers.contentDisposition = rule.ContentDisposition
+		}
+		if rule.ContentLanguage != "" {
+			headers.contentLanguage = rule.ContentLanguage
+		}
+		for name, value := range rule.Metadata {
+			name = strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-")
+			headers.metadata[name] = value
+		}
+	}
+	return headers
+}
+
+// Builds objectHeaders from what HeadObject returned.
+func getRemoteObjectHeaders(cacheControl *string, contentDisposition *string, contentLanguage *string, metadata map[string]*string) objectHeaders {
+	headers := objectHeaders{
+		cacheControl:       aws.StringValue(cacheControl),
+		contentDisposition: aws.StringValue(contentDisposition),
+		contentLanguage:    aws.StringValue(contentLanguage),
+		metadata:           map[string]string{},
+	}
+	for name, value := range metadata {
+		headers.metadata[strings.ToLower(name)] = aws.StringValue(value)
+	}
+	return headers
+}
+
+func objectHeadersEqual(a objectHeaders, b objectHeaders) bool {
+	if a.cacheControl != b.cacheControl ||
+		a.contentDisposition != b.contentDisposition ||
+		a.contentLanguage != b.contentLanguage ||
+		len(a.metadata) != len(b.metadata) {
+		return false
+	}
+	for name, value := range a.metadata {
+		if otherValue, exists := b.metadata[name]; !exists || otherValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// A fingerprint of the headers, so a deploy manifest can record what each
+// object was uploaded with (see loadRemoteHeaders).
+func hashObjectHeaders(headers objectHeaders) string {
+	metadata := headers.metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	// encoding/json sorts map keys, so equal headers always hash the same
+	canonical, _ := json.Marshal([]interface{}{headers.cacheControl, headers.contentDisposition, headers.contentLanguage, metadata})
+	sum := md5.Sum(canonical)
+	return hex.EncodeToString(sum[:])
+}
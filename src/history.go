@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// After every deploy, scarr writes a manifest of what it deployed to
+// .scarr/deploys/<id>.json in the bucket.  Everything under .scarr/ belongs to
+// scarr: it's never synced, pruned, or readable through cloudfront.
+
+const scarrPrefix = ".scarr/"
+
+const deployManifestPrefix = scarrPrefix + "deploys/"
+
+// What one deploy put live.
+type deployManifest struct {
+	ID           string `json:"id"`
+	ScarrVersion string `json:"scarrVersion"`
+	// The HEAD commit of the git repo deploy ran in, if any
+	GitCommit      string         `json:"gitCommit,omitempty"`
+	Release        string         `json:"release,omitempty"`
+	InvalidationID string         `json:"invalidationId,omitempty"`
+	Files          []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+	// hashObjectHeaders of the headers the deploy left the object with.  Only
+	// set for local files, since scarr doesn't know what any other object in
+	// the bucket carries.
+	Headers string `json:"headers,omitempty"`
+}
+
+func isScarrKey(key string) bool {
+	return strings.HasPrefix(key, scarrPrefix)
+}
+
+func getDeployManifestKey(id string) string {
+	return deployManifestPrefix + id + ".json"
+}
+
+// The commit checked out in the current directory, or "" if it isn't a git
+// repo (or git isn't installed).
+var getGitCommit = func() string {
+	output, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// Builds the manifest for a deploy from what's now live in the bucket: the
+// release's files in release mode, otherwise the bucket's (minus scarr's own).
+// Only called once every local file made it up, so each of localFiles now has
+// its headers.
+func buildDeployManifest(config configType, releaseID string, invalidationID string, localFiles []localFile) (deployManifest, error) {
+	manifest := deployManifest{
+		ID:             now().UTC().Format(releaseIDFormat),
+		ScarrVersion:   getVersion(),
+		GitCommit:      getGitCommit(),
+		Release:        releaseID,
+		InvalidationID: invalidationID,
+		Files:          []manifestFile{},
+	}
+	var objects map[string]remoteObject
+	var err error
+	if releaseID != "" {
+		manifest.ID = releaseID
+		objects, err = getReleaseObjects(config, releaseID)
+	} else {
+		objects, err = getRemoteObjects(config.Region, getBucketName(config))
+	}
+	if err != nil {
+		return manifest, err
+	}
+	headers := map[string]string{}
+	for _, file := range localFiles {
+		headers[file.key] = hashObjectHeaders(file.headers)
+	}
+	for key, object := range objects {
+		if isScarrKey(key) {
+			continue
+		}
+		manifest.Files = append(manifest.Files, manifestFile{Key: key, ETag: object.etag, Size: object.size, Headers: headers[key]})
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Key < manifest.Files[j].Key })
+	return manifest, nil
+}
+
+// Writes the deploy's manifest to the bucket.  It's never public-read, so a
+// website bucket doesn't serve it either.
+func writeDeployManifest(config configType, manifest deployManifest) error {
+	body, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := getDeployManifestKey(manifest.ID)
+	service := s3Service(config.Region)
+	_, err = service.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(getBucketName(config)),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return wrapAWSError(err, "upload deploy manifest "+key)
+	}
+	logln("Recorded the deploy in " + key)
+	return nil
+}
+
+// The ID of the newest deploy recorded among objects (listed from the bucket's
+// root), or "" if there isn't one.
+func getLatestDeployID(objects map[string]remoteObject) string {
+	latest := ""
+	for key := range objects {
+		if !strings.HasPrefix(key, deployManifestPrefix) || !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		// IDs are timestamps, so they sort oldest first
+		if id := strings.TrimSuffix(strings.TrimPrefix(key, deployManifestPrefix), ".json"); id > latest {
+			latest = id
+		}
+	}
+	return latest
+}
+
+// Lists the IDs of the recorded deploys, oldest first.
+func listDeployManifests(config configType) ([]string, error) {
+	objects, err := getRemoteObjectsUnder(config.Region, getBucketName(config), deployManifestPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for key := range objects {
+		if strings.HasSuffix(key, ".json") {
+			ids = append(ids, strings.TrimSuffix(key, ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func readDeployManifest(config configType, id string) (deployManifest, error) {
+	manifest, found, err := findDeployManifest(config, id)
+	if err == nil && !found {
+		err = newConfigError(nil, "no deploy "+id+"; see scarr history")
+	}
+	return manifest, err
+}
+
+// Like readDeployManifest, but found is false rather than an error if the
+// deploy wasn't recorded (eg it predates manifests).
+func findDeployManifest(config configType, id string) (manifest deployManifest, found bool, err error) {
+	key := getDeployManifestKey(id)
+	service := s3Service(config.Region)
+	result, err := service.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(getBucketName(config)),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if awsErrorCode(err) == "NoSuchKey" {
+			return manifest, false, nil
+		}
+		return manifest, false, wrapAWSError(err, "get deploy manifest "+key)
+	}
+	defer result.Body.Close()
+	body, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		return manifest, false, fmt.Errorf("failed to read deploy manifest %v: %w", key, err)
+	}
+	if err = json.Unmarshal(body, &manifest); err != nil {
+		return manifest, false, fmt.Errorf("deploy manifest %v isn't valid: %w", key, err)
+	}
+	return manifest, true, nil
+}
+
+// How the files in two deploys differ.
+type manifestDiff struct {
+	added   []string
+	removed []string
+	changed []string
+}
+
+func diffDeployManifests(from deployManifest, to deployManifest) manifestDiff {
+	diff := manifestDiff{added: []string{}, removed: []string{}, changed: []string{}}
+	fromFiles := map[string]manifestFile{}
+	for _, file := range from.Files {
+		fromFiles[file.Key] = file
+	}
+	toFiles := map[string]bool{}
+	for _, file := range to.Files {
+		toFiles[file.Key] = true
+		previous, ok := fromFiles[file.Key]
+		if !ok {
+			diff.added = append(diff.added, file.Key)
+		} else if previous.ETag != file.ETag || previous.Size != file.Size {
+			diff.changed = append(diff.changed, file.Key)
+		}
+	}
+	for _, file := range from.Files {
+		if !toFiles[file.Key] {
+			diff.removed = append(diff.removed, file.Key)
+		}
+	}
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.changed)
+	return diff
+}
+
+func printDeployHistory(config configType) error {
+	ids, err := listDeployManifests(config)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fmt.Println("No deploys recorded yet")
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DEPLOY\tTIME\tVERSION\tCOMMIT\tFILES\tINVALIDATION")
+	// Newest first, like scarr releases
+	for i := len(ids) - 1; i >= 0; i-- {
+		manifest, err := readDeployManifest(config, ids[i])
+		if err != nil {
+			return err
+		}
+		deployed := "unknown"
+		if parsed, err := time.Parse(releaseIDFormat, manifest.ID); err == nil {
+			deployed = parsed.Format("2006-01-02 15:04:05 UTC")
+		}
+		commit := manifest.GitCommit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\t%v\n", manifest.ID, deployed, manifest.ScarrVersion, commit, len(manifest.Files), manifest.InvalidationID)
+	}
+	return writer.Flush()
+}
+
+func printDeployDiff(config configType, fromID string, toID string) error {
+	from, err := readDeployManifest(config, fromID)
+	if err != nil {
+		return err
+	}
+	to, err := readDeployManifest(config, toID)
+	if err != nil {
+		return err
+	}
+	diff := diffDeployManifests(from, to)
+	if len(diff.added)+len(diff.removed)+len(diff.changed) == 0 {
+		fmt.Println("No files changed between " + fromID + " and " + toID)
+		return nil
+	}
+	for _, key := range diff.added {
+		fmt.Println("+ " + key)
+	}
+	for _, key := range diff.removed {
+		fmt.Println("- " + key)
+	}
+	for _, key := range diff.changed {
+		fmt.Println("~ " + key)
+	}
+	return nil
+}
+
+// Lists the recorded deploys, or with two deploy IDs, what changed between
+// them.
+func runHistory(args []string) error {
+	config, err := getConfig()
+	if err != nil {
+		return err
+	}
+	switch len(args) {
+	case 0:
+		return printDeployHistory(config)
+	case 2:
+		return printDeployDiff(config, args[0], args[1])
+	}
+	return newConfigError(nil, "history takes either no deploys (to list them) or two (to diff them)")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeployHistory(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer func(original func() time.Time) { now = original }(now)
+	deployTime := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return deployTime }
+	defer func(original func() string) { getGitCommit = original }(getGitCommit)
+	getGitCommit = func() string { return "0123456789abcdef" }
+	files := copySite()
+	// A local .scarr/ directory never gets uploaded
+	files[".scarr/deploys/local.json"] = "{}"
+	defer useSite(t, files)()
+
+	if err := runDeploy(false, true, false, false, false, true, 4); err != nil {
+		t.Fatal(err)
+	}
+	deployTime = deployTime.Add(time.Hour)
+	files["index.html"] = "<h1>new home</h1>"
+	files["new.html"] = "new"
+	delete(files, "style.css")
+	defer useSite(t, files)()
+	// Pruning leaves the first deploy's manifest alone
+	if err := runDeploy(true, false, false, false, false, true, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := listDeployManifests(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"20261018T120000Z", "20261018T130000Z"}) {
+		t.Fatalf("expected a manifest for each deploy, got %v", ids)
+	}
+	if _, ok := fake.buckets["example-bucket"].objects[".scarr/deploys/local.json"]; ok {
+		t.Error("expected the local .scarr directory not to be uploaded")
+	}
+
+	first, err := readDeployManifest(config, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ScarrVersion != getVersion() || first.GitCommit != "0123456789abcdef" || first.InvalidationID == "" {
+		t.Errorf("expected the manifest to record the version, commit, and invalidation, got %+v", first)
+	}
+	keys := []string{}
+	for _, file := range first.Files {
+		keys = append(keys, file.Key)
+		// about/index.html is the only file the second deploy didn't touch
+		if object := fake.buckets["example-bucket"].objects[file.Key]; file.Key == "about/index.html" && file.ETag != object.etag {
+			t.Errorf("expected %v's hash to match the bucket's, got %v", file.Key, file.ETag)
+		}
+	}
+	if !reflect.DeepEqual(keys, []string{"about/index.html", "index.html", "style.css"}) {
+		t.Errorf("expected the manifest to list the site's files, got %v", keys)
+	}
+
+	second, err := readDeployManifest(config, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := diffDeployManifests(first, second)
+	expected := manifestDiff{added: []string{"new.html"}, removed: []string{"style.css"}, changed: []string{"index.html"}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected diff %+v, got %+v", expected, diff)
+	}
+
+	if _, err := readDeployManifest(config, "20261018T110000Z"); err == nil {
+		t.Error("expected an error reading a deploy that doesn't exist")
+	}
+}
+
+func TestGetPrunableKeysSkipsScarrFiles(t *testing.T) {
+	remote := map[string]remoteObject{
+		"index.html":                           {},
+		"old.html":                             {},
+		"_redirects":                           {},
+		".scarr/deploys/20261018T120000Z.json": {},
+	}
+	local := []localFile{{key: "index.html"}}
+	if keys := getPrunableKeys(local, remote, &[]string{}); !reflect.DeepEqual(keys, []string{"old.html"}) {
+		t.Errorf("expected only old.html to be prunable, got %v", keys)
+	}
+}
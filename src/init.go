@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"fmt"
 	"io/ioutil"
 	"os"
 	"text/template"
@@ -34,9 +33,91 @@ exclude:
   - "scarr\\.yml"
   - "^\\.git"
   - "\\.DS_Store"
+
+# Delete files from the bucket that no longer exist locally.  Files matching the
+# exclude list above are never deleted.  Same as running deploy with -delete.
+prune: false
+
+# Headers to set on uploaded files.  Each rule matches by regex (path) or glob
+# (glob), and later matching rules override earlier ones.  Changed headers cause
+# a re-upload.
+# headers:
+#   - path: "^assets/"
+#     cacheControl: "public, max-age=31536000, immutable"
+#   - glob: "*.html"
+#     cacheControl: "no-cache"
+#     contentDisposition: "inline"
+#     contentLanguage: "en"
+#     metadata:
+#       x-amz-meta-team: "web"
+
+# Compress matching files before upload and serve them with Content-Encoding.
+# encoding is gzip, the only encoding every client accepts (s3 stores one copy of
+# each file, so there's no falling back to an uncompressed one).
+# compress:
+#   encoding: gzip
+#   extensions: [".html", ".css", ".js", ".json", ".svg", ".txt", ".xml"]
+#   minSize: 1024
+
+# Serve the site from one of example.com and www.example.com and 301 the other
+# to it: apex (serve from the bare domain), www-primary (serve from www), or none.
+# Redirect rules go under rules: from (ending in * to match a prefix), to (a path
+# or URL; ending in * carries over what the from's * matched), and status
+# (defaults to 301).  With origin: website, every from has to end in * (and can't
+# be just /*), since s3 routing rules only match prefixes.  They can also go in a
+# _redirects file, one "from to [status]" per line.
+# redirects:
+#   www: apex
+#   rules:
+#     - from: /blog/*
+#       to: /posts/*
+
+# How cloudfront reads the bucket.  website (the default) makes the bucket a
+# public s3 website; private blocks all public access to the bucket and lets only
+# cloudfront read it.
+# origin: private
+
+# Error pages.  notFoundPage is served with a 404 for paths that don't exist;
+# responses customize other statuses (page, responseCode, and how many seconds
+# cloudfront caches the error).
+# errors:
+#   notFoundPage: 404.html
+#   responses:
+#     - status: 500
+#       page: 500.html
+#       responseCode: 503
+#       ttl: 0
+
+# For single page apps: serve /index.html with a 200 for paths that don't
+# exist, so client-side routes work.
+# spa: true
+
+# Security headers on every response.  "default" sends HSTS, nosniff,
+# X-Frame-Options, and Referrer-Policy; as a block, it can also set
+# contentSecurityPolicy, custom headers, and cors, or override the preset.
+# securityHeaders: default
+
+# Upload each deploy as a new release under releases/<id>/ and switch to it all
+# at once; see scarr releases and scarr rollback.  Needs origin: private.  keep
+# is how many releases to leave in the bucket.
+# releases:
+#   keep: 10
+
+# After syncing, changed paths are invalidated in cloudfront individually.  If
+# more than this many paths changed, everything (/*) is invalidated instead.
+invalidationThreshold: 100
+
+# Send API calls somewhere other than AWS, eg a local emulator.  Services not
+# listed here use the SCARR_ENDPOINT_URL environment variable if it's set.
+# endpoints:
+#   s3: "http://localhost:4566"
+#   cloudfront: "http://localhost:4566"
+#   acm: "http://localhost:4566"
+#   route53: "http://localhost:4566"
+#   route53domains: "http://localhost:4566"
 `
 
-func generateConfig(domain string, name string, region string) string {
+func generateConfig(domain string, name string, region string) (string, error) {
 	configTemplate := template.Must(template.New("config").Parse(configTemplateString))
 	buffer := &bytes.Buffer{}
 	data := map[string]interface{}{
@@ -44,24 +125,33 @@ func generateConfig(domain string, name string, region string) string {
 		"domain": domain,
 		"region": region,
 	}
-	check(configTemplate.Execute(buffer, data))
+	err := configTemplate.Execute(buffer, data)
 
-	return buffer.String()
+	return buffer.String(), err
 }
 
-func writeFile(path string, content string) {
-	check(ioutil.WriteFile(path, []byte(content), 0644))
+func writeFile(path string, content string) error {
+	return ioutil.WriteFile(path, []byte(content), 0644)
 }
 
-func runInit(domain string, name string, region string) {
+func runInit(domain string, name string, region string) error {
+	if domain == "" || name == "" {
+		return newConfigError(nil, "init needs both -domain and -name (eg scarr init -domain example.com -name example)")
+	}
+
 	log("Initializing...")
 	err := os.Mkdir(name, 0755)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
+	}
+	config, err := generateConfig(domain, name, region)
+	if err != nil {
+		return err
+	}
+	if err = writeFile(name+"/scarr.yml", config); err != nil {
+		return err
 	}
-	config := generateConfig(domain, name, region)
-	writeFile(name+"/scarr.yml", config)
 	logln("done")
 	logln("You'll need to edit scarr.yml to fill in contact details if you want to use scarr register domain names.")
+	return nil
 }
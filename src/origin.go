@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// How cloudfront reads from the bucket.  In the default "website" mode the
+// bucket is a public S3 website and cloudfront fetches from its website
+// endpoint over http.  In "private" mode the bucket blocks all public access
+// and cloudfront reads from its REST endpoint over https, signing requests
+// with an Origin Access Control that the bucket policy trusts.
+
+func validateOrigin(origin string) error {
+	switch origin {
+	case "", "website", "private":
+		return nil
+	}
+	return newConfigError(nil, "unknown origin "+origin+" (expected website or private)")
+}
+
+func usesPrivateOrigin(config configType) bool {
+	return config.Origin == "private"
+}
+
+// The bucket's REST endpoint, which is what cloudfront uses as a private
+// origin.
+func getS3RESTDomain(bucket string, region string) string {
+	return bucket + ".s3." + region + ".amazonaws.com"
+}
+
+// The domain cloudfront should use as the site's origin.
+func getOriginDomain(config configType) string {
+	bucket := getBucketName(config)
+	if usesPrivateOrigin(config) {
+		return getS3RESTDomain(bucket, config.Region)
+	}
+	return getS3WebsiteDomain(bucket, config.Region)
+}
+
+// Every origin the site's distribution might have, so it's still found after
+// switching origin modes (the distribution's origin gets fixed up by
+// reconcileCloudFront).
+func getOriginDomains(config configType) []string {
+	bucket := getBucketName(config)
+	return []string{getS3WebsiteDomain(bucket, config.Region), getS3RESTDomain(bucket, config.Region)}
+}
+
+func getOriginAccessControlName(config configType) string {
+	return config.Name + "-oac"
+}
+
+// Returns the ID of the origin access control with the given name, or "" if
+// there isn't one.
+func findOriginAccessControl(name string) (string, error) {
+	service := cloudFrontService()
+	input := &cloudfront.ListOriginAccessControlsInput{}
+	for {
+		result, err := service.ListOriginAccessControls(input)
+		if err != nil {
+			return "", wrapAWSError(err, "list origin access controls")
+		}
+		list := result.OriginAccessControlList
+		for _, summary := range list.Items {
+			if aws.StringValue(summary.Name) == name {
+				return *summary.Id, nil
+			}
+		}
+		if !aws.BoolValue(list.IsTruncated) {
+			return "", nil
+		}
+		input.Marker = list.NextMarker
+	}
+}
+
+// Makes sure the site's origin access control exists.  Returns its ID.
+func ensureOriginAccessControl(config configType) (string, error) {
+	name := getOriginAccessControlName(config)
+	logf("Checking origin access control %v...", name)
+	id, err := findOriginAccessControl(name)
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		logln(" already exists.")
+		return id, nil
+	}
+
+	log(" doesn't exist; creating...")
+	service := cloudFrontService()
+	result, err := service.CreateOriginAccessControl(&cloudfront.CreateOriginAccessControlInput{
+		OriginAccessControlConfig: &cloudfront.OriginAccessControlConfig{
+			Name:                          &name,
+			Description:                   aws.String("Created by scarr.io"),
+			OriginAccessControlOriginType: aws.String("s3"),
+			SigningBehavior:               aws.String("always"),
+			SigningProtocol:               aws.String("sigv4"),
+		},
+	})
+	if err != nil {
+		return "", wrapAWSError(err, "create origin access control "+name)
+	}
+	logln(" done")
+	return *result.OriginAccessControl.Id, nil
+}
+
+func deleteOriginAccessControl(id string) error {
+	service := cloudFrontService()
+	result, err := service.GetOriginAccessControl(&cloudfront.GetOriginAccessControlInput{Id: &id})
+	if err != nil {
+		return wrapAWSError(err, "get origin access control")
+	}
+	_, err = service.DeleteOriginAccessControl(&cloudfront.DeleteOriginAccessControlInput{
+		Id:      &id,
+		IfMatch: result.ETag,
+	})
+	return wrapAWSError(err, "delete origin access control")
+}
+
+// Whether the bucket blocks every kind of public access.
+func bucketBlocksPublicAccess(bucketName string, region string) (bool, error) {
+	service := s3Service(region)
+	result, err := service.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{Bucket: &bucketName})
+	if err != nil {
+		if awsErrorCode(err) == "NoSuchPublicAccessBlockConfiguration" {
+			return false, nil
+		}
+		return false, wrapAWSError(err, "get public access block for "+bucketName)
+	}
+	block := result.PublicAccessBlockConfiguration
+	return aws.BoolValue(block.BlockPublicAcls) && aws.BoolValue(block.IgnorePublicAcls) &&
+		aws.BoolValue(block.BlockPublicPolicy) && aws.BoolValue(block.RestrictPublicBuckets), nil
+}
+
+// Blocks public access to the bucket.  Objects uploaded while the bucket was a
+// public website keep their public-read ACLs, but IgnorePublicAcls makes s3
+// disregard them.
+func ensureBucketBlocksPublicAccess(bucketName string, region string) error {
+	blocked, err := bucketBlocksPublicAccess(bucketName, region)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		logln("Bucket already blocks public access")
+		return nil
+	}
+
+	log("Blocking public access to the bucket...")
+	service := s3Service(region)
+	_, err = service.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+		Bucket: &bucketName,
+		PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return wrapAWSError(err, "block public access to "+bucketName)
+	}
+	logln(" done")
+	return nil
+}
+
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Sid       string                       `json:"Sid"`
+	Effect    string                       `json:"Effect"`
+	Principal map[string]string            `json:"Principal"`
+	Action    string                       `json:"Action"`
+	Resource  string                       `json:"Resource"`
+	Condition map[string]map[string]string `json:"Condition"`
+}
+
+// A bucket policy letting only the given distribution read the bucket.
+// ListBucket lets cloudfront tell missing files (404) from forbidden ones
+// (403).  Scarr's own files under .scarr/ (eg deploy manifests) stay private.
+func buildBucketPolicy(bucketName string, distributionARN string) string {
+	statement := func(sid string, effect string, action string, resource string) policyStatement {
+		return policyStatement{
+			Sid:       sid,
+			Effect:    effect,
+			Principal: map[string]string{"Service": "cloudfront.amazonaws.com"},
+			Action:    action,
+			Resource:  resource,
+			Condition: map[string]map[string]string{
+				"StringEquals": {"AWS:SourceArn": distributionARN},
+			},
+		}
+	}
+	policy := policyDocument{
+		Version: "2012-10-17",
+		Statement: []policyStatement{
+			statement("ScarrCloudFrontRead", "Allow", "s3:GetObject", "arn:aws:s3:::"+bucketName+"/*"),
+			statement("ScarrCloudFrontList", "Allow", "s3:ListBucket", "arn:aws:s3:::"+bucketName),
+			statement("ScarrCloudFrontHideScarrFiles", "Deny", "s3:GetObject", "arn:aws:s3:::"+bucketName+"/"+scarrPrefix+"*"),
+		},
+	}
+	encoded, _ := json.Marshal(policy)
+	return string(encoded)
+}
+
+// Returns the bucket's policy, or "" if it doesn't have one.
+func getBucketPolicy(bucketName string, region string) (string, error) {
+	service := s3Service(region)
+	result, err := service.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: &bucketName})
+	if err != nil {
+		if awsErrorCode(err) == "NoSuchBucketPolicy" {
+			return "", nil
+		}
+		return "", wrapAWSError(err, "get bucket policy for "+bucketName)
+	}
+	return aws.StringValue(result.Policy), nil
+}
+
+// Whether two policy documents say the same thing, ignoring formatting (s3
+// hands policies back reformatted).
+func samePolicy(a string, b string) bool {
+	var aDoc, bDoc policyDocument
+	if json.Unmarshal([]byte(a), &aDoc) != nil || json.Unmarshal([]byte(b), &bDoc) != nil {
+		return false
+	}
+	aJSON, _ := json.Marshal(aDoc)
+	bJSON, _ := json.Marshal(bDoc)
+	return string(aJSON) == string(bJSON)
+}
+
+// Makes sure the bucket policy lets the distribution read the bucket.  This
+// replaces any other policy on the bucket, since scarr owns the bucket.
+func ensureBucketPolicy(bucketName string, region string, distributionARN string) error {
+	desired := buildBucketPolicy(bucketName, distributionARN)
+	current, err := getBucketPolicy(bucketName, region)
+	if err != nil {
+		return err
+	}
+	if samePolicy(current, desired) {
+		logln("Bucket policy already lets cloudfront read the bucket")
+		return nil
+	}
+
+	log("Setting bucket policy so only cloudfront can read the bucket...")
+	service := s3Service(region)
+	_, err = service.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: &bucketName,
+		Policy: &desired,
+	})
+	if err != nil {
+		return wrapAWSError(err, "put bucket policy for "+bucketName)
+	}
+	logln(" done")
+	return nil
+}
+
+func ensureDistributionCanReadBucket(bucketName string, region string, distributionID string) error {
+	distributionARN, err := getDistributionARN(distributionID)
+	if err != nil {
+		return err
+	}
+	return ensureBucketPolicy(bucketName, region, distributionARN)
+}
+
+// Whether the distribution reads from the bucket's REST endpoint yet.
+func distributionUsesRESTOrigin(config configType, distributionID string) (bool, error) {
+	distributionConfig, _, err := getDistributionConfig(distributionID)
+	if err != nil {
+		return false, err
+	}
+	restDomain := getS3RESTDomain(getBucketName(config), config.Region)
+	for _, origin := range distributionConfig.Origins.Items {
+		if aws.StringValue(origin.DomainName) != restDomain {
+			return false, nil
+		}
+	}
+	return len(distributionConfig.Origins.Items) > 0, nil
+}
+
+// Finishes making the bucket private once the distribution is set up: the
+// bucket policy (for a distribution that was just created), then blocking
+// public access.  Blocking waits until the distribution reads from the REST
+// endpoint, since the website endpoint it used before stops working then.  If
+// the distribution update was declined, this errors rather than let the deploy
+// upload files without public-read ACLs that the website endpoint can't serve.
+func ensurePrivateOrigin(config configType, distributionID string) error {
+	bucket := getBucketName(config)
+	if err := ensureDistributionCanReadBucket(bucket, config.Region, distributionID); err != nil {
+		return err
+	}
+	usesREST, err := distributionUsesRESTOrigin(config, distributionID)
+	if err != nil {
+		return err
+	}
+	if !usesREST {
+		return newConfigError(nil, "distribution "+distributionID+" still reads from the bucket's website endpoint, so the bucket stays public for now; deploy again and accept the update (or pass -yes) to finish switching to origin: private")
+	}
+	return ensureBucketBlocksPublicAccess(bucket, config.Region)
+}
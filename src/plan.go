@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// One infrastructure step of a deploy and what deploy would do about it.
+type planStep struct {
+	Resource string `json:"resource"`
+	// "none", "create", "update", "register", "validate", or "blocked"
+	Action string `json:"action"`
+	Detail string `json:"detail"`
+}
+
+type deployPlan struct {
+	Steps             []planStep `json:"steps"`
+	Upload            []string   `json:"upload"`
+	Delete            []string   `json:"delete"`
+	Skip              []string   `json:"skip"`
+	InvalidationPaths []string   `json:"invalidationPaths"`
+}
+
+func planDomainRegistration(config configType) (planStep, error) {
+	domain := getRootDomain(config.Domain)
+	step := planStep{Resource: "domain registration"}
+	domainDetail, err := getDomainDetails(domain)
+	if err != nil {
+		return step, err
+	}
+	if domainDetail != nil {
+		step.Action = "none"
+		step.Detail = domain + " is registered in route53"
+		return step, nil
+	}
+
+	available, err := getDomainAvailability(domain)
+	if err != nil {
+		return step, err
+	}
+	if available {
+		step.Action = "register"
+		step.Detail = domain + " is available and would be registered (after a prompt unless -auto-register)"
+	} else {
+		step.Action = "blocked"
+		step.Detail = domain + " is not in route53 and is not available to register"
+	}
+	return step, nil
+}
+
+func planHostedZone(domain string) (planStep, error) {
+	rootDomain := getRootDomain(domain)
+	step := planStep{Resource: "hosted zone"}
+	hostedZoneID, err := findHostedZone(domain)
+	if err != nil {
+		return step, err
+	}
+	if hostedZoneID != "" {
+		step.Action = "none"
+		step.Detail = hostedZoneID + " holds the records for " + rootDomain
+		return step, nil
+	}
+
+	domainDetail, err := getDomainDetails(rootDomain)
+	if err != nil {
+		return step, err
+	}
+	step.Action = "create"
+	if domainDetail != nil {
+		step.Detail = "would create a hosted zone for " + rootDomain + " and point the domain's name servers at it"
+	} else {
+		step.Detail = "would create a hosted zone for " + rootDomain + " and print the name servers to set at your registrar"
+	}
+	return step, nil
+}
+
+func planACMCertificate(domain string, skipDNS bool) (planStep, error) {
+	validateHow := "create its validation dns record if missing"
+	if skipDNS {
+		validateHow = "print its validation record for your DNS provider"
+	}
+	step := planStep{Resource: "acm certificate"}
+	certificateArn, err := getAcmCertificateARN(domain)
+	if err != nil {
+		return step, err
+	}
+	if certificateArn == nil {
+		step.Action = "create"
+		step.Detail = "would request a certificate for " + domain + " and *." + domain + ", " + validateHow + " and wait"
+		return step, nil
+	}
+
+	validation, err := getCertificateValidation(*certificateArn)
+	if err != nil {
+		return step, err
+	}
+	if validation.ValidationStatus != nil && *validation.ValidationStatus == "SUCCESS" {
+		step.Action = "none"
+		step.Detail = *certificateArn + " is validated"
+	} else if validation.ValidationStatus != nil && *validation.ValidationStatus == "FAILED" {
+		step.Action = "blocked"
+		step.Detail = *certificateArn + " failed validation"
+	} else {
+		step.Action = "validate"
+		step.Detail = *certificateArn + " is pending validation; would " + validateHow + " and wait"
+	}
+	return step, nil
+}
+
+func planS3Bucket(bucket string, region string, private bool, desiredWebsite *s3.WebsiteConfiguration) (planStep, bool, error) {
+	step := planStep{Resource: "s3 bucket"}
+	exists, err := bucketExists(bucket, region)
+	if err != nil {
+		return step, false, err
+	}
+	if !exists {
+		step.Action = "create"
+		if private {
+			step.Detail = "would create " + bucket + " in " + region + " and block public access to it"
+		} else {
+			step.Detail = "would create " + bucket + " in " + region + " and configure it as a website"
+		}
+		return step, false, nil
+	}
+
+	if private {
+		blocked, err := bucketBlocksPublicAccess(bucket, region)
+		if err != nil {
+			return step, true, err
+		}
+		if !blocked {
+			step.Action = "update"
+			step.Detail = bucket + " exists; would block public access to it once the distribution reads from its REST endpoint"
+		} else {
+			step.Action = "none"
+			step.Detail = bucket + " exists and blocks public access"
+		}
+		return step, true, nil
+	}
+
+	website, err := getBucketWebsite(bucket, region)
+	if err != nil {
+		return step, true, err
+	}
+	if website == nil {
+		step.Action = "create"
+		step.Detail = bucket + " exists; would add its website configuration"
+	} else if !websiteMatches(website, desiredWebsite) {
+		step.Action = "update"
+		step.Detail = bucket + " exists; would update its website configuration (error document and redirects)"
+	} else {
+		step.Action = "none"
+		step.Detail = bucket + " exists and is configured as a website"
+	}
+	return step, true, nil
+}
+
+// Returns the step and the ARN the distribution would end up using: the
+// existing function's, a placeholder for one that'd be created, or "" if the
+// site doesn't need one.
+func planViewerRequestFunction(config configType) (planStep, string, error) {
+	name := getFunctionName(config)
+	step := planStep{Resource: "cloudfront function"}
+	code := buildViewerRequestCode(config)
+	if code == "" {
+		step.Action = "none"
+		step.Detail = "not needed"
+		return step, "", nil
+	}
+
+	summary, _, err := describeCloudFrontFunction(name)
+	if err != nil {
+		return step, "", err
+	}
+	if summary == nil {
+		step.Action = "create"
+		step.Detail = "would create and publish " + name
+		return step, "(new function)", nil
+	}
+	liveCode, err := getLiveFunctionCode(name)
+	if err != nil {
+		return step, "", err
+	}
+	if string(liveCode) == code {
+		step.Action = "none"
+		step.Detail = name + " is up to date"
+	} else {
+		step.Action = "update"
+		step.Detail = "would update and publish " + name
+	}
+	return step, *summary.FunctionMetadata.FunctionARN, nil
+}
+
+// Returns the origin access control the distribution would use: the existing
+// one's ID, or a placeholder for one that'd be created.
+func planOriginAccessControl(config configType) (planStep, string, error) {
+	name := getOriginAccessControlName(config)
+	step := planStep{Resource: "origin access control"}
+	id, err := findOriginAccessControl(name)
+	if err != nil {
+		return step, "", err
+	}
+	if id == "" {
+		step.Action = "create"
+		step.Detail = "would create " + name
+		return step, "(new origin access control)", nil
+	}
+	step.Action = "none"
+	step.Detail = name + " (" + id + ") exists"
+	return step, id, nil
+}
+
+func planBucketPolicy(config configType) (planStep, error) {
+	bucket := getBucketName(config)
+	step := planStep{Resource: "bucket policy"}
+	_, distributionID, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return step, err
+	}
+	if distributionID == nil {
+		step.Action = "create"
+		step.Detail = "would let only the new distribution read " + bucket
+		return step, nil
+	}
+	distributionARN, err := getDistributionARN(*distributionID)
+	if err != nil {
+		return step, err
+	}
+	exists, err := bucketExists(bucket, config.Region)
+	if err != nil {
+		return step, err
+	}
+	current := ""
+	if exists {
+		if current, err = getBucketPolicy(bucket, config.Region); err != nil {
+			return step, err
+		}
+	}
+	if samePolicy(current, buildBucketPolicy(bucket, distributionARN)) {
+		step.Action = "none"
+		step.Detail = "only " + *distributionID + " can read " + bucket
+	} else {
+		step.Action = "update"
+		step.Detail = "would set " + bucket + "'s policy to let only " + *distributionID + " read it"
+	}
+	return step, nil
+}
+
+// Returns the response headers policy the distribution would use: the existing
+// one's ID, a placeholder for one that'd be created, or "" if the site doesn't
+// set securityHeaders.
+func planResponseHeadersPolicy(config configType) (planStep, string, error) {
+	name := getResponseHeadersPolicyName(config)
+	step := planStep{Resource: "response headers policy"}
+	if config.SecurityHeaders == nil {
+		step.Action = "none"
+		step.Detail = "not needed"
+		return step, "", nil
+	}
+	id, err := findResponseHeadersPolicy(name)
+	if err != nil {
+		return step, "", err
+	}
+	if id == "" {
+		step.Action = "create"
+		step.Detail = "would create " + name
+		return step, "(new response headers policy)", nil
+	}
+	current, _, err := getResponseHeadersPolicyConfig(id)
+	if err != nil {
+		return step, "", err
+	}
+	if sameResponseHeadersPolicy(current, buildResponseHeadersPolicyConfig(name, config.SecurityHeaders)) {
+		step.Action = "none"
+		step.Detail = name + " (" + id + ") is up to date"
+	} else {
+		step.Action = "update"
+		step.Detail = "would update " + name + " (" + id + ") to send the headers in scarr.yml"
+	}
+	return step, id, nil
+}
+
+// certificateArn, functionARN, originAccessControlID, and
+// responseHeadersPolicyID are what the distribution would use, to check it for
+// drift.
+func planCloudFront(config configType, certificateArn string, functionARN string, originAccessControlID string, responseHeadersPolicyID string) (planStep, error) {
+	step := planStep{Resource: "cloudfront distribution"}
+	originDomain := getOriginDomain(config)
+	cloudfrontDomain, distributionID, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return step, err
+	}
+	if cloudfrontDomain == nil {
+		step.Action = "create"
+		step.Detail = "would create a distribution in front of " + originDomain
+		return step, nil
+	}
+
+	current, _, err := getDistributionConfig(*distributionID)
+	if err != nil {
+		return step, err
+	}
+	desired := buildDistributionConfig(config, certificateArn, functionARN, originAccessControlID, responseHeadersPolicyID)
+	if usesReleases(config) {
+		if err = keepLiveRelease(desired, *distributionID); err != nil {
+			return step, err
+		}
+	}
+	changes := diffDistributionConfig(current, desired)
+	if len(changes) > 0 {
+		descriptions := []string{}
+		for _, change := range changes {
+			descriptions = append(descriptions, change.String())
+		}
+		step.Action = "update"
+		step.Detail = "would update " + *distributionID + " (" + strings.Join(descriptions, "; ") + ")"
+		return step, nil
+	}
+	step.Action = "none"
+	step.Detail = *distributionID + " (" + *cloudfrontDomain + ") already points at " + originDomain
+	return step, nil
+}
+
+func planAliasRecord(domain string, recordType string) (planStep, error) {
+	step := planStep{Resource: "alias record"}
+	hostedZoneID, err := findHostedZone(domain)
+	if err != nil {
+		return step, err
+	}
+	if hostedZoneID == "" {
+		step.Action = "create"
+		step.Detail = "would create an " + recordType + " alias from " + domain + " to the cloudfront distribution in the new hosted zone"
+		return step, nil
+	}
+
+	exists, err := dnsRecordExists(hostedZoneID, domain, recordType)
+	if err != nil {
+		return step, err
+	}
+	if exists {
+		step.Action = "none"
+		step.Detail = domain + " already has an " + recordType + " record"
+	} else {
+		step.Action = "create"
+		step.Detail = "would create an " + recordType + " alias from " + domain + " to the cloudfront distribution"
+	}
+	return step, nil
+}
+
+// For -skip-dns, checks public DNS for the record pointing the domain at
+// cloudfront.
+func planExternalDNSRecord(config configType, domain string) (planStep, error) {
+	step := planStep{Resource: "dns record"}
+	cloudfrontDomain, _, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return step, err
+	}
+	if cloudfrontDomain == nil {
+		step.Action = "create"
+		step.Detail = "would print a record pointing " + domain + " at the new distribution for your DNS provider and wait for it"
+	} else if domainPointsAt(domain, *cloudfrontDomain) {
+		step.Action = "none"
+		step.Detail = domain + " points at " + *cloudfrontDomain
+	} else {
+		step.Action = "create"
+		step.Detail = "would print a CNAME from " + domain + " to " + *cloudfrontDomain + " for your DNS provider and wait for it"
+	}
+	return step, nil
+}
+
+// Runs every infrastructure check in deploy order, skipping the same steps
+// deploy would.
+func planInfrastructure(config configType, skipDomain bool, skipDNS bool) ([]planStep, bool, error) {
+	s3Bucket := getBucketName(config)
+	private := usesPrivateOrigin(config)
+
+	steps := []planStep{}
+	var step planStep
+	var err error
+	if !skipDomain {
+		if step, err = planDomainRegistration(config); err != nil {
+			return nil, false, err
+		}
+		steps = append(steps, step)
+	}
+
+	if !skipDNS {
+		if step, err = planHostedZone(config.Domain); err != nil {
+			return nil, false, err
+		}
+		steps = append(steps, step)
+	}
+
+	if step, err = planACMCertificate(config.Domain, skipDNS); err != nil {
+		return nil, false, err
+	}
+	steps = append(steps, step)
+
+	step, bucketExists, err := planS3Bucket(s3Bucket, config.Region, private, buildWebsiteConfiguration(config))
+	if err != nil {
+		return nil, false, err
+	}
+	steps = append(steps, step)
+
+	originAccessControlID := ""
+	if private {
+		if step, originAccessControlID, err = planOriginAccessControl(config); err != nil {
+			return nil, false, err
+		}
+		steps = append(steps, step)
+	}
+
+	step, functionARN, err := planViewerRequestFunction(config)
+	if err != nil {
+		return nil, false, err
+	}
+	steps = append(steps, step)
+
+	// A certificate deploy would create counts as a change, like a new function
+	certificateArn := "(new certificate)"
+	existingArn, err := getAcmCertificateARN(config.Domain)
+	if err != nil {
+		return nil, false, err
+	}
+	if existingArn != nil {
+		certificateArn = *existingArn
+	}
+	step, responseHeadersPolicyID, err := planResponseHeadersPolicy(config)
+	if err != nil {
+		return nil, false, err
+	}
+	steps = append(steps, step)
+
+	if step, err = planCloudFront(config, certificateArn, functionARN, originAccessControlID, responseHeadersPolicyID); err != nil {
+		return nil, false, err
+	}
+	steps = append(steps, step)
+
+	if private {
+		if step, err = planBucketPolicy(config); err != nil {
+			return nil, false, err
+		}
+		steps = append(steps, step)
+	}
+
+	for _, domain := range getSiteDomains(config) {
+		if skipDNS {
+			if step, err = planExternalDNSRecord(config, domain); err != nil {
+				return nil, false, err
+			}
+			steps = append(steps, step)
+			continue
+		}
+		for _, recordType := range aliasRecordTypes {
+			if step, err = planAliasRecord(domain, recordType); err != nil {
+				return nil, false, err
+			}
+			steps = append(steps, step)
+		}
+	}
+	return steps, bucketExists, nil
+}
+
+// Works out everything a deploy would do, calling only read-only AWS APIs.
+func getDeployPlan(config configType, skipSetup bool, skipDomain bool, skipDNS bool, prune bool) (deployPlan, error) {
+	s3Bucket := getBucketName(config)
+
+	plan := deployPlan{Steps: []planStep{}}
+	bucketExists := true
+	if !skipSetup {
+		var err error
+		if plan.Steps, bucketExists, err = planInfrastructure(config, skipDomain, skipDNS); err != nil {
+			return plan, err
+		}
+	}
+
+	localFiles, err := getLocalFiles(config)
+	if err != nil {
+		return plan, err
+	}
+	if usesReleases(config) {
+		return planRelease(config, plan, localFiles)
+	}
+	// A bucket that doesn't exist yet is as good as an empty one
+	remoteObjects := map[string]remoteObject{}
+	if bucketExists {
+		if remoteObjects, err = getRemoteObjects(config.Region, s3Bucket); err != nil {
+			return plan, err
+		}
+		if err = loadRemoteHeaders(config, s3Bucket, localFiles, remoteObjects, defaultConcurrency); err != nil {
+			return plan, err
+		}
+	}
+	sync := planSync(localFiles, remoteObjects, &config.Exclude, prune)
+
+	plan.Upload = []string{}
+	for _, file := range sync.upload {
+		plan.Upload = append(plan.Upload, file.key)
+	}
+	plan.Skip = []string{}
+	for _, file := range sync.skip {
+		plan.Skip = append(plan.Skip, file.key)
+	}
+	plan.Delete = sync.delete
+
+	plan.InvalidationPaths = []string{}
+	if changedKeys := sync.changedKeys(); len(changedKeys) > 0 {
+		plan.InvalidationPaths = getInvalidationPaths(changedKeys, config.InvalidationThreshold)
+	}
+	return plan, nil
+}
+
+// A release copies the live release's unchanged files, uploads the rest, and
+// invalidates the ones that differ from the live release.
+func planRelease(config configType, plan deployPlan, localFiles []localFile) (deployPlan, error) {
+	liveID := ""
+	liveObjects := map[string]remoteObject{}
+	_, distributionID, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return plan, err
+	}
+	if distributionID != nil {
+		if liveID, err = getLiveRelease(*distributionID); err != nil {
+			return plan, err
+		}
+		if liveObjects, err = getReleaseObjects(config, liveID); err != nil {
+			return plan, err
+		}
+	}
+	toCopy, toUpload, err := planReleaseFiles(config, liveID, liveObjects, localFiles)
+	if err != nil {
+		return plan, err
+	}
+
+	id := newReleaseID()
+	detail := "would upload every file under " + getReleasePrefix(id) + " and switch the distribution to it"
+	if len(toCopy) > 0 {
+		detail = fmt.Sprintf("would copy %v unchanged files from release %v and upload the rest under %v, then switch the distribution to it", len(toCopy), liveID, getReleasePrefix(id))
+	}
+	plan.Steps = append(plan.Steps, planStep{
+		Resource: "release",
+		Action:   "create",
+		Detail:   detail,
+	})
+	plan.Upload = []string{}
+	for _, file := range toUpload {
+		plan.Upload = append(plan.Upload, file.key)
+	}
+	// Copied files count as skipped, since they don't get uploaded
+	plan.Skip = []string{}
+	for _, file := range toCopy {
+		plan.Skip = append(plan.Skip, file.key)
+	}
+	plan.Delete = []string{}
+	plan.InvalidationPaths = []string{}
+	if changedKeys := planSync(localFiles, liveObjects, &config.Exclude, true).changedKeys(); len(changedKeys) > 0 {
+		plan.InvalidationPaths = getInvalidationPaths(changedKeys, config.InvalidationThreshold)
+	}
+	return plan, nil
+}
+
+func printPlan(plan deployPlan) {
+	if len(plan.Steps) > 0 {
+		fmt.Println("Infrastructure:")
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, step := range plan.Steps {
+			fmt.Fprintf(writer, "  %v\t%v\t%v\n", step.Resource, step.Action, step.Detail)
+		}
+		writer.Flush()
+		fmt.Println("")
+	}
+
+	fmt.Printf("Files (%v to upload, %v to delete, %v unchanged):\n", len(plan.Upload), len(plan.Delete), len(plan.Skip))
+	for _, key := range plan.Upload {
+		fmt.Println("  upload  " + key)
+	}
+	for _, key := range plan.Delete {
+		fmt.Println("  delete  " + key)
+	}
+	fmt.Println("")
+
+	if len(plan.InvalidationPaths) == 0 {
+		fmt.Println("Nothing to invalidate")
+		return
+	}
+	fmt.Println("Invalidation paths:")
+	for _, path := range plan.InvalidationPaths {
+		fmt.Println("  " + path)
+	}
+}
+
+// Prints what a deploy would do without changing anything.
+func runPlan(skipSetup bool, skipDomain bool, skipDNS bool, prune bool, asJSON bool) error {
+	config, err := getConfig()
+	if err != nil {
+		return err
+	}
+	plan, err := getDeployPlan(config, skipSetup, skipDomain, skipDNS, prune || config.Prune)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		output, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+	} else {
+		printPlan(plan)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Calls that change something in AWS, by operation name prefix.
+var mutatingCallPrefixes = []string{"Put", "Create", "Update", "Delete", "Register", "Request", "Change", "Publish", "Upload", "Copy", "Associate", "Tag"}
+
+// Runs runPlan with -json, failing the test if it changed anything in AWS.
+func runJSONPlan(t *testing.T, fake *fakeAWS, prune bool) deployPlan {
+	t.Helper()
+	start := len(fake.calls)
+	output, err := captureStdout(t, func() error { return runPlan(false, false, false, prune, true) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, call := range fake.calls[start:] {
+		operation := call[strings.Index(call, ".")+1:]
+		for _, prefix := range mutatingCallPrefixes {
+			if strings.HasPrefix(operation, prefix) {
+				t.Errorf("expected plan to only read from AWS, but it called %v", call)
+			}
+		}
+	}
+
+	plan := deployPlan{}
+	if err = json.Unmarshal([]byte(output), &plan); err != nil {
+		t.Fatalf("expected the plan as JSON, got %q: %v", output, err)
+	}
+	return plan
+}
+
+func planActions(plan deployPlan) map[string]string {
+	actions := map[string]string{}
+	for _, step := range plan.Steps {
+		actions[step.Resource] = step.Action
+	}
+	return actions
+}
+
+func TestPlanFreshAccount(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer useSite(t, copySite())()
+
+	plan := runJSONPlan(t, fake, false)
+	actions := planActions(plan)
+	for resource, action := range map[string]string{
+		"domain registration":     "register",
+		"s3 bucket":               "create",
+		"cloudfront distribution": "create",
+	} {
+		if actions[resource] != action {
+			t.Errorf("expected the %v step to be %v, got %q (steps: %+v)", resource, action, actions[resource], plan.Steps)
+		}
+	}
+	if !reflect.DeepEqual(plan.Upload, []string{"about/index.html", "index.html", "style.css"}) {
+		t.Errorf("expected every file to be uploaded, got %v", plan.Upload)
+	}
+	if len(plan.Skip) != 0 || len(plan.Delete) != 0 {
+		t.Errorf("expected nothing to skip or delete, got %v and %v", plan.Skip, plan.Delete)
+	}
+}
+
+func TestPlanAfterDeploy(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	seedInfrastructure(fake)
+	files := copySite()
+	defer useSite(t, files)()
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	files["index.html"] = "<h1>new home</h1>"
+	files["new.html"] = "new"
+	delete(files, "style.css")
+	defer useSite(t, files)()
+	plan := runJSONPlan(t, fake, true)
+
+	for _, step := range plan.Steps {
+		if step.Action != "none" {
+			t.Errorf("expected the infrastructure to be up to date, got %+v", step)
+		}
+	}
+	expected := deployPlan{
+		Steps:             plan.Steps,
+		Upload:            []string{"index.html", "new.html"},
+		Delete:            []string{"style.css"},
+		Skip:              []string{"about/index.html"},
+		InvalidationPaths: []string{"/index.html", "/", "/new.html", "/style.css"},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected plan %+v, got %+v", expected, plan)
+	}
+	// Plan left the bucket as it was
+	if keys := bucketKeys(fake, "example-bucket"); !reflect.DeepEqual(keys, []string{"about/index.html", "index.html", "style.css"}) {
+		t.Errorf("expected the bucket to be untouched, got %v", keys)
+	}
+}
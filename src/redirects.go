@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// scarr.yml's redirects block.
+type redirectsConfigType struct {
+	// How www.<domain> relates to <domain>: "apex" serves the site from the
+	// apex and redirects www to it, "www-primary" does the reverse, and "none"
+	// (the default) leaves www alone.
+	WWW   string               `yaml:"www"`
+	Rules []redirectRuleConfig `yaml:"rules"`
+}
+
+// One path redirect.  From is a path on the site; ending it in * makes it match
+// everything under that prefix.  To is a path on the site or a full URL; ending
+// it in * carries over whatever the * in From matched.
+type redirectRuleConfig struct {
+	From   string `yaml:"from"`
+	To     string `yaml:"to"`
+	Status int    `yaml:"status"`
+}
+
+// redirects can also just be a list of rules, for sites that don't care about
+// www.
+func (config *redirectsConfigType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var rules []redirectRuleConfig
+	if err := unmarshal(&rules); err == nil {
+		config.Rules = rules
+		return nil
+	}
+	type plain redirectsConfigType
+	return unmarshal((*plain)(config))
+}
+
+// Rules in this file (in the site's root) get added after the ones in
+// scarr.yml.  Each line is "from to [status]"; blank lines and lines starting
+// with # are skipped.
+const redirectsFileName = "_redirects"
+
+const defaultRedirectStatus = 301
+
+var redirectStatuses = map[int]bool{301: true, 302: true, 303: true, 307: true, 308: true}
+
+// S3 won't take more routing rules than this on a website config.
+const maxRoutingRules = 50
+
+// Returns the rules in the _redirects file, or nil if there isn't one.
+func readRedirectsFile(path string) ([]redirectRuleConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, newConfigError(err, "error reading "+path)
+	}
+	defer file.Close()
+
+	rules := []redirectRuleConfig{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, newConfigError(nil, fmt.Sprintf("%v line %v should be \"from to [status]\"", path, lineNumber))
+		}
+		rule := redirectRuleConfig{From: fields[0], To: fields[1]}
+		if len(fields) == 3 {
+			if rule.Status, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, newConfigError(err, fmt.Sprintf("%v line %v has a status that isn't a number", path, lineNumber))
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, newConfigError(err, "error reading "+path)
+	}
+	return rules, nil
+}
+
+func (rule redirectRuleConfig) isPrefix() bool {
+	return strings.HasSuffix(rule.From, "*")
+}
+
+func (rule redirectRuleConfig) getStatus() int {
+	if rule.Status == 0 {
+		return defaultRedirectStatus
+	}
+	return rule.Status
+}
+
+// Where a path matching the rule redirects to.  ok is false if the rule doesn't
+// match.
+func (rule redirectRuleConfig) apply(path string) (destination string, ok bool) {
+	if !rule.isPrefix() {
+		return rule.To, path == rule.From
+	}
+	prefix := strings.TrimSuffix(rule.From, "*")
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	if strings.HasSuffix(rule.To, "*") {
+		return strings.TrimSuffix(rule.To, "*") + strings.TrimPrefix(path, prefix), true
+	}
+	return rule.To, true
+}
+
+func validateRedirectRule(rule redirectRuleConfig) error {
+	describe := "redirect from " + rule.From
+	if !strings.HasPrefix(rule.From, "/") {
+		return newConfigError(nil, describe+" should start with /")
+	}
+	if rule.From == "/" {
+		return newConfigError(nil, "redirects can't match just / (use /* to redirect the whole site)")
+	}
+	if strings.Contains(strings.TrimSuffix(rule.From, "*"), "*") {
+		return newConfigError(nil, describe+" can only have a * at the end")
+	}
+	if rule.To == "" {
+		return newConfigError(nil, describe+" needs a to")
+	}
+	if !strings.HasPrefix(rule.To, "/") && !strings.HasPrefix(rule.To, "https://") && !strings.HasPrefix(rule.To, "http://") {
+		return newConfigError(nil, describe+" should go to a path starting with / or a full http(s) URL")
+	}
+	if strings.Contains(strings.TrimSuffix(rule.To, "*"), "*") {
+		return newConfigError(nil, describe+" can only have a * at the end of its to")
+	}
+	if strings.HasSuffix(rule.To, "*") && !rule.isPrefix() {
+		return newConfigError(nil, describe+" ends its to with * but doesn't end its from with one")
+	}
+	if !redirectStatuses[rule.getStatus()] {
+		return newConfigError(nil, fmt.Sprintf("%v has status %v (expected 301, 302, 303, 307, or 308)", describe, rule.Status))
+	}
+	return nil
+}
+
+// S3 routing rules only match key prefixes, so with origin: website a rule has
+// to be a prefix rule, and one that leaves something to match and redirect to.
+func validateRoutingRule(rule redirectRuleConfig) error {
+	describe := "redirect from " + rule.From
+	if !rule.isPrefix() {
+		return newConfigError(nil, describe+" needs origin: private to match exactly; s3 routing rules only match prefixes, so it would also redirect every path starting with "+rule.From+" (end it in * if that's what you want)")
+	}
+	if rule.From == "/*" {
+		return newConfigError(nil, "redirect from /* would be an s3 routing rule that redirects the whole site; use origin: private")
+	}
+	if !strings.HasSuffix(rule.To, "*") && routingRuleKey(rule.To) == "" {
+		return newConfigError(nil, describe+" goes to "+rule.To+", which has no path for an s3 routing rule to redirect to; use origin: private")
+	}
+	return nil
+}
+
+// The bucket key a redirect destination (a path, or a full URL) points at.
+func routingRuleKey(to string) string {
+	if !strings.HasPrefix(to, "/") {
+		// Already validated as an http(s) URL
+		parsed, _ := url.Parse(to)
+		to = parsed.Path
+	}
+	// S3 keys don't start with /
+	return strings.TrimPrefix(to, "/")
+}
+
+// Turns a redirect destination into a path on the site, or "" if it leaves the
+// site.  siteDomains counts as the site, since the www redirect sends any of
+// them to the same path on the canonical one.
+func sitePath(destination string, siteDomains []string) string {
+	if strings.HasPrefix(destination, "/") {
+		return destination
+	}
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return ""
+	}
+	for _, domain := range siteDomains {
+		if strings.EqualFold(parsed.Host, domain) {
+			if parsed.Path == "" {
+				return "/"
+			}
+			return parsed.Path
+		}
+	}
+	return ""
+}
+
+// Follows the redirects from path, the way a browser would.  Errors if they
+// loop, or go on for longer than there are rules (which with prefix rules means
+// the path keeps growing forever).
+func checkRedirectChain(path string, rules []redirectRuleConfig, siteDomains []string) error {
+	chain := []string{path}
+	seen := map[string]bool{path: true}
+	for hops := 0; ; hops++ {
+		var next string
+		for _, rule := range rules {
+			if destination, ok := rule.apply(path); ok {
+				next = sitePath(destination, siteDomains)
+				break
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		chain = append(chain, next)
+		if seen[next] {
+			return newConfigError(nil, "redirect loop: "+strings.Join(chain, " -> "))
+		}
+		if hops >= len(rules) {
+			return newConfigError(nil, "redirects never stop: "+strings.Join(chain, " -> ")+" -> ...")
+		}
+		seen[next] = true
+		path = next
+	}
+}
+
+// S3 routing rules can't express some rules (see validateRoutingRule), so
+// website says whether they'll become routing rules.
+func validateRedirectsConfig(config redirectsConfigType, siteDomains []string, website bool) error {
+	switch config.WWW {
+	case "", "none", "apex", "www-primary":
+	default:
+		return newConfigError(nil, "unknown redirects www setting "+config.WWW+" (expected apex, www-primary, or none)")
+	}
+	for _, rule := range config.Rules {
+		if err := validateRedirectRule(rule); err != nil {
+			return err
+		}
+		if website {
+			if err := validateRoutingRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rule := range config.Rules {
+		// Prefix rules get checked with an example path under the prefix
+		start := rule.From
+		if rule.isPrefix() {
+			start = strings.TrimSuffix(rule.From, "*") + "example"
+		}
+		if err := checkRedirectChain(start, config.Rules, siteDomains); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func usesWWWRedirect(config configType) bool {
+	return config.Redirects.WWW == "apex" || config.Redirects.WWW == "www-primary"
+}
+
+// The host the site is actually served from.  Any other host in
+// getSiteDomains redirects here.
+func getCanonicalDomain(config configType) string {
+	if config.Redirects.WWW == "www-primary" {
+		return "www." + config.Domain
+	}
+	return config.Domain
+}
+
+// Every host the distribution answers for, and that gets a dns record.
+func getSiteDomains(config configType) []string {
+	if usesWWWRedirect(config) {
+		return []string{config.Domain, "www." + config.Domain}
+	}
+	return []string{config.Domain}
+}
+
+// The redirect rules as S3 website routing rules, which only match key
+// prefixes (validateRoutingRule makes sure every rule is a prefix rule).  S3
+// fills in the host of a redirect from the request, which behind cloudfront is
+// the bucket's website endpoint, so redirects within the site name the
+// canonical domain explicitly.
+func buildRoutingRules(config configType) []*s3.RoutingRule {
+	routingRules := []*s3.RoutingRule{}
+	for _, rule := range config.Redirects.Rules {
+		redirect := &s3.Redirect{
+			HttpRedirectCode: aws.String(strconv.Itoa(rule.getStatus())),
+			HostName:         aws.String(getCanonicalDomain(config)),
+			Protocol:         aws.String("https"),
+		}
+		if !strings.HasPrefix(rule.To, "/") {
+			// Already validated as an http(s) URL
+			parsed, _ := url.Parse(rule.To)
+			redirect.HostName = aws.String(parsed.Host)
+			redirect.Protocol = aws.String(parsed.Scheme)
+		}
+		key := routingRuleKey(rule.To)
+		if strings.HasSuffix(rule.To, "*") {
+			redirect.ReplaceKeyPrefixWith = aws.String(strings.TrimSuffix(key, "*"))
+		} else {
+			redirect.ReplaceKeyWith = aws.String(key)
+		}
+		routingRules = append(routingRules, &s3.RoutingRule{
+			Condition: &s3.Condition{KeyPrefixEquals: aws.String(strings.TrimSuffix(strings.TrimPrefix(rule.From, "/"), "*"))},
+			Redirect:  redirect,
+		})
+	}
+	return routingRules
+}
+
+// Renders routing rules for comparison.
+func describeRoutingRules(routingRules []*s3.RoutingRule) string {
+	descriptions := []string{}
+	for _, rule := range routingRules {
+		condition, redirect := rule.Condition, rule.Redirect
+		if condition == nil {
+			condition = &s3.Condition{}
+		}
+		if redirect == nil {
+			redirect = &s3.Redirect{}
+		}
+		descriptions = append(descriptions, strings.Join([]string{
+			aws.StringValue(condition.KeyPrefixEquals),
+			aws.StringValue(condition.HttpErrorCodeReturnedEquals),
+			aws.StringValue(redirect.HttpRedirectCode),
+			aws.StringValue(redirect.Protocol),
+			aws.StringValue(redirect.HostName),
+			aws.StringValue(redirect.ReplaceKeyPrefixWith),
+			aws.StringValue(redirect.ReplaceKeyWith),
+		}, " "))
+	}
+	return strings.Join(descriptions, "\n")
+}
+
+// The redirect rules as steps in the viewer request function, for private
+// origins (which have no website config to put routing rules in).
+func buildRedirectRuleSteps(config configType) []string {
+	steps := []string{}
+	for _, rule := range config.Redirects.Rules {
+		condition := fmt.Sprintf("request.uri === %v", jsString(rule.From))
+		location := jsString(rule.To)
+		if rule.isPrefix() {
+			prefix := strings.TrimSuffix(rule.From, "*")
+			condition = fmt.Sprintf("request.uri.indexOf(%v) === 0", jsString(prefix))
+			if strings.HasSuffix(rule.To, "*") {
+				location = fmt.Sprintf("%v + request.uri.substring(%v)", jsString(strings.TrimSuffix(rule.To, "*")), len(prefix))
+			}
+		}
+		steps = append(steps, fmt.Sprintf(`    if (%v) {
+        return redirect(%v, %v + querystring(request));
+    }`, condition, rule.getStatus(), location))
+	}
+	return steps
+}
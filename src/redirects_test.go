@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRedirectsConfigAcceptsList(t *testing.T) {
+	var config configType
+	if err := yaml.Unmarshal([]byte("redirects:\n  - from: /old\n    to: /new\n"), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Redirects.Rules) != 1 || config.Redirects.Rules[0].To != "/new" {
+		t.Errorf("expected one rule to /new, got %v", config.Redirects.Rules)
+	}
+
+	config = configType{}
+	if err := yaml.Unmarshal([]byte("redirects:\n  www: apex\n  rules:\n    - from: /old\n      to: /new\n      status: 302\n"), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Redirects.WWW != "apex" || len(config.Redirects.Rules) != 1 || config.Redirects.Rules[0].Status != 302 {
+		t.Errorf("expected www and one 302 rule, got %v", config.Redirects)
+	}
+}
+
+func TestReadRedirectsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scarr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "_redirects")
+	contents := "# moved in the redesign\n/blog/* /posts/*\n\n/about  /team  302\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readRedirectsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []redirectRuleConfig{{From: "/blog/*", To: "/posts/*"}, {From: "/about", To: "/team", Status: 302}}
+	if len(rules) != len(expected) || rules[0] != expected[0] || rules[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, rules)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("/just-one-field\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRedirectsFile(path); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected an error about line 1, got %v", err)
+	}
+
+	os.Remove(path)
+	if rules, err := readRedirectsFile(path); rules != nil || err != nil {
+		t.Errorf("expected no rules and no error without the file, got %v, %v", rules, err)
+	}
+}
+
+func TestValidateRedirectsConfig(t *testing.T) {
+	domains := []string{"example.com", "www.example.com"}
+	cases := []struct {
+		name    string
+		rules   []redirectRuleConfig
+		website bool
+		err     string
+	}{
+		{name: "chain", rules: []redirectRuleConfig{{From: "/a", To: "/b"}, {From: "/b", To: "/c"}}},
+		{name: "prefix", rules: []redirectRuleConfig{{From: "/blog/*", To: "/posts/*"}}},
+		{name: "offsite", rules: []redirectRuleConfig{{From: "/*", To: "https://example.org/*"}}},
+		{name: "relative from", rules: []redirectRuleConfig{{From: "a", To: "/b"}}, err: "should start with /"},
+		{name: "root", rules: []redirectRuleConfig{{From: "/", To: "/b"}}, err: "just /"},
+		{name: "star in middle", rules: []redirectRuleConfig{{From: "/a/*/b", To: "/b"}}, err: "at the end"},
+		{name: "splat without prefix", rules: []redirectRuleConfig{{From: "/a", To: "/b/*"}}, err: "doesn't end its from"},
+		{name: "bad status", rules: []redirectRuleConfig{{From: "/a", To: "/b", Status: 200}}, err: "status 200"},
+		{name: "loop", rules: []redirectRuleConfig{{From: "/a", To: "/b"}, {From: "/b", To: "/a"}}, err: "redirect loop: /a -> /b -> /a"},
+		{name: "loop through own domain", rules: []redirectRuleConfig{{From: "/a", To: "https://www.example.com/a"}}, err: "redirect loop"},
+		{name: "growing prefix", rules: []redirectRuleConfig{{From: "/a/*", To: "/a/b/*"}}, err: "never stop"},
+		{name: "exact rule into its own prefix", rules: []redirectRuleConfig{{From: "/a", To: "/ab"}}},
+		{name: "website prefix rule", rules: []redirectRuleConfig{{From: "/old/*", To: "/new/*"}}, website: true},
+		{name: "website prefix rule offsite", rules: []redirectRuleConfig{{From: "/old/*", To: "https://example.org/*"}}, website: true},
+		{name: "website exact rule", rules: []redirectRuleConfig{{From: "/a", To: "/b"}}, website: true, err: "needs origin: private"},
+		{name: "website whole site", rules: []redirectRuleConfig{{From: "/*", To: "https://example.org/*"}}, website: true, err: "whole site"},
+		{name: "website to bare URL", rules: []redirectRuleConfig{{From: "/old/*", To: "https://example.org"}}, website: true, err: "no path"},
+		{name: "website to root", rules: []redirectRuleConfig{{From: "/old/*", To: "/"}}, website: true, err: "no path"},
+	}
+	for _, c := range cases {
+		err := validateRedirectsConfig(redirectsConfigType{Rules: c.rules}, domains, c.website)
+		if c.err == "" && err != nil {
+			t.Errorf("%v: expected no error, got %v", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%v: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+// In release mode each deploy uploads the whole site under its own
+// releases/<id>/ prefix, and only then points the distribution's origin path at
+// it.  Visitors never see a half-uploaded site, and going back is just pointing
+// the origin path at an older release.
+
+// scarr.yml's releases block.
+type releasesConfigType struct {
+	Enabled bool `yaml:"enabled"`
+	// How many releases to keep, counting the live one.  Older ones get
+	// deleted after each deploy.
+	Keep int `yaml:"keep"`
+}
+
+// releases can also just be true or false.  Writing out the block turns
+// releases on unless it says enabled: false.
+func (config *releasesConfigType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		config.Enabled = enabled
+		return nil
+	}
+	type plain releasesConfigType
+	config.Enabled = true
+	return unmarshal((*plain)(config))
+}
+
+const defaultReleasesKept = 10
+
+const releasesPrefix = "releases/"
+
+// Release IDs are when the release was made, so they sort oldest to newest.
+const releaseIDFormat = "20060102T150405Z"
+
+// Swapped out in tests, so releases get predictable IDs.
+var now = time.Now
+
+func usesReleases(config configType) bool {
+	return config.Releases.Enabled
+}
+
+func validateReleasesConfig(config configType) error {
+	if !usesReleases(config) {
+		return nil
+	}
+	// The website endpoint's index redirects, routing rules, and error
+	// document all work on whole keys, so they'd point outside the release.
+	if !usesPrivateOrigin(config) {
+		return newConfigError(nil, "releases need origin: private")
+	}
+	if config.Releases.Keep < 0 {
+		return newConfigError(nil, "releases keep can't be negative")
+	}
+	return nil
+}
+
+func getReleasesKept(config configType) int {
+	if config.Releases.Keep == 0 {
+		return defaultReleasesKept
+	}
+	return config.Releases.Keep
+}
+
+func newReleaseID() string {
+	return now().UTC().Format(releaseIDFormat)
+}
+
+func getReleasePrefix(id string) string {
+	return releasesPrefix + id + "/"
+}
+
+// The origin path that serves the release, or "" (the bucket's root) for no
+// release.
+func getReleaseOriginPath(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "/" + strings.TrimSuffix(getReleasePrefix(id), "/")
+}
+
+// The release the distribution is serving, or "" if it isn't serving one.
+func getLiveRelease(distributionID string) (string, error) {
+	distributionConfig, _, err := getDistributionConfig(distributionID)
+	if err != nil {
+		return "", err
+	}
+	for _, origin := range distributionConfig.Origins.Items {
+		if originPath := aws.StringValue(origin.OriginPath); strings.HasPrefix(originPath, "/"+releasesPrefix) {
+			return strings.TrimPrefix(originPath, "/"+releasesPrefix), nil
+		}
+	}
+	return "", nil
+}
+
+func setOriginPath(distributionConfig *cloudfront.DistributionConfig, originPath string) {
+	for _, origin := range distributionConfig.Origins.Items {
+		origin.OriginPath = &originPath
+	}
+}
+
+// Keeps the desired distribution config on whatever release is live, so
+// checking it for drift doesn't undo the last deploy or rollback.
+func keepLiveRelease(desired *cloudfront.DistributionConfig, distributionID string) error {
+	liveID, err := getLiveRelease(distributionID)
+	if err != nil {
+		return err
+	}
+	setOriginPath(desired, getReleaseOriginPath(liveID))
+	return nil
+}
+
+// Points the distribution at the release and waits for that to roll out.
+func switchRelease(distributionID string, id string) error {
+	originPath := getReleaseOriginPath(id)
+	_, err := updateCloudFront(distributionID, func(current *cloudfront.DistributionConfig) (bool, error) {
+		for _, origin := range current.Origins.Items {
+			if aws.StringValue(origin.OriginPath) != originPath {
+				setOriginPath(current, originPath)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	return err
+}
+
+type release struct {
+	id      string
+	created time.Time
+	files   int
+}
+
+// Lists the releases in the bucket, newest first.
+func listReleases(config configType) ([]release, error) {
+	objects, err := getRemoteObjectsUnder(config.Region, getBucketName(config), releasesPrefix)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for key := range objects {
+		if slash := strings.Index(key, "/"); slash > 0 {
+			counts[key[:slash]]++
+		}
+	}
+	releases := []release{}
+	for id, files := range counts {
+		// Zero if the ID isn't a timestamp, eg a release made by hand
+		created, _ := time.Parse(releaseIDFormat, id)
+		releases = append(releases, release{id: id, created: created, files: files})
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].id > releases[j].id })
+	return releases, nil
+}
+
+// The release's objects, keyed by their path within the release.
+func getReleaseObjects(config configType, id string) (map[string]remoteObject, error) {
+	if id == "" {
+		return map[string]remoteObject{}, nil
+	}
+	return getRemoteObjectsUnder(config.Region, getBucketName(config), getReleasePrefix(id))
+}
+
+// The paths whose content differs between two releases, ie the ones to
+// invalidate when switching from one to the other.
+func getReleaseChanges(from map[string]remoteObject, to map[string]remoteObject) []string {
+	changed := []string{}
+	for key, object := range to {
+		if previous, ok := from[key]; !ok || previous.etag != object.etag || previous.size != object.size {
+			changed = append(changed, key)
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func getReleaseDistributionID(config configType) (string, error) {
+	_, distributionID, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return "", err
+	}
+	if distributionID == nil {
+		return "", newConfigError(nil, "no cloudfront distribution found for "+getOriginDomain(config)+"; run deploy without -skip-setup first")
+	}
+	return *distributionID, nil
+}
+
+// Splits the local files into the ones a new release can copy from the live
+// one, and the ones it has to upload.  A file gets copied if the live release
+// has it with the same content and, according to the live release's manifest,
+// the same headers.  Copying a multipart object gives the copy a plain md5
+// ETag, which would no longer match the file's, so those always get uploaded.
+func planReleaseFiles(config configType, liveID string, liveObjects map[string]remoteObject, localFiles []localFile) (toCopy []localFile, toUpload []localFile, err error) {
+	recorded := map[string]manifestFile{}
+	if liveID != "" {
+		manifest, found, err := findDeployManifest(config, liveID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if found {
+			for _, file := range manifest.Files {
+				recorded[file.Key] = file
+			}
+		}
+	}
+
+	toCopy, toUpload = []localFile{}, []localFile{}
+	for _, file := range localFiles {
+		entry, ok := recorded[file.key]
+		if ok && !fileContentChanged(file, liveObjects) && entry.ETag == file.etag &&
+			entry.Headers == hashObjectHeaders(file.headers) && !strings.Contains(file.etag, "-") {
+			toCopy = append(toCopy, file)
+		} else {
+			toUpload = append(toUpload, file)
+		}
+	}
+	return toCopy, toUpload, nil
+}
+
+// Makes a new release out of the local files and makes it live: unchanged
+// files are copied over from the live release, and the rest uploaded.  If any
+// copy or upload fails, the release is left in the bucket but never goes live.
+// Returns the release's ID, the paths that changed since the previous release,
+// and any failed copies or uploads.
+func deployRelease(config configType, localFiles []localFile, concurrency int) (string, []string, []uploadFailure, error) {
+	bucket := getBucketName(config)
+	distributionID, err := getReleaseDistributionID(config)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	liveID, err := getLiveRelease(distributionID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	id := newReleaseID()
+	if id <= liveID {
+		return "", nil, nil, fmt.Errorf("release %v is older than the live release %v; check your clock", id, liveID)
+	}
+
+	liveObjects, err := getReleaseObjects(config, liveID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	changed := planSync(localFiles, liveObjects, &config.Exclude, true).changedKeys()
+	sort.Strings(changed)
+
+	toCopy, toUpload, err := planReleaseFiles(config, liveID, liveObjects, localFiles)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	prefix := getReleasePrefix(id)
+	copies := []objectCopy{}
+	for _, file := range toCopy {
+		copies = append(copies, objectCopy{from: getReleasePrefix(liveID) + file.key, to: prefix + file.key})
+	}
+	copied, failures := copyObjects(s3Service(config.Region), bucket, copies, concurrency)
+	releaseFiles := []localFile{}
+	for _, file := range toUpload {
+		file.key = prefix + file.key
+		releaseFiles = append(releaseFiles, file)
+	}
+	uploaded, uploadFailures := uploadFiles(s3ManagerService(config.Region), bucket, releaseFiles, false, concurrency)
+	failures = append(failures, uploadFailures...)
+	sort.Slice(failures, func(i, j int) bool { return failures[i].key < failures[j].key })
+	logf("Uploaded %v and copied %v of %v files to release %v (%v failed)\n", len(uploaded), len(copied), len(localFiles), id, len(failures))
+	for _, failure := range failures {
+		fmt.Fprintf(os.Stderr, "  Failed to upload %v: %v\n", failure.key, failure.err)
+	}
+	if len(failures) > 0 {
+		logln("Not making release " + id + " live, since it's incomplete")
+		return id, nil, failures, nil
+	}
+
+	logln("Switching the distribution to release " + id)
+	if err = switchRelease(distributionID, id); err != nil {
+		return "", nil, nil, err
+	}
+	if err = pruneReleases(config, id); err != nil {
+		return id, changed, nil, err
+	}
+	return id, changed, nil, nil
+}
+
+// Deletes all but the newest releases (see getReleasesKept), never touching
+// the live one.
+func pruneReleases(config configType, liveID string) error {
+	releases, err := listReleases(config)
+	if err != nil {
+		return err
+	}
+	bucket := getBucketName(config)
+	// The live release always stays, on top of the newest others
+	others := getReleasesKept(config) - 1
+	keys := []string{}
+	deleted := 0
+	for _, release := range releases {
+		if release.id == liveID {
+			continue
+		}
+		if others > 0 {
+			others--
+			continue
+		}
+		prefix := getReleasePrefix(release.id)
+		objects, err := getRemoteObjectsUnder(config.Region, bucket, prefix)
+		if err != nil {
+			return err
+		}
+		for key := range objects {
+			keys = append(keys, prefix+key)
+		}
+		deleted++
+	}
+	if deleted == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	logf("Deleting %v old releases\n", deleted)
+	return deleteObjects(config.Region, bucket, keys)
+}
+
+// Points the distribution back at an earlier release: the given one, or the
+// one before the live one.
+func runRollback(id string) error {
+	config, err := getConfig()
+	if err != nil {
+		return err
+	}
+	if !usesReleases(config) {
+		return newConfigError(nil, "rollback needs releases turned on in scarr.yml")
+	}
+	distributionID, err := getReleaseDistributionID(config)
+	if err != nil {
+		return err
+	}
+	liveID, err := getLiveRelease(distributionID)
+	if err != nil {
+		return err
+	}
+	releases, err := listReleases(config)
+	if err != nil {
+		return err
+	}
+
+	target := ""
+	for _, release := range releases {
+		if (id == "" && release.id < liveID) || (id != "" && release.id == id) {
+			target = release.id
+			break
+		}
+	}
+	if target == "" {
+		if id == "" {
+			return newConfigError(nil, "there's no release before the live one ("+liveID+") to roll back to")
+		}
+		return newConfigError(nil, "no release "+id+" in the bucket; see scarr releases")
+	}
+	if target == liveID {
+		logln("Release " + target + " is already live")
+		return nil
+	}
+
+	liveObjects, err := getReleaseObjects(config, liveID)
+	if err != nil {
+		return err
+	}
+	targetObjects, err := getReleaseObjects(config, target)
+	if err != nil {
+		return err
+	}
+	logln("Switching the distribution from release " + liveID + " to " + target)
+	if err = switchRelease(distributionID, target); err != nil {
+		return err
+	}
+	if _, err = invalidateCloudfront(getOriginDomains(config), getReleaseChanges(liveObjects, targetObjects), config.InvalidationThreshold); err != nil {
+		return err
+	}
+	logln("Rolled back to release " + target)
+	return nil
+}
+
+func runReleases() error {
+	config, err := getConfig()
+	if err != nil {
+		return err
+	}
+	if !usesReleases(config) {
+		return newConfigError(nil, "releases aren't turned on in scarr.yml")
+	}
+	distributionID, err := getReleaseDistributionID(config)
+	if err != nil {
+		return err
+	}
+	liveID, err := getLiveRelease(distributionID)
+	if err != nil {
+		return err
+	}
+	releases, err := listReleases(config)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		fmt.Println("No releases yet")
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "RELEASE\tCREATED\tFILES\t")
+	for _, release := range releases {
+		created := "unknown"
+		if !release.created.IsZero() {
+			created = release.created.Format("2006-01-02 15:04:05 UTC")
+		}
+		live := ""
+		if release.id == liveID {
+			live = "live"
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\t%v\n", release.id, created, release.files, live)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDeployReleases(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	defer func(original func() time.Time) { now = original }(now)
+	releaseTime := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return releaseTime }
+	files := copySite()
+	files["scarr.yml"] = testConfig + "origin: private\nreleases:\n  keep: 2\n"
+	defer useSite(t, files)()
+
+	liveRelease := func() string {
+		t.Helper()
+		for id := range fake.distributions {
+			live, err := getLiveRelease(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return live
+		}
+		return ""
+	}
+	lastInvalidation := func() string {
+		return strings.Join(fake.invalidations[len(fake.invalidations)-1], " ")
+	}
+
+	if err := runDeploy(false, true, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if live := liveRelease(); live != "20261018T120000Z" {
+		t.Errorf("expected the first release to be live, got %q", live)
+	}
+	keys := strings.Join(bucketKeys(fake, "example-bucket"), " ")
+	if keys != "releases/20261018T120000Z/about/index.html releases/20261018T120000Z/index.html releases/20261018T120000Z/style.css" {
+		t.Errorf("expected the site to be uploaded under the release, got %v", keys)
+	}
+
+	// Each release copies what didn't change from the live one, uploads the
+	// rest, and only invalidates what changed
+	releaseTime = releaseTime.Add(time.Hour)
+	files["style.css"] = "h1 { color: blue }"
+	defer useSite(t, files)()
+	uploads, copies := fake.callCount("s3.Upload"), fake.callCount("s3.CopyObject")
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded, copied := fake.callCount("s3.Upload")-uploads, fake.callCount("s3.CopyObject")-copies; uploaded != 1 || copied != 2 {
+		t.Errorf("expected style.css to be uploaded and the rest copied, got %v uploads and %v copies", uploaded, copied)
+	}
+	copied := fake.buckets["example-bucket"].objects["releases/20261018T130000Z/index.html"]
+	if string(copied.body) != files["index.html"] || aws.StringValue(copied.input.ContentType) != "text/html" {
+		t.Errorf("expected index.html to be copied with its content type, got %q as %v", copied.body, copied.input.ContentType)
+	}
+	if live := liveRelease(); live != "20261018T130000Z" {
+		t.Errorf("expected the second release to be live, got %q", live)
+	}
+	if paths := lastInvalidation(); paths != "/style.css" {
+		t.Errorf("expected only /style.css to be invalidated, got %v", paths)
+	}
+
+	// Only the newest two releases are kept
+	releaseTime = releaseTime.Add(time.Hour)
+	files["index.html"] = "<h1>new home</h1>"
+	defer useSite(t, files)()
+	if err := runDeploy(true, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	releases, err := listReleases(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 2 || releases[0].id != "20261018T140000Z" || releases[1].id != "20261018T130000Z" || releases[1].files != 3 {
+		t.Errorf("expected the two newest releases, got %v", releases)
+	}
+
+	// Rolling back goes to the previous release and invalidates what differs
+	if err := runRollback(""); err != nil {
+		t.Fatal(err)
+	}
+	if live := liveRelease(); live != "20261018T130000Z" {
+		t.Errorf("expected the rollback to make the second release live, got %q", live)
+	}
+	if paths := lastInvalidation(); !strings.Contains(paths, "/index.html") || strings.Contains(paths, "/style.css") {
+		t.Errorf("expected index.html but not style.css to be invalidated, got %v", paths)
+	}
+	if err := runRollback("20261018T120000Z"); err == nil || !strings.Contains(err.Error(), "no release 20261018T120000Z") {
+		t.Errorf("expected an error rolling back to a deleted release, got %v", err)
+	}
+
+	// A drift check on the next full deploy leaves the rollback alone
+	releaseTime = releaseTime.Add(time.Hour)
+	if err := runDeploy(false, false, false, false, false, false, 4); err != nil {
+		t.Fatal(err)
+	}
+	if live := liveRelease(); live != "20261018T150000Z" {
+		t.Errorf("expected the new release to be live, got %q", live)
+	}
+}
+
+func TestValidateReleasesConfig(t *testing.T) {
+	config := configType{Releases: releasesConfigType{Enabled: true}}
+	if err := validateReleasesConfig(config); err == nil || !strings.Contains(err.Error(), "origin: private") {
+		t.Errorf("expected releases to need a private origin, got %v", err)
+	}
+	config.Origin = "private"
+	if err := validateReleasesConfig(config); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
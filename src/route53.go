@@ -1,31 +1,15 @@
 package main
 
 import (
-	"fmt"
+	"errors"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/aws/aws-sdk-go/service/route53domains"
-	"os"
 	"strings"
 	"time"
 )
 
-func route53DomainsService() *route53domains.Route53Domains {
-	// Route53 only has the one domain, so hardcode to us east
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String("us-east-1")}))
-	return route53domains.New(sess)
-}
-func route53Service() *route53.Route53 {
-	// Route53 only has the one domain, so hardcode to us east
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String("us-east-1")}))
-	return route53.New(sess)
-}
-
-func registerDomain(domain string, contactDetails contactDetailsType) {
+func registerDomain(domain string, contactDetails contactDetailsType) error {
 	logf("Registering %v...", domain)
 	contact := route53domains.ContactDetail{
 		AddressLine1: &contactDetails.Address1,
@@ -52,7 +36,9 @@ func registerDomain(domain string, contactDetails contactDetailsType) {
 	}
 	route53DomainsService := route53DomainsService()
 	result, err := route53DomainsService.RegisterDomain(&input)
-	dieOnError(err, "Failed to register domain")
+	if err != nil {
+		return wrapAWSError(err, "register domain "+domain)
+	}
 
 	operationInput := route53domains.GetOperationDetailInput{
 		OperationId: result.OperationId,
@@ -61,20 +47,22 @@ func registerDomain(domain string, contactDetails contactDetailsType) {
 	// Wait up to 60 minutes for registration
 	for i := 0; i < 60; i++ {
 		operationResult, err := route53DomainsService.GetOperationDetail(&operationInput)
-		dieOnError(err, "Failed to get registration operation (but probably still registered the domain)")
+		if err != nil {
+			return wrapAWSError(err, "get registration operation (but probably still registered the domain)")
+		}
 		if *operationResult.Status == "SUCCESSFUL" {
 			logln(" done")
-			return
+			return nil
 		} else if *operationResult.Status == "FAILED" {
-			logln("Domain registration failed")
-			os.Exit(1)
+			return errors.New("domain registration failed")
 		}
-		time.Sleep(60 * time.Second)
+		sleep(60 * time.Second)
 	}
 	logln("\nTimed out waiting for registration to finish.  It may yet succeed - check your aws console.")
+	return nil
 }
 
-func getDomainDetails(domain string) *route53domains.GetDomainDetailOutput {
+func getDomainDetails(domain string) (*route53domains.GetDomainDetailOutput, error) {
 	route53DomainsService := route53DomainsService()
 
 	// So, apparently the only way to determine if a domain exists in our route53
@@ -85,78 +73,153 @@ func getDomainDetails(domain string) *route53domains.GetDomainDetailOutput {
 	result, err := route53DomainsService.GetDomainDetail(&input)
 	if err != nil {
 		if strings.Contains(err.Error(), "Domain "+domain+" not found in") {
-			return nil
+			return nil, nil
 		}
-		dieOnError(err, "error loading domain: ")
+		return nil, wrapAWSError(err, "load domain "+domain)
 	}
 
 	// TODO: handle domain-found result
 	//fmt.Println("get domain details result = ", result)
-	return result
+	return result, nil
 }
 
-func getDomainAvailability(domain string) bool {
+func getDomainAvailability(domain string) (bool, error) {
 	return getDomainAvailabilityWithRetries(domain, 3)
 }
 
-func getDomainAvailabilityWithRetries(domain string, retries int) bool {
+func getDomainAvailabilityWithRetries(domain string, retries int) (bool, error) {
 
 	route53DomainsService := route53DomainsService()
 	input := route53domains.CheckDomainAvailabilityInput{DomainName: &domain}
 	availabilityResult, err := route53DomainsService.CheckDomainAvailability(&input)
-	dieOnError(err, "error getting domain availability")
+	if err != nil {
+		return false, wrapAWSError(err, "get domain availability")
+	}
 	if *availabilityResult.Availability == "AVAILABLE" {
-		return true
+		return true, nil
 	}
 	if *availabilityResult.Availability == "PENDING" {
 		if retries > 0 {
-			time.Sleep(time.Second)
+			sleep(time.Second)
 			return getDomainAvailabilityWithRetries(domain, retries-1)
 		}
 	}
-	return false
+	return false, nil
 }
 
-func dnsRecordExists(hostedZoneID string, domain string, recordType string) bool {
+// Returns the record set with the given name and type, or nil if there isn't
+// one.  The name may or may not have route53's trailing dot.
+func getDNSRecord(hostedZoneID string, name string, recordType string) (*route53.ResourceRecordSet, error) {
 	service := route53Service()
-	result, err := service.ListResourceRecordSets(&route53.ListResourceRecordSetsInput{
-		HostedZoneId: &hostedZoneID,
-	})
-	dieOnError(err, "Failed listing resource record sets")
+	name = strings.TrimSuffix(name, ".") + "."
 
-	for _, recordSet := range result.ResourceRecordSets {
-		if *recordSet.Name == domain+"." && *recordSet.Type == recordType {
-			return true
+	// Starting the listing at the record we want means it's normally on the
+	// first page, but keep going in case it isn't.
+	var found *route53.ResourceRecordSet
+	err := service.ListResourceRecordSetsPages(&route53.ListResourceRecordSetsInput{
+		HostedZoneId:    &hostedZoneID,
+		StartRecordName: &name,
+		StartRecordType: &recordType,
+	}, func(page *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+		for _, recordSet := range page.ResourceRecordSets {
+			if *recordSet.Name == name && *recordSet.Type == recordType {
+				found = recordSet
+				return false
+			}
 		}
+		return true
+	})
+	if err != nil {
+		return nil, wrapAWSError(err, "list resource record sets")
 	}
-	return false
+	return found, nil
 }
 
-func getHostedZone(domain string) string {
+func dnsRecordExists(hostedZoneID string, domain string, recordType string) (bool, error) {
+	recordSet, err := getDNSRecord(hostedZoneID, domain, recordType)
+	return recordSet != nil, err
+}
+
+// Returns the ID of the public hosted zone the given domain's records belong
+// in, or "" if there isn't one.  That's the zone with the longest name that
+// the domain is in, so a delegated subdomain zone (eg dev.example.com) wins
+// over the root domain's zone.
+func findHostedZone(domain string) (string, error) {
 	rootDomain := getRootDomain(domain)
+	domain = strings.TrimSuffix(domain, ".") + "."
 	service := route53Service()
 
 	hostedZoneID := ""
+	longestMatch := ""
 
-	hostedZonesList, err := service.ListHostedZones(&route53.ListHostedZonesInput{})
-	dieOnError(err, "Failed to list hosted zones")
-
-	for _, hostedZone := range hostedZonesList.HostedZones {
-		if *hostedZone.Name == rootDomain+"." {
-			hostedZoneID = *hostedZone.Id
+	err := service.ListHostedZonesPages(&route53.ListHostedZonesInput{}, func(page *route53.ListHostedZonesOutput, lastPage bool) bool {
+		for _, hostedZone := range page.HostedZones {
+			if hostedZone.Config != nil && aws.BoolValue(hostedZone.Config.PrivateZone) {
+				continue
+			}
+			name := *hostedZone.Name
+			inZone := domain == name || strings.HasSuffix(domain, "."+name)
+			// Zones above the root domain (eg for a whole TLD) don't count
+			if inZone && len(name) >= len(rootDomain)+1 && len(name) > len(longestMatch) {
+				hostedZoneID = *hostedZone.Id
+				longestMatch = name
+			}
 		}
+		return true
+	})
+	if err != nil {
+		return "", wrapAWSError(err, "list hosted zones")
 	}
+	return hostedZoneID, nil
+}
 
+func getHostedZone(domain string) (string, error) {
+	hostedZoneID, err := findHostedZone(domain)
+	if err != nil {
+		return "", err
+	}
 	if hostedZoneID == "" {
-		// TODO: we can probably just create the hosted zone in this case
-		logln("Couldn't find hosted zone for domain")
-		os.Exit(1)
+		return "", errors.New("couldn't find hosted zone for domain " + getRootDomain(domain))
 	}
-	return hostedZoneID
+	return hostedZoneID, nil
 }
 
-func createAliasRecord(hostedZoneDomain string, recordName string, cloudfrontDomain string) {
-	createDNSRecord(hostedZoneDomain, recordName, "A", nil, &route53.AliasTarget{
+// Creates a public hosted zone for the domain.  Returns the new zone's ID and
+// the name servers route53 assigned it.
+func createHostedZone(domain string) (string, []string, error) {
+	service := route53Service()
+	callerReference := time.Now().Format(time.RFC3339Nano)
+	result, err := service.CreateHostedZone(&route53.CreateHostedZoneInput{
+		Name:            &domain,
+		CallerReference: &callerReference,
+		HostedZoneConfig: &route53.HostedZoneConfig{
+			Comment:     aws.String("Created by scarr.io"),
+			PrivateZone: aws.Bool(false),
+		},
+	})
+	if err != nil {
+		return "", nil, wrapAWSError(err, "create hosted zone for "+domain)
+	}
+	return *result.HostedZone.Id, aws.StringValueSlice(result.DelegationSet.NameServers), nil
+}
+
+// Points a domain registered in our route53 at the given name servers.  This
+// kicks off an async operation at the registry; we don't wait for it.
+func updateDomainNameservers(domain string, nameServers []string) error {
+	service := route53DomainsService()
+	input := route53domains.UpdateDomainNameserversInput{DomainName: &domain}
+	for _, nameServer := range nameServers {
+		input.Nameservers = append(input.Nameservers, &route53domains.Nameserver{Name: aws.String(nameServer)})
+	}
+	_, err := service.UpdateDomainNameservers(&input)
+	return wrapAWSError(err, "update name servers for "+domain)
+}
+
+// Each site domain gets an alias of each type: A for IPv4 and AAAA for IPv6.
+var aliasRecordTypes = []string{"A", "AAAA"}
+
+func createAliasRecord(hostedZoneDomain string, recordName string, recordType string, cloudfrontDomain string) error {
+	return createDNSRecord(hostedZoneDomain, recordName, recordType, nil, &route53.AliasTarget{
 		DNSName:              &cloudfrontDomain,
 		EvaluateTargetHealth: aws.Bool(false),
 		HostedZoneId:         aws.String("Z2FDTNDATAQYW2"),
@@ -164,11 +227,14 @@ func createAliasRecord(hostedZoneDomain string, recordName string, cloudfrontDom
 	// ^ Hardcoded zone ID as specified in aws docs
 }
 
-func createDNSRecord(domain string, recordName string, recordType string, recordValue *string, aliasTarget *route53.AliasTarget) {
+func createDNSRecord(domain string, recordName string, recordType string, recordValue *string, aliasTarget *route53.AliasTarget) error {
 	// fmt.Println("Creating record of type", recordType, recordName, recordValue)
 	service := route53Service()
 
-	hostedZoneID := getHostedZone(domain)
+	hostedZoneID, err := getHostedZone(domain)
+	if err != nil {
+		return err
+	}
 
 	input := route53.ChangeResourceRecordSetsInput{
 		HostedZoneId: &hostedZoneID,
@@ -202,12 +268,25 @@ func createDNSRecord(domain string, recordName string, recordType string, record
 		input.ChangeBatch.Changes[0].ResourceRecordSet.TTL = aws.Int64(300)
 	}
 
-	_, err := service.ChangeResourceRecordSets(&input)
-	if err != nil {
-		awserror := err.(awserr.Error)
-
-		fmt.Println("code=", awserror.Code())
-	}
+	_, err = service.ChangeResourceRecordSets(&input)
+	return wrapAWSError(err, "create "+recordType+" record "+recordName)
+}
 
-	dieOnError(err, "Failed to create dns record")
+// Deletes a record set.  Route53 requires the deleted record to match the
+// existing one exactly, so this takes the record set as returned by getDNSRecord.
+func deleteDNSRecord(hostedZoneID string, recordSet *route53.ResourceRecordSet) error {
+	service := route53Service()
+	_, err := service.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: &hostedZoneID,
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("Deleted by scarr.io"),
+			Changes: []*route53.Change{
+				{
+					Action:            aws.String("DELETE"),
+					ResourceRecordSet: recordSet,
+				},
+			},
+		},
+	})
+	return wrapAWSError(err, "delete "+*recordSet.Type+" record "+*recordSet.Name)
 }
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestGetRootDomain(t *testing.T) {
+	cases := map[string]string{
+		"example.com":            "example.com",
+		"www.example.com":        "example.com",
+		"a.b.example.com":        "example.com",
+		"example.co.uk":          "example.co.uk",
+		"shop.example.co.uk":     "example.co.uk",
+		"shop.example.com.au":    "example.com.au",
+		"blog.example.github.io": "example.github.io",
+		"example.com.":           "example.com",
+	}
+	for domain, expected := range cases {
+		if actual := getRootDomain(domain); actual != expected {
+			t.Errorf("expected root domain of %v to be %v, got %v", domain, expected, actual)
+		}
+	}
+}
+
+func TestValidateConfigRejectsPublicSuffix(t *testing.T) {
+	config := configType{Domain: "co.uk", Name: "example", Region: "us-west-2"}
+	if err := validateConfig(config); exitCodeFor(err) != exitCodeConfig {
+		t.Errorf("expected co.uk to be rejected as a config error, got %v", err)
+	}
+}
+
+func TestFindHostedZoneUsesLongestMatch(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+
+	fake.addZone("com")
+	root := fake.addZone("example.com")
+	dev := fake.addZone("dev.example.com")
+	private := fake.addZone("app.dev.example.com")
+	private.private = true
+	fake.addZone("otherdev.example.com")
+
+	cases := map[string]string{
+		"example.com":           root.id,
+		"www.example.com":       root.id,
+		"dev.example.com":       dev.id,
+		"app.dev.example.com":   dev.id,
+		"x.app.dev.example.com": dev.id,
+		"www.otherexample.com":  "",
+		"notdev.example.com":    root.id,
+	}
+	for domain, expected := range cases {
+		actual, err := findHostedZone(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != expected {
+			t.Errorf("expected %v to be in zone %q, got %q", domain, expected, actual)
+		}
+	}
+}
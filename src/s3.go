@@ -1,86 +1,122 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-func s3Service(region string) *s3.S3 {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region)}))
-	return s3.New(sess)
-}
-func s3ManagerService(region string) *s3manager.Uploader {
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region)}))
-	return s3manager.NewUploader(sess)
-}
-
-func bucketExists(bucketName string, region string) bool {
+func bucketExists(bucketName string, region string) (bool, error) {
 	service := s3Service(region)
 	_, err := service.HeadBucket(&s3.HeadBucketInput{Bucket: &bucketName})
 
 	if err != nil {
-		awsError := err.(awserr.Error)
-		if awsError.Code() == "NotFound" {
-			return false
+		if awsErrorCode(err) == "NotFound" {
+			return false, nil
 		}
-		dieOnError(err, "Error HEADing bucket")
+		return false, wrapAWSError(err, "HEAD bucket "+bucketName)
 	}
-	return true
+	return true, nil
 }
 
-func bucketIsWorldReadable(bucketName string, region string) bool {
+func bucketIsWorldReadable(bucketName string, region string) (bool, error) {
 	service := s3Service(region)
 	aclResult, err := service.GetBucketAcl(&s3.GetBucketAclInput{
 		Bucket: &bucketName,
 	})
-	dieOnError(err, "Error getting bucket ACL")
+	if err != nil {
+		return false, wrapAWSError(err, "get bucket ACL")
+	}
 
 	// Make sure this bucket is publicly readable
 	for _, grant := range aclResult.Grants {
 		if *grant.Grantee.Type == "Group" &&
 			*grant.Grantee.URI == "http://acs.amazonaws.com/groups/global/AllUsers" &&
 			*grant.Permission == "READ" {
-			return true
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
-func ensureBucketIsWebsite(bucketName string, region string) {
+// Returns the bucket's website config, or nil if it isn't a website.
+func getBucketWebsite(bucketName string, region string) (*s3.GetBucketWebsiteOutput, error) {
 	service := s3Service(region)
-	_, err := service.GetBucketWebsite(&s3.GetBucketWebsiteInput{Bucket: &bucketName})
+	result, err := service.GetBucketWebsite(&s3.GetBucketWebsiteInput{Bucket: &bucketName})
 	if err != nil {
-		awsError := err.(awserr.Error)
-		if awsError.Code() == "NoSuchWebsiteConfiguration" {
-			log("Making S3 bucket website...")
-			indexFile := "index.html"
-			_, err = service.PutBucketWebsite(&s3.PutBucketWebsiteInput{
-				Bucket: &bucketName,
-				WebsiteConfiguration: &s3.WebsiteConfiguration{
-					IndexDocument: &s3.IndexDocument{Suffix: &indexFile},
-				},
-			})
-			dieOnError(err, "Failed to update s3 bucket website config")
-			logln(" done")
-		} else {
-			dieOnError(err, "Failed to get bucket website config")
+		if awsErrorCode(err) == "NoSuchWebsiteConfiguration" {
+			return nil, nil
+		}
+		return nil, wrapAWSError(err, "get bucket website config")
+	}
+	return result, nil
+}
+
+// The website config scarr wants on the bucket.
+func buildWebsiteConfiguration(config configType) *s3.WebsiteConfiguration {
+	website := &s3.WebsiteConfiguration{
+		IndexDocument: &s3.IndexDocument{Suffix: aws.String("index.html")},
+	}
+	if errorDocument := getErrorDocument(config); errorDocument != "" {
+		website.ErrorDocument = &s3.ErrorDocument{Key: aws.String(errorDocument)}
+	}
+	if routingRules := buildRoutingRules(config); len(routingRules) > 0 {
+		website.RoutingRules = routingRules
+	}
+	return website
+}
+
+// Whether the bucket's website config is the one scarr wants.  Without an
+// error document in scarr.yml, any error document goes; routing rules always
+// have to match, so that removing a redirect removes it from the bucket.
+func websiteMatches(current *s3.GetBucketWebsiteOutput, desired *s3.WebsiteConfiguration) bool {
+	if desired.ErrorDocument != nil {
+		if current.ErrorDocument == nil || aws.StringValue(current.ErrorDocument.Key) != *desired.ErrorDocument.Key {
+			return false
 		}
-	} else {
+	}
+	return describeRoutingRules(current.RoutingRules) == describeRoutingRules(desired.RoutingRules)
+}
+
+func ensureBucketIsWebsite(bucketName string, region string, desired *s3.WebsiteConfiguration) error {
+	website, err := getBucketWebsite(bucketName, region)
+	if err != nil {
+		return err
+	}
+	if website != nil && websiteMatches(website, desired) {
 		logln("Bucket correctly configured for website")
+		return nil
+	}
+
+	service := s3Service(region)
+	log("Making S3 bucket website...")
+	_, err = service.PutBucketWebsite(&s3.PutBucketWebsiteInput{
+		Bucket:               &bucketName,
+		WebsiteConfiguration: desired,
+	})
+	if err != nil {
+		return wrapAWSError(err, "update s3 bucket website config")
 	}
+	logln(" done")
+	return nil
 }
 
-func createBucket(bucketName string, region string) {
+func createBucket(bucketName string, region string) error {
 	service := s3Service(region)
 
 	input := s3.CreateBucketInput{
@@ -96,74 +132,553 @@ func createBucket(bucketName string, region string) {
 	}
 
 	_, err := service.CreateBucket(&input)
-	dieOnError(err, "Failed to create bucket")
+	return wrapAWSError(err, "create bucket "+bucketName)
 }
 
-func s3Sync(region string, bucket string, configuredExclude *[]string) []string {
-	service := s3ManagerService(region)
+func emptyBucket(bucketName string, region string) error {
+	remoteObjects, err := getRemoteObjects(region, bucketName)
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for key := range remoteObjects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return deleteObjects(region, bucketName, keys)
+}
 
-	fileList := []string{}
+func deleteBucket(bucketName string, region string) error {
+	service := s3Service(region)
+	_, err := service.DeleteBucket(&s3.DeleteBucketInput{Bucket: &bucketName})
+	return wrapAWSError(err, "delete bucket "+bucketName)
+}
+
+// A file in the current directory that belongs in the bucket.
+type localFile struct {
+	path string
+	key  string
+	size int64
+	// The ETag s3 will report for this file once it's uploaded.
+	etag    string
+	headers objectHeaders
+	// "gzip" if the file gets compressed before upload
+	contentEncoding string
+	// The compressed body, kept from hashing it so it only gets compressed
+	// once per deploy
+	compressed []byte
+}
+
+// The bits of an existing s3 object we need to decide whether to re-upload it.
+type remoteObject struct {
+	etag     string
+	size     int64
+	modified time.Time
+	// What loadRemoteHeaders found out about the object's headers: either the
+	// headers themselves (via HeadObject), or the hash the last deploy's
+	// manifest recorded for them.
+	headers     *objectHeaders
+	headersHash string
+}
+
+// How many files to upload or HEAD at once unless told otherwise.
+const defaultConcurrency = 16
+
+// Calls work with each of 0 through count-1, up to concurrency at once.
+func runConcurrently(count int, concurrency int, work func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	queue := make(chan int)
+	var workers sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range queue {
+				work(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		queue <- i
+	}
+	close(queue)
+	workers.Wait()
+}
+
+func isExcluded(path string, configuredExclude *[]string) bool {
+	for _, exclude := range *configuredExclude {
+		// Already checked for invalid regexes in validateConfig
+		matched, _ := regexp.MatchString(exclude, path)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the key is one of scarr's own files rather than part of the site:
+// anything under .scarr/ in the bucket (see history.go), or the _redirects
+// file, which is config and shouldn't be served.  These are never synced or
+// pruned.
+func isScarrFile(key string) bool {
+	return isScarrKey(key) || key == redirectsFileName
+}
+
+func getLocalFiles(config configType) ([]localFile, error) {
+	files := []localFile{}
 	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return nil
 		}
 
-		for _, exclude := range *configuredExclude {
-			matched, err := regexp.MatchString(exclude, path)
-			dieOnError(err, "Invalid exclude regex")
-			if matched {
-				return nil
+		key := filepath.ToSlash(path)
+		if isExcluded(path, &config.Exclude) || isScarrFile(key) {
+			return nil
+		}
+
+		file := localFile{
+			path:    path,
+			key:     key,
+			size:    info.Size(),
+			headers: getObjectHeaders(key, config.Headers),
+		}
+
+		// Compressed files get compared by their compressed contents, since
+		// that's what ends up in the bucket.
+		if len(config.Compress.Extensions) > 0 && shouldCompress(path, info.Size(), config.Compress) {
+			file.contentEncoding = compressionEncoding
+			body, err := compressFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to compress %v: %w", path, err)
+			}
+			file.compressed = body
+			file.size = int64(len(body))
+			file.etag, err = readerETag(bytes.NewReader(body), file.size)
+			if err != nil {
+				return err
+			}
+		} else {
+			source, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			file.etag, err = readerETag(source, file.size)
+			source.Close()
+			if err != nil {
+				return fmt.Errorf("failed to hash %v: %w", path, err)
 			}
 		}
 
-		fileList = append(fileList, path)
+		files = append(files, file)
 		return nil
 	})
 	if err != nil {
-		logf("walk error [%v]\n", err)
-	}
-
-	// TODO: detect differences and actually sync, rather than just overwriting everything
-	for _, filename := range fileList {
-		file, fileErr := os.Open(filename)
-		dieOnError(fileErr, "Failed to open file")
-
-		ext := filepath.Ext(filename)
-
-		contentType := ""
-
-		// Detect content type from the extension
-		switch ext {
-		case ".htm", ".html":
-			contentType = "text/html"
-		case ".css":
-			contentType = "text/css"
-		case ".js":
-			contentType = "application/javascript"
-		default:
-			contentType = mime.TypeByExtension(ext)
-		}
-
-		// If we can't figure out content type from the extension, try DetectContentType
-		if contentType == "" {
-			// Grab the first 512 bytes to detect the content type
-			buffer := make([]byte, 512)
-			_, err = file.Read(buffer)
-			dieOnError(err, "Failed reading start of file to detect content type for "+filename)
-			// Reset the read pointer if necessary.
-			file.Seek(0, 0)
-			contentType = http.DetectContentType(buffer)
-		}
-
-		logln("Uploading ", filename, " to ", bucket)
-		_, uploadErr := service.Upload(&s3manager.UploadInput{
-			Bucket:      aws.String(bucket),
-			Key:         aws.String(filename),
-			Body:        file,
-			GrantRead:   aws.String("uri=http://acs.amazonaws.com/groups/global/AllUsers"),
-			ContentType: &contentType,
+		return nil, err
+	}
+	return files, nil
+}
+
+// Calculates the ETag s3 will assign this content when s3manager uploads it.
+// For single-part uploads that's just the hex md5 of the content.  For
+// multipart uploads it's the md5 of all the part md5s concatenated, plus
+// "-<part count>".
+func readerETag(file io.Reader, size int64) (string, error) {
+	// Mirror the part size s3manager picks for us
+	partSize := int64(s3manager.DefaultUploadPartSize)
+	if size/partSize >= int64(s3manager.MaxUploadParts) {
+		partSize = (size / int64(s3manager.MaxUploadParts)) + 1
+	}
+
+	if size <= partSize {
+		hash := md5.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	partHashes := md5.New()
+	parts := 0
+	for {
+		hash := md5.New()
+		written, err := io.CopyN(hash, file, partSize)
+		if written > 0 {
+			partHashes.Write(hash.Sum(nil))
+			parts++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%v-%v", hex.EncodeToString(partHashes.Sum(nil)), parts), nil
+}
+
+func getRemoteObjects(region string, bucket string) (map[string]remoteObject, error) {
+	return getRemoteObjectsUnder(region, bucket, "")
+}
+
+// Lists the objects whose keys start with prefix, keyed by the rest of the key.
+func getRemoteObjectsUnder(region string, bucket string, prefix string) (map[string]remoteObject, error) {
+	service := s3Service(region)
+	objects := map[string]remoteObject{}
+	err := service.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects[strings.TrimPrefix(*object.Key, prefix)] = remoteObject{
+				etag:     strings.Trim(*object.ETag, "\""),
+				size:     *object.Size,
+				modified: aws.TimeValue(object.LastModified),
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, wrapAWSError(err, "list bucket contents")
+	}
+	return objects, nil
+}
+
+func fileContentChanged(file localFile, remoteObjects map[string]remoteObject) bool {
+	remote, exists := remoteObjects[file.key]
+	return !exists || remote.size != file.size || remote.etag != file.etag
+}
+
+func fileNeedsUpload(file localFile, remoteObjects map[string]remoteObject) bool {
+	if fileContentChanged(file, remoteObjects) {
+		return true
+	}
+	remote := remoteObjects[file.key]
+	if remote.headers != nil {
+		return !objectHeadersEqual(*remote.headers, file.headers)
+	}
+	return remote.headersHash != "" && remote.headersHash != hashObjectHeaders(file.headers)
+}
+
+// ListObjects doesn't include headers, so work out the headers of every object
+// whose content hasn't changed, to see whether they have.  The last deploy's
+// manifest records the headers it left each file with, which still holds for
+// objects that haven't been modified since it was written; the rest (eg on the
+// first deploy, or after a failed one) get a HEAD.  This happens even with no
+// header rules, since objects uploaded under rules that have since been
+// removed still carry their headers.  remoteObjects has to be the bucket's
+// whole listing, manifests included.  Returns the first error hit, if any.
+func loadRemoteHeaders(config configType, bucket string, localFiles []localFile, remoteObjects map[string]remoteObject, concurrency int) error {
+	recorded := map[string]manifestFile{}
+	var written time.Time
+	if id := getLatestDeployID(remoteObjects); id != "" {
+		manifest, err := readDeployManifest(config, id)
+		if err != nil {
+			return err
+		}
+		// A release deploy's manifest describes the release, not the bucket
+		if manifest.Release == "" {
+			for _, file := range manifest.Files {
+				recorded[file.Key] = file
+			}
+			written = remoteObjects[getDeployManifestKey(id)].modified
+		}
+	}
+
+	keys := []string{}
+	for _, file := range localFiles {
+		if fileContentChanged(file, remoteObjects) {
+			continue
+		}
+		remote := remoteObjects[file.key]
+		entry, ok := recorded[file.key]
+		if ok && entry.Headers != "" && entry.ETag == remote.etag && remote.modified.Before(written) {
+			remote.headersHash = entry.Headers
+			remoteObjects[file.key] = remote
+		} else {
+			keys = append(keys, file.key)
+		}
+	}
+
+	service := s3Service(config.Region)
+	var mutex sync.Mutex
+	var firstErr error
+	runConcurrently(len(keys), concurrency, func(i int) {
+		key := keys[i]
+		result, err := service.HeadObject(&s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String(key),
+		})
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = wrapAWSError(err, "HEAD "+key)
+			}
+			return
+		}
+		headers := getRemoteObjectHeaders(result.CacheControl, result.ContentDisposition, result.ContentLanguage, result.Metadata)
+		remote := remoteObjects[key]
+		remote.headers = &headers
+		remoteObjects[key] = remote
+	})
+	return firstErr
+}
+
+// publicRead grants everyone read access to the object, which a website bucket
+// needs.
+func uploadFile(service s3UploaderAPI, bucket string, fileToUpload localFile, publicRead bool) error {
+	filename := fileToUpload.path
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ext := filepath.Ext(filename)
+
+	contentType := ""
+
+	// Detect content type from the extension
+	switch ext {
+	case ".htm", ".html":
+		contentType = "text/html"
+	case ".css":
+		contentType = "text/css"
+	case ".js":
+		contentType = "application/javascript"
+	default:
+		contentType = mime.TypeByExtension(ext)
+	}
+
+	// If we can't figure out content type from the extension, try DetectContentType
+	if contentType == "" {
+		// Grab the first 512 bytes to detect the content type
+		buffer := make([]byte, 512)
+		_, err = file.Read(buffer)
+		if err != nil {
+			return fmt.Errorf("failed reading start of file to detect content type: %w", err)
+		}
+		// Reset the read pointer if necessary.
+		file.Seek(0, 0)
+		contentType = http.DetectContentType(buffer)
+	}
+
+	input := s3manager.UploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(fileToUpload.key),
+		Body:        file,
+		ContentType: &contentType,
+	}
+	if publicRead {
+		input.GrantRead = aws.String("uri=http://acs.amazonaws.com/groups/global/AllUsers")
+	}
+	// The content type still comes from the original file above; only the body
+	// gets compressed.
+	if fileToUpload.contentEncoding != "" {
+		input.Body = bytes.NewReader(fileToUpload.compressed)
+		input.ContentEncoding = aws.String(fileToUpload.contentEncoding)
+	}
+	headers := fileToUpload.headers
+	if headers.cacheControl != "" {
+		input.CacheControl = aws.String(headers.cacheControl)
+	}
+	if headers.contentDisposition != "" {
+		input.ContentDisposition = aws.String(headers.contentDisposition)
+	}
+	if headers.contentLanguage != "" {
+		input.ContentLanguage = aws.String(headers.contentLanguage)
+	}
+	if len(headers.metadata) > 0 {
+		input.Metadata = aws.StringMap(headers.metadata)
+	}
+
+	logln("Uploading ", filename, " to ", bucket)
+	_, err = service.Upload(&input)
+	return wrapAWSError(err, "upload "+fileToUpload.key)
+}
+
+// A file that failed to upload, and why.
+type uploadFailure struct {
+	key string
+	err error
+}
+
+// Uploads files using up to concurrency uploads at once.  Keeps going when a
+// file fails, and returns the keys that made it along with the failures.
+func uploadFiles(service s3UploaderAPI, bucket string, files []localFile, publicRead bool, concurrency int) ([]string, []uploadFailure) {
+	var mutex sync.Mutex
+	uploaded := []string{}
+	failures := []uploadFailure{}
+	runConcurrently(len(files), concurrency, func(i int) {
+		file := files[i]
+		err := uploadFile(service, bucket, file, publicRead)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			failures = append(failures, uploadFailure{key: file.key, err: err})
+		} else {
+			uploaded = append(uploaded, file.key)
+		}
+	})
+
+	sort.Strings(uploaded)
+	sort.Slice(failures, func(i, j int) bool { return failures[i].key < failures[j].key })
+	return uploaded, failures
+}
+
+// A copy of one object in the bucket to another key.
+type objectCopy struct {
+	from string
+	to   string
+}
+
+// Copies objects within the bucket, headers and all, using up to concurrency
+// copies at once.  Like uploadFiles, keeps going when one fails, and returns
+// the keys copied to along with the failures.
+func copyObjects(service s3API, bucket string, copies []objectCopy, concurrency int) ([]string, []uploadFailure) {
+	var mutex sync.Mutex
+	copied := []string{}
+	failures := []uploadFailure{}
+	runConcurrently(len(copies), concurrency, func(i int) {
+		objectCopy := copies[i]
+		logln("Copying ", objectCopy.from, " to ", objectCopy.to)
+		_, err := service.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(objectCopy.to),
+			CopySource: aws.String(url.PathEscape(bucket + "/" + objectCopy.from)),
 		})
-		dieOnError(uploadErr, "Failed to upload file")
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			failures = append(failures, uploadFailure{key: objectCopy.to, err: wrapAWSError(err, "copy "+objectCopy.from)})
+		} else {
+			copied = append(copied, objectCopy.to)
+		}
+	})
+
+	sort.Strings(copied)
+	sort.Slice(failures, func(i, j int) bool { return failures[i].key < failures[j].key })
+	return copied, failures
+}
+
+// Deletes the given keys from the bucket, 1000 at a time (the most
+// DeleteObjects will take in one request).
+func deleteObjects(region string, bucket string, keys []string) error {
+	service := s3Service(region)
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objects := []*s3.ObjectIdentifier{}
+		for _, key := range keys[start:end] {
+			logln("Deleting ", key, " from ", bucket)
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		result, err := service.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: &bucket,
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return wrapAWSError(err, "delete objects")
+		}
+		if len(result.Errors) > 0 {
+			failed := result.Errors[0]
+			return fmt.Errorf("delete object %v: %v (%v)", *failed.Key, *failed.Message, *failed.Code)
+		}
+	}
+	return nil
+}
+
+// What a sync would do: the local files to upload or leave alone, and the
+// bucket keys to delete.
+type syncPlan struct {
+	upload []localFile
+	skip   []localFile
+	delete []string
+}
+
+// The keys a sync would upload or delete, ie the ones that need invalidating.
+func (plan syncPlan) changedKeys() []string {
+	keys := []string{}
+	for _, file := range plan.upload {
+		keys = append(keys, file.key)
+	}
+	return append(keys, plan.delete...)
+}
+
+// Works out which local files are new or changed and, if prune is set, which
+// non-excluded objects in the bucket no longer exist locally.
+func planSync(localFiles []localFile, remoteObjects map[string]remoteObject, configuredExclude *[]string, prune bool) syncPlan {
+	plan := syncPlan{upload: []localFile{}, skip: []localFile{}, delete: []string{}}
+	for _, file := range localFiles {
+		if fileNeedsUpload(file, remoteObjects) {
+			plan.upload = append(plan.upload, file)
+		} else {
+			plan.skip = append(plan.skip, file)
+		}
+	}
+	if prune {
+		plan.delete = getPrunableKeys(localFiles, remoteObjects, configuredExclude)
+	}
+	return plan
+}
+
+// Uploads any files that are new or have changed (content or headers) since
+// the last sync, up to concurrency at a time.  If prune is set, also deletes
+// any non-excluded objects in the bucket that no longer exist locally.
+// Returns the keys that were uploaded or deleted, plus any files that failed
+// to upload.  Failed uploads don't stop the sync; any other error does.
+func s3Sync(config configType, bucket string, localFiles []localFile, prune bool, concurrency int) ([]string, []uploadFailure, error) {
+	region := config.Region
+	service := s3ManagerService(region)
+
+	remoteObjects, err := getRemoteObjects(region, bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = loadRemoteHeaders(config, bucket, localFiles, remoteObjects, concurrency); err != nil {
+		return nil, nil, err
+	}
+	plan := planSync(localFiles, remoteObjects, &config.Exclude, prune)
+
+	changedFiles, failures := uploadFiles(service, bucket, plan.upload, !usesPrivateOrigin(config), concurrency)
+	logf("Uploaded %v of %v files (%v unchanged, %v failed)\n", len(changedFiles), len(localFiles), len(plan.skip), len(failures))
+	for _, failure := range failures {
+		fmt.Fprintf(os.Stderr, "  Failed to upload %v: %v\n", failure.key, failure.err)
+	}
+
+	if prune {
+		if err = deleteObjects(region, bucket, plan.delete); err != nil {
+			return changedFiles, failures, err
+		}
+		changedFiles = append(changedFiles, plan.delete...)
+		logf("Deleted %v files\n", len(plan.delete))
+	}
+	return changedFiles, failures, nil
+}
+
+// Finds the keys in the bucket that have no matching local file.  Remote keys
+// matching the exclude list, and scarr's own files, are left alone.
+func getPrunableKeys(localFiles []localFile, remoteObjects map[string]remoteObject, configuredExclude *[]string) []string {
+	localKeys := map[string]bool{}
+	for _, file := range localFiles {
+		localKeys[file.key] = true
+	}
+
+	keys := []string{}
+	for key := range remoteObjects {
+		if !localKeys[key] && !isExcluded(key, configuredExclude) && !isScarrFile(key) {
+			keys = append(keys, key)
+		}
 	}
-	return fileList
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestReaderETag(t *testing.T) {
+	partSize := int(s3manager.DefaultUploadPartSize)
+	// Expected ETags worked out independently of readerETag: the md5 of the
+	// content for single-part uploads, and the md5 of the parts' md5s for
+	// multipart ones
+	cases := []struct {
+		name     string
+		content  []byte
+		expected string
+	}{
+		{name: "empty", content: []byte{}, expected: "d41d8cd98f00b204e9800998ecf8427e"},
+		{name: "single part", content: []byte("hello world"), expected: "5eb63bbbe01eeed093cb22bb8f5acdc3"},
+		{name: "exactly one part", content: bytes.Repeat([]byte("a"), partSize), expected: "79b281060d337b9b2b84ccf390adcf74"},
+		{name: "one byte over a part", content: bytes.Repeat([]byte("a"), partSize+1), expected: "c8ce36bbc9c0db61b79d3b4478950f0f-2"},
+		{name: "exactly two parts", content: bytes.Repeat([]byte("a"), 2*partSize), expected: "daebcb5e72f14b690c18018c9f92af05-2"},
+		{name: "three parts", content: bytes.Repeat([]byte("a"), 2*partSize+3), expected: "ce5faa569e8aab02cb2941fe7378ecab-3"},
+	}
+	for _, c := range cases {
+		etag, err := readerETag(bytes.NewReader(c.content), int64(len(c.content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != c.expected {
+			t.Errorf("%v: expected ETag %v, got %v", c.name, c.expected, etag)
+		}
+	}
+}
+
+func TestUploadFilesKeepsGoingAfterFailures(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	fake.buckets["example-bucket"] = &fakeBucket{objects: map[string]fakeObject{}}
+	fake.failUploads["b.html"] = true
+	fake.failUploads["d.html"] = true
+	files := map[string]string{}
+	for _, name := range []string{"a.html", "b.html", "c.html", "d.html", "e.html"} {
+		files[name] = name
+	}
+	defer useSite(t, files)()
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	localFiles, err := getLocalFiles(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded, failures := uploadFiles(s3ManagerService(config.Region), "example-bucket", localFiles, false, 2)
+	if !reflect.DeepEqual(uploaded, []string{"a.html", "c.html", "e.html"}) {
+		t.Errorf("expected every other file to upload, got %v", uploaded)
+	}
+	failed := []string{}
+	for _, failure := range failures {
+		failed = append(failed, failure.key)
+		if failure.err == nil || !strings.Contains(failure.err.Error(), "InternalError") {
+			t.Errorf("expected %v's failure to say why, got %v", failure.key, failure.err)
+		}
+	}
+	if !reflect.DeepEqual(failed, []string{"b.html", "d.html"}) {
+		t.Errorf("expected both failures to be reported, got %v", failed)
+	}
+	if keys := bucketKeys(fake, "example-bucket"); !reflect.DeepEqual(keys, []string{"a.html", "c.html", "e.html"}) {
+		t.Errorf("expected the uploaded files in the bucket, got %v", keys)
+	}
+}
+
+func TestSyncDeletesInBatches(t *testing.T) {
+	fake := newFakeAWS()
+	defer fake.install()()
+	fake.buckets["example-bucket"] = &fakeBucket{objects: map[string]fakeObject{}}
+	for i := 0; i < 1500; i++ {
+		fake.putObject("example-bucket", fmt.Sprintf("old/%04d.html", i), []byte("old"), s3manager.UploadInput{})
+	}
+	defer useSite(t, copySite())()
+	config, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	localFiles, err := getLocalFiles(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, failures, err := s3Sync(config, "example-bucket", localFiles, true, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 0 || len(changed) != len(localFiles)+1500 {
+		t.Errorf("expected every file uploaded and every old one deleted, got %v changed and %v failures", len(changed), len(failures))
+	}
+	// DeleteObjects takes at most 1000 keys at a time
+	expectCalls(t, fake, map[string]int{"s3.DeleteObjects": 2})
+	if keys := bucketKeys(fake, "example-bucket"); !reflect.DeepEqual(keys, []string{"about/index.html", "index.html", "style.css"}) {
+		t.Errorf("expected only the site's files to be left, got %v", keys)
+	}
+}
@@ -9,15 +9,11 @@ import (
 	// "github.com/aws/aws-sdk-go/service/s3"
 )
 
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
-}
-
-func exitErrorf(msg string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, msg+"\n", args...)
-	os.Exit(1)
+// Prints the error and exits with a code based on what kind of error it was
+// (see exitCodeFor).  Only main should call this.
+func exitWithError(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(exitCodeFor(err))
 }
 
 func getUsage() string {
@@ -29,6 +25,12 @@ syncs files.
 Available commands:
 	init		# Generates a new scarr.yml file
 	deploy		# Sets up infrastructure + syncs files to it
+	plan		# Shows what deploy would do without changing anything
+	destroy		# Deletes everything deploy created (except the domain)
+	status		# Shows the state of every resource deploy manages
+	releases	# Lists the site's releases (with releases: true)
+	rollback	# Switches back to an earlier release (with releases: true)
+	history		# Lists past deploys, or diffs two of them
 	version		# Print version
 	
 Use "scarr <command> -h" for more information.
@@ -60,17 +62,44 @@ Either way, the IAM user you connect should have the following permissions:
 		"s3:GetBucketAcl",
 		"cloudfront:CreateInvalidation",
 		"route53domains:GetOperationDetail",
+		"route53domains:UpdateDomainNameservers",
 		"s3:PutObject",
 		"s3:GetObject",
+		"s3:DeleteObject",
+		"s3:DeleteBucket",
 		"route53domains:CheckDomainAvailability",
 		"s3:PutBucketWebsite",
 		"acm:DescribeCertificate",
 		"acm:RequestCertificate",
 		"route53domains:RegisterDomain",
 		"cloudfront:ListDistributions",
+		"cloudfront:GetDistribution",
+		"cloudfront:GetDistributionConfig",
+		"cloudfront:UpdateDistribution",
+		"cloudfront:DeleteDistribution",
+		"cloudfront:CreateFunction",
+		"cloudfront:DescribeFunction",
+		"cloudfront:GetFunction",
+		"cloudfront:UpdateFunction",
+		"cloudfront:PublishFunction",
+		"cloudfront:DeleteFunction",
+		"s3:GetBucketPublicAccessBlock",
+		"s3:PutBucketPublicAccessBlock",
+		"s3:GetBucketPolicy",
+		"s3:PutBucketPolicy",
+		"cloudfront:ListOriginAccessControls",
+		"cloudfront:CreateOriginAccessControl",
+		"cloudfront:GetOriginAccessControl",
+		"cloudfront:DeleteOriginAccessControl",
+		"cloudfront:ListResponseHeadersPolicies",
+		"cloudfront:CreateResponseHeadersPolicy",
+		"cloudfront:GetResponseHeadersPolicyConfig",
+		"cloudfront:UpdateResponseHeadersPolicy",
+		"cloudfront:DeleteResponseHeadersPolicy",
 		"route53:ListResourceRecordSets",
 		"s3:PutBucketAcl",
 		"acm:ListCertificates",
+		"acm:DeleteCertificate",
 		"s3:PutObjectAcl"
 	],
 	"Resource": "*"
@@ -106,6 +135,12 @@ func printVersion() {
 func main() {
 	initCommand := flag.NewFlagSet("init", flag.ExitOnError)
 	deployCommand := flag.NewFlagSet("deploy", flag.ExitOnError)
+	planCommand := flag.NewFlagSet("plan", flag.ExitOnError)
+	destroyCommand := flag.NewFlagSet("destroy", flag.ExitOnError)
+	statusCommand := flag.NewFlagSet("status", flag.ExitOnError)
+	releasesCommand := flag.NewFlagSet("releases", flag.ExitOnError)
+	rollbackCommand := flag.NewFlagSet("rollback", flag.ExitOnError)
+	historyCommand := flag.NewFlagSet("history", flag.ExitOnError)
 
 	domainPtr := initCommand.String("domain", "", "The domain this site will live at")
 	namePtr := initCommand.String("name", "", "The name of this project")
@@ -113,14 +148,47 @@ func main() {
 
 	skipSetupPtr := deployCommand.Bool("skip-setup", false, "Assume the infrastructure is all set up and just do the file upload + cache invalidations.")
 	autoRegisterPtr := deployCommand.Bool("auto-register", false, "Register the domain name without prompting if necessary and available")
-	silentDeployPtr := deployCommand.Bool("silent", false, "Limits stdout to errors and user-input prompts.  Run with -auto-register or use an existing domain name to avoid a registration prompt")
+	autoApproveDeployPtr := deployCommand.Bool("yes", false, "Update an existing cloudfront distribution that doesn't match scarr's config without prompting")
+	skipDomainPtr := deployCommand.Bool("skip-domain", false, "Don't check route53 for the domain's registration; assume it's registered elsewhere")
+	skipDNSPtr := deployCommand.Bool("skip-dns", false, "Don't use route53 for dns; print the records to create at your own DNS provider and wait for them")
+	deletePtr := deployCommand.Bool("delete", false, "Delete files from the bucket that no longer exist locally (same as prune: true in scarr.yml)")
+	silentDeployPtr := deployCommand.Bool("silent", false, "Limits stdout to errors and user-input prompts.  Run with -auto-register or use an existing domain name to avoid a registration prompt, and with -yes to avoid a distribution update prompt")
+	concurrencyPtr := deployCommand.Int("concurrency", defaultConcurrency, "How many files to upload at once")
+	dryRunPtr := deployCommand.Bool("dry-run", false, "Print what deploy would do (same as the plan command) without changing anything")
+	deployJSONPtr := deployCommand.Bool("json", false, "With -dry-run, print the plan as JSON")
+
+	planSkipSetupPtr := planCommand.Bool("skip-setup", false, "Only plan the file sync + cache invalidation")
+	planDeletePtr := planCommand.Bool("delete", false, "Plan deleting files from the bucket that no longer exist locally")
+	planJSONPtr := planCommand.Bool("json", false, "Print the plan as JSON")
+	planSkipDomainPtr := planCommand.Bool("skip-domain", false, "Plan as if the domain's registered outside route53")
+	planSkipDNSPtr := planCommand.Bool("skip-dns", false, "Plan as if the domain's DNS is hosted outside route53")
+
+	statusSkipDomainPtr := statusCommand.Bool("skip-domain", false, "Don't check the domain's route53 registration")
+	statusSkipDNSPtr := statusCommand.Bool("skip-dns", false, "Check public DNS instead of route53 for the domain's record")
+
+	silentRollbackPtr := rollbackCommand.Bool("silent", false, "Limits stdout to errors")
+	rollbackCommand.Usage = func() {
+		fmt.Fprintln(rollbackCommand.Output(), "Usage: scarr rollback [-silent] [release-id]")
+		fmt.Fprintln(rollbackCommand.Output(), "Switches to the given release, or without one, to the release before the live one.")
+		rollbackCommand.PrintDefaults()
+	}
+
+	historyCommand.Usage = func() {
+		fmt.Fprintln(historyCommand.Output(), "Usage: scarr history [deploy-id deploy-id]")
+		fmt.Fprintln(historyCommand.Output(), "Lists past deploys, or with two deploy ids, the files that changed between them.")
+		historyCommand.PrintDefaults()
+	}
+
+	autoApproveDestroyPtr := destroyCommand.Bool("yes", false, "Delete everything without prompting for confirmation")
+	silentDestroyPtr := destroyCommand.Bool("silent", false, "Limits stdout to errors, the list of resources being deleted, and the confirmation prompt")
 
 	if len(os.Args) < 2 {
 		fmt.Println("Missing command")
-		os.Exit(1)
+		os.Exit(exitCodeConfig)
 	}
 
 	command := os.Args[1]
+	var err error
 
 	switch command {
 	case "-h":
@@ -133,6 +201,18 @@ func main() {
 		initCommand.Parse(os.Args[2:])
 	case "deploy":
 		deployCommand.Parse(os.Args[2:])
+	case "plan":
+		planCommand.Parse(os.Args[2:])
+	case "destroy":
+		destroyCommand.Parse(os.Args[2:])
+	case "status":
+		statusCommand.Parse(os.Args[2:])
+	case "releases":
+		releasesCommand.Parse(os.Args[2:])
+	case "rollback":
+		rollbackCommand.Parse(os.Args[2:])
+	case "history":
+		historyCommand.Parse(os.Args[2:])
 	case "version":
 		printVersion()
 	case "-version":
@@ -144,17 +224,46 @@ func main() {
 	default:
 		fmt.Println("Unknown command ", command)
 		flag.PrintDefaults()
-		os.Exit(1)
+		os.Exit(exitCodeConfig)
 	}
 	logLevel = 1
 
 	if initCommand.Parsed() {
-		runInit(*domainPtr, *namePtr, *regionPtr)
+		err = runInit(*domainPtr, *namePtr, *regionPtr)
 		// fmt.Println("init parsed", *domainPtr, *namePtr, *regionPtr)
 	} else if deployCommand.Parsed() {
-		if *silentDeployPtr {
+		if *silentDeployPtr || *deployJSONPtr {
 			logLevel = 0
 		}
-		runDeploy(*skipSetupPtr, *autoRegisterPtr)
+		if *dryRunPtr {
+			err = runPlan(*skipSetupPtr, *skipDomainPtr, *skipDNSPtr, *deletePtr, *deployJSONPtr)
+		} else {
+			err = runDeploy(*skipSetupPtr, *autoRegisterPtr, *autoApproveDeployPtr, *skipDomainPtr, *skipDNSPtr, *deletePtr, *concurrencyPtr)
+		}
+	} else if planCommand.Parsed() {
+		if *planJSONPtr {
+			logLevel = 0
+		}
+		err = runPlan(*planSkipSetupPtr, *planSkipDomainPtr, *planSkipDNSPtr, *planDeletePtr, *planJSONPtr)
+	} else if destroyCommand.Parsed() {
+		if *silentDestroyPtr {
+			logLevel = 0
+		}
+		err = runDestroy(*autoApproveDestroyPtr)
+	} else if statusCommand.Parsed() {
+		err = runStatus(*statusSkipDomainPtr, *statusSkipDNSPtr)
+	} else if releasesCommand.Parsed() {
+		err = runReleases()
+	} else if rollbackCommand.Parsed() {
+		if *silentRollbackPtr {
+			logLevel = 0
+		}
+		err = runRollback(rollbackCommand.Arg(0))
+	} else if historyCommand.Parsed() {
+		err = runHistory(historyCommand.Args())
+	}
+
+	if err != nil {
+		exitWithError(err)
 	}
 }
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+)
+
+// scarr.yml's securityHeaders block, which becomes a cloudfront response
+// headers policy on the distribution.  It starts from a preset and then
+// applies whatever's set here on top.
+type securityHeadersConfigType struct {
+	// "default" (the default) starts from defaultSecurityHeaders; "none"
+	// starts from nothing
+	Preset string          `yaml:"preset"`
+	HSTS   *hstsConfigType `yaml:"hsts"`
+	// Left out of the preset, since a policy that fits one site breaks another
+	ContentSecurityPolicy string `yaml:"contentSecurityPolicy"`
+	// DENY, SAMEORIGIN, or none
+	FrameOptions string `yaml:"frameOptions"`
+	// Any Referrer-Policy value, or none
+	ReferrerPolicy string                   `yaml:"referrerPolicy"`
+	Custom         []customHeaderConfigType `yaml:"custom"`
+	CORS           *corsConfigType          `yaml:"cors"`
+}
+
+// Strict-Transport-Security.  A MaxAge of 0 leaves the header out.
+type hstsConfigType struct {
+	MaxAge            int64 `yaml:"maxAge"`
+	IncludeSubdomains bool  `yaml:"includeSubdomains"`
+	Preload           bool  `yaml:"preload"`
+}
+
+type customHeaderConfigType struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+	// Whether to replace the header if the origin sent one too.  Defaults to
+	// true.
+	Override *bool `yaml:"override"`
+}
+
+type corsConfigType struct {
+	AllowOrigins []string `yaml:"allowOrigins"`
+	// Defaults to GET, HEAD, and OPTIONS
+	AllowMethods []string `yaml:"allowMethods"`
+	// Defaults to *
+	AllowHeaders     []string `yaml:"allowHeaders"`
+	ExposeHeaders    []string `yaml:"exposeHeaders"`
+	AllowCredentials bool     `yaml:"allowCredentials"`
+	MaxAge           *int64   `yaml:"maxAge"`
+}
+
+// securityHeaders can also just be a preset name, eg "securityHeaders: default".
+func (config *securityHeadersConfigType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var preset string
+	if err := unmarshal(&preset); err == nil {
+		config.Preset = preset
+		return nil
+	}
+	type plain securityHeadersConfigType
+	return unmarshal((*plain)(config))
+}
+
+// What the default preset sends, on top of X-Content-Type-Options: nosniff.
+// HSTS leaves out includeSubdomains and preload, since those commit every
+// subdomain of the site's domain to https.
+var defaultSecurityHeaders = securityHeadersConfigType{
+	HSTS:           &hstsConfigType{MaxAge: 31536000},
+	FrameOptions:   "SAMEORIGIN",
+	ReferrerPolicy: "strict-origin-when-cross-origin",
+}
+
+var referrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+var corsMethods = map[string]bool{"GET": true, "HEAD": true, "OPTIONS": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "ALL": true}
+
+// Headers cloudfront only lets you set through the policy's security headers
+// or cors settings, not as custom headers.
+var reservedHeaders = []string{
+	"strict-transport-security", "content-security-policy", "x-frame-options",
+	"referrer-policy", "x-content-type-options", "x-xss-protection",
+	"access-control-allow-origin", "access-control-allow-methods", "access-control-allow-headers",
+	"access-control-allow-credentials", "access-control-expose-headers", "access-control-max-age",
+}
+
+func validateSecurityHeadersConfig(config *securityHeadersConfigType) error {
+	if config == nil {
+		return nil
+	}
+	switch config.Preset {
+	case "", "default", "none":
+	default:
+		return newConfigError(nil, "unknown securityHeaders preset "+config.Preset+" (expected default or none)")
+	}
+	if config.HSTS != nil && config.HSTS.MaxAge < 0 {
+		return newConfigError(nil, "securityHeaders hsts maxAge can't be negative")
+	}
+	switch config.FrameOptions {
+	case "", "DENY", "SAMEORIGIN", "none":
+	default:
+		return newConfigError(nil, "unknown securityHeaders frameOptions "+config.FrameOptions+" (expected DENY, SAMEORIGIN, or none)")
+	}
+	if config.ReferrerPolicy != "" && config.ReferrerPolicy != "none" && !referrerPolicies[config.ReferrerPolicy] {
+		return newConfigError(nil, "unknown securityHeaders referrerPolicy "+config.ReferrerPolicy)
+	}
+
+	seen := map[string]bool{}
+	for _, header := range config.Custom {
+		name := strings.ToLower(header.Name)
+		if name == "" || header.Value == "" {
+			return newConfigError(nil, "securityHeaders custom headers need a name and a value")
+		}
+		for _, reserved := range reservedHeaders {
+			if name == reserved {
+				return newConfigError(nil, header.Name+" can't be a custom header; use securityHeaders' own settings for it")
+			}
+		}
+		if seen[name] {
+			return newConfigError(nil, "securityHeaders custom header "+header.Name+" is listed more than once")
+		}
+		seen[name] = true
+	}
+
+	if cors := config.CORS; cors != nil {
+		if len(cors.AllowOrigins) == 0 {
+			return newConfigError(nil, "securityHeaders cors needs at least one allowOrigins entry")
+		}
+		for _, method := range cors.AllowMethods {
+			if !corsMethods[method] {
+				return newConfigError(nil, "unknown securityHeaders cors method "+method)
+			}
+		}
+		if cors.AllowCredentials {
+			for _, origin := range cors.AllowOrigins {
+				if origin == "*" {
+					return newConfigError(nil, "securityHeaders cors can't allow credentials from every origin (*)")
+				}
+			}
+		}
+		if cors.MaxAge != nil && *cors.MaxAge < 0 {
+			return newConfigError(nil, "securityHeaders cors maxAge can't be negative")
+		}
+	}
+
+	if buildResponseHeadersPolicyConfig("", config) == nil {
+		return newConfigError(nil, "securityHeaders with preset none has to set at least one header")
+	}
+	return nil
+}
+
+func usesCORS(config configType) bool {
+	return config.SecurityHeaders != nil && config.SecurityHeaders.CORS != nil
+}
+
+func getResponseHeadersPolicyName(config configType) string {
+	return config.Name + "-headers"
+}
+
+func stringList(items []string) (*int64, []*string) {
+	return aws.Int64(int64(len(items))), aws.StringSlice(items)
+}
+
+// Builds the response headers policy config for the block, or nil if it ends up
+// with no headers at all (which cloudfront won't accept).
+func buildResponseHeadersPolicyConfig(name string, config *securityHeadersConfigType) *cloudfront.ResponseHeadersPolicyConfig {
+	// Start from the preset, then let anything set in scarr.yml win
+	settings := securityHeadersConfigType{}
+	contentTypeOptions := config.Preset != "none"
+	if contentTypeOptions {
+		settings = defaultSecurityHeaders
+	}
+	if config.HSTS != nil {
+		settings.HSTS = config.HSTS
+	}
+	if config.ContentSecurityPolicy != "" {
+		settings.ContentSecurityPolicy = config.ContentSecurityPolicy
+	}
+	if config.FrameOptions != "" {
+		settings.FrameOptions = config.FrameOptions
+	}
+	if config.ReferrerPolicy != "" {
+		settings.ReferrerPolicy = config.ReferrerPolicy
+	}
+
+	policy := &cloudfront.ResponseHeadersPolicyConfig{
+		Name:    &name,
+		Comment: aws.String("Created by scarr.io"),
+	}
+	security := &cloudfront.ResponseHeadersPolicySecurityHeadersConfig{}
+	hasSecurityHeaders := false
+	if contentTypeOptions {
+		security.ContentTypeOptions = &cloudfront.ResponseHeadersPolicyContentTypeOptions{Override: aws.Bool(true)}
+		hasSecurityHeaders = true
+	}
+	if settings.HSTS != nil && settings.HSTS.MaxAge > 0 {
+		security.StrictTransportSecurity = &cloudfront.ResponseHeadersPolicyStrictTransportSecurity{
+			AccessControlMaxAgeSec: aws.Int64(settings.HSTS.MaxAge),
+			IncludeSubdomains:      aws.Bool(settings.HSTS.IncludeSubdomains),
+			Preload:                aws.Bool(settings.HSTS.Preload),
+			Override:               aws.Bool(true),
+		}
+		hasSecurityHeaders = true
+	}
+	if settings.ContentSecurityPolicy != "" {
+		security.ContentSecurityPolicy = &cloudfront.ResponseHeadersPolicyContentSecurityPolicy{
+			ContentSecurityPolicy: aws.String(settings.ContentSecurityPolicy),
+			Override:              aws.Bool(true),
+		}
+		hasSecurityHeaders = true
+	}
+	if settings.FrameOptions != "" && settings.FrameOptions != "none" {
+		security.FrameOptions = &cloudfront.ResponseHeadersPolicyFrameOptions{
+			FrameOption: aws.String(settings.FrameOptions),
+			Override:    aws.Bool(true),
+		}
+		hasSecurityHeaders = true
+	}
+	if settings.ReferrerPolicy != "" && settings.ReferrerPolicy != "none" {
+		security.ReferrerPolicy = &cloudfront.ResponseHeadersPolicyReferrerPolicy{
+			ReferrerPolicy: aws.String(settings.ReferrerPolicy),
+			Override:       aws.Bool(true),
+		}
+		hasSecurityHeaders = true
+	}
+	if hasSecurityHeaders {
+		policy.SecurityHeadersConfig = security
+	}
+
+	if len(config.Custom) > 0 {
+		custom := &cloudfront.ResponseHeadersPolicyCustomHeadersConfig{Quantity: aws.Int64(int64(len(config.Custom)))}
+		for _, header := range config.Custom {
+			override := header.Override == nil || *header.Override
+			custom.Items = append(custom.Items, &cloudfront.ResponseHeadersPolicyCustomHeader{
+				Header:   aws.String(header.Name),
+				Value:    aws.String(header.Value),
+				Override: aws.Bool(override),
+			})
+		}
+		policy.CustomHeadersConfig = custom
+	}
+
+	if cors := config.CORS; cors != nil {
+		methods := cors.AllowMethods
+		if len(methods) == 0 {
+			methods = []string{"GET", "HEAD", "OPTIONS"}
+		}
+		headers := cors.AllowHeaders
+		if len(headers) == 0 {
+			headers = []string{"*"}
+		}
+		corsConfig := &cloudfront.ResponseHeadersPolicyCorsConfig{
+			AccessControlAllowOrigins:     &cloudfront.ResponseHeadersPolicyAccessControlAllowOrigins{},
+			AccessControlAllowMethods:     &cloudfront.ResponseHeadersPolicyAccessControlAllowMethods{},
+			AccessControlAllowHeaders:     &cloudfront.ResponseHeadersPolicyAccessControlAllowHeaders{},
+			AccessControlAllowCredentials: aws.Bool(cors.AllowCredentials),
+			AccessControlMaxAgeSec:        cors.MaxAge,
+			OriginOverride:                aws.Bool(true),
+		}
+		corsConfig.AccessControlAllowOrigins.Quantity, corsConfig.AccessControlAllowOrigins.Items = stringList(cors.AllowOrigins)
+		corsConfig.AccessControlAllowMethods.Quantity, corsConfig.AccessControlAllowMethods.Items = stringList(methods)
+		corsConfig.AccessControlAllowHeaders.Quantity, corsConfig.AccessControlAllowHeaders.Items = stringList(headers)
+		if len(cors.ExposeHeaders) > 0 {
+			corsConfig.AccessControlExposeHeaders = &cloudfront.ResponseHeadersPolicyAccessControlExposeHeaders{}
+			corsConfig.AccessControlExposeHeaders.Quantity, corsConfig.AccessControlExposeHeaders.Items = stringList(cors.ExposeHeaders)
+		}
+		policy.CorsConfig = corsConfig
+	}
+
+	if policy.SecurityHeadersConfig == nil && policy.CustomHeadersConfig == nil && policy.CorsConfig == nil {
+		return nil
+	}
+	return policy
+}
+
+// Renders the parts of a policy config scarr sets, for comparison.  Like
+// drift.go's describe helpers, a missing setting and an empty one render the
+// same, since cloudfront hands configs back with empty lists (and an empty
+// SecurityHeadersConfig) where scarr leaves them out.
+func describeResponseHeadersPolicy(config *cloudfront.ResponseHeadersPolicyConfig) string {
+	lines := []string{}
+	add := func(name string, value string) {
+		lines = append(lines, name+": "+value)
+	}
+
+	security := config.SecurityHeadersConfig
+	if security == nil {
+		security = &cloudfront.ResponseHeadersPolicySecurityHeadersConfig{}
+	}
+	contentTypeOptions := "(none)"
+	if options := security.ContentTypeOptions; options != nil {
+		contentTypeOptions = "nosniff override=" + describeValue(options.Override)
+	}
+	add("content type options", contentTypeOptions)
+	hsts := "(none)"
+	if sts := security.StrictTransportSecurity; sts != nil {
+		hsts = fmt.Sprintf("max-age=%v includeSubdomains=%v preload=%v override=%v",
+			describeValue(sts.AccessControlMaxAgeSec), describeValue(sts.IncludeSubdomains), describeValue(sts.Preload), describeValue(sts.Override))
+	}
+	add("hsts", hsts)
+	csp := "(none)"
+	if policy := security.ContentSecurityPolicy; policy != nil {
+		csp = describeValue(policy.ContentSecurityPolicy) + " override=" + describeValue(policy.Override)
+	}
+	add("content security policy", csp)
+	frameOptions := "(none)"
+	if options := security.FrameOptions; options != nil {
+		frameOptions = describeValue(options.FrameOption) + " override=" + describeValue(options.Override)
+	}
+	add("frame options", frameOptions)
+	referrerPolicy := "(none)"
+	if policy := security.ReferrerPolicy; policy != nil {
+		referrerPolicy = describeValue(policy.ReferrerPolicy) + " override=" + describeValue(policy.Override)
+	}
+	add("referrer policy", referrerPolicy)
+
+	custom := []string{}
+	if config.CustomHeadersConfig != nil {
+		for _, header := range config.CustomHeadersConfig.Items {
+			custom = append(custom, aws.StringValue(header.Header)+"="+aws.StringValue(header.Value)+" override="+describeValue(header.Override))
+		}
+	}
+	add("custom headers", describeList(custom))
+
+	if cors := config.CorsConfig; cors == nil {
+		add("cors", "(none)")
+	} else {
+		var origins, methods, headers, exposeHeaders []string
+		if cors.AccessControlAllowOrigins != nil {
+			origins = aws.StringValueSlice(cors.AccessControlAllowOrigins.Items)
+		}
+		if cors.AccessControlAllowMethods != nil {
+			methods = aws.StringValueSlice(cors.AccessControlAllowMethods.Items)
+		}
+		if cors.AccessControlAllowHeaders != nil {
+			headers = aws.StringValueSlice(cors.AccessControlAllowHeaders.Items)
+		}
+		if cors.AccessControlExposeHeaders != nil {
+			exposeHeaders = aws.StringValueSlice(cors.AccessControlExposeHeaders.Items)
+		}
+		add("cors origins", describeList(origins))
+		add("cors methods", describeList(methods))
+		add("cors headers", describeList(headers))
+		add("cors expose headers", describeList(exposeHeaders))
+		add("cors credentials", describeValue(cors.AccessControlAllowCredentials))
+		add("cors max age", describeValue(cors.AccessControlMaxAgeSec))
+		add("cors origin override", describeValue(cors.OriginOverride))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Whether two policy configs set the same headers.
+func sameResponseHeadersPolicy(a *cloudfront.ResponseHeadersPolicyConfig, b *cloudfront.ResponseHeadersPolicyConfig) bool {
+	return describeResponseHeadersPolicy(a) == describeResponseHeadersPolicy(b)
+}
+
+// Returns the ID of the custom response headers policy with the given name, or
+// "" if there isn't one.
+func findResponseHeadersPolicy(name string) (string, error) {
+	service := cloudFrontService()
+	input := &cloudfront.ListResponseHeadersPoliciesInput{Type: aws.String("custom")}
+	for {
+		result, err := service.ListResponseHeadersPolicies(input)
+		if err != nil {
+			return "", wrapAWSError(err, "list response headers policies")
+		}
+		list := result.ResponseHeadersPolicyList
+		for _, summary := range list.Items {
+			policy := summary.ResponseHeadersPolicy
+			if aws.StringValue(policy.ResponseHeadersPolicyConfig.Name) == name {
+				return *policy.Id, nil
+			}
+		}
+		if aws.StringValue(list.NextMarker) == "" {
+			return "", nil
+		}
+		input.Marker = list.NextMarker
+	}
+}
+
+func getResponseHeadersPolicyConfig(id string) (*cloudfront.ResponseHeadersPolicyConfig, *string, error) {
+	service := cloudFrontService()
+	result, err := service.GetResponseHeadersPolicyConfig(&cloudfront.GetResponseHeadersPolicyConfigInput{Id: &id})
+	if err != nil {
+		return nil, nil, wrapAWSError(err, "get response headers policy "+id)
+	}
+	return result.ResponseHeadersPolicyConfig, result.ETag, nil
+}
+
+// Makes sure the site's response headers policy exists and sends the headers
+// in scarr.yml.  Returns its ID, or "" if the site doesn't set securityHeaders.
+func ensureResponseHeadersPolicy(config configType) (string, error) {
+	if config.SecurityHeaders == nil {
+		return "", nil
+	}
+	name := getResponseHeadersPolicyName(config)
+	desired := buildResponseHeadersPolicyConfig(name, config.SecurityHeaders)
+	service := cloudFrontService()
+
+	logf("Checking response headers policy %v...", name)
+	id, err := findResponseHeadersPolicy(name)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		log(" doesn't exist; creating...")
+		result, err := service.CreateResponseHeadersPolicy(&cloudfront.CreateResponseHeadersPolicyInput{
+			ResponseHeadersPolicyConfig: desired,
+		})
+		if err != nil {
+			return "", wrapAWSError(err, "create response headers policy "+name)
+		}
+		logln(" done")
+		return *result.ResponseHeadersPolicy.Id, nil
+	}
+
+	current, etag, err := getResponseHeadersPolicyConfig(id)
+	if err != nil {
+		return "", err
+	}
+	if sameResponseHeadersPolicy(current, desired) {
+		logln(" up to date.")
+		return id, nil
+	}
+	log(" updating...")
+	_, err = service.UpdateResponseHeadersPolicy(&cloudfront.UpdateResponseHeadersPolicyInput{
+		Id:                          &id,
+		IfMatch:                     etag,
+		ResponseHeadersPolicyConfig: desired,
+	})
+	if err != nil {
+		return "", wrapAWSError(err, "update response headers policy "+name)
+	}
+	logln(" done")
+	return id, nil
+}
+
+// Only works once no distribution uses the policy anymore.
+func deleteResponseHeadersPolicy(id string) error {
+	_, etag, err := getResponseHeadersPolicyConfig(id)
+	if err != nil {
+		return err
+	}
+	service := cloudFrontService()
+	_, err = service.DeleteResponseHeadersPolicy(&cloudfront.DeleteResponseHeadersPolicyInput{
+		Id:      &id,
+		IfMatch: etag,
+	})
+	return wrapAWSError(err, "delete response headers policy "+id)
+}
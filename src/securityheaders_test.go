@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"gopkg.in/yaml.v2"
+)
+
+func TestBuildResponseHeadersPolicyConfig(t *testing.T) {
+	policy := buildResponseHeadersPolicyConfig("example-headers", &securityHeadersConfigType{})
+	security := policy.SecurityHeadersConfig
+	if security.ContentTypeOptions == nil || aws.Int64Value(security.StrictTransportSecurity.AccessControlMaxAgeSec) != 31536000 ||
+		*security.FrameOptions.FrameOption != "SAMEORIGIN" || *security.ReferrerPolicy.ReferrerPolicy != "strict-origin-when-cross-origin" {
+		t.Errorf("expected the default preset, got %v", security)
+	}
+	if security.ContentSecurityPolicy != nil || policy.CustomHeadersConfig != nil || policy.CorsConfig != nil {
+		t.Errorf("expected nothing beyond the default preset, got %v", policy)
+	}
+
+	// Settings in scarr.yml win over the preset
+	policy = buildResponseHeadersPolicyConfig("example-headers", &securityHeadersConfigType{
+		FrameOptions:          "none",
+		ContentSecurityPolicy: "default-src 'self'",
+		HSTS:                  &hstsConfigType{MaxAge: 63072000, IncludeSubdomains: true, Preload: true},
+	})
+	security = policy.SecurityHeadersConfig
+	if security.FrameOptions != nil || *security.ContentSecurityPolicy.ContentSecurityPolicy != "default-src 'self'" || !*security.StrictTransportSecurity.Preload {
+		t.Errorf("expected scarr.yml's settings to override the preset, got %v", security)
+	}
+
+	// preset: none only sends what's asked for
+	policy = buildResponseHeadersPolicyConfig("example-headers", &securityHeadersConfigType{
+		Preset: "none",
+		Custom: []customHeaderConfigType{{Name: "Permissions-Policy", Value: "camera=()"}},
+		CORS:   &corsConfigType{AllowOrigins: []string{"https://app.example.com"}},
+	})
+	if policy.SecurityHeadersConfig != nil {
+		t.Errorf("expected no security headers, got %v", policy.SecurityHeadersConfig)
+	}
+	if header := policy.CustomHeadersConfig.Items[0]; *header.Header != "Permissions-Policy" || !*header.Override {
+		t.Errorf("expected an overriding Permissions-Policy header, got %v", header)
+	}
+	if methods := aws.StringValueSlice(policy.CorsConfig.AccessControlAllowMethods.Items); strings.Join(methods, ",") != "GET,HEAD,OPTIONS" {
+		t.Errorf("expected the default cors methods, got %v", methods)
+	}
+
+	if policy := buildResponseHeadersPolicyConfig("example-headers", &securityHeadersConfigType{Preset: "none"}); policy != nil {
+		t.Errorf("expected no policy when there are no headers, got %v", policy)
+	}
+}
+
+func TestSameResponseHeadersPolicy(t *testing.T) {
+	config := &securityHeadersConfigType{
+		Preset: "none",
+		Custom: []customHeaderConfigType{{Name: "Permissions-Policy", Value: "camera=()"}, {Name: "X-Robots-Tag", Value: "noindex"}},
+		CORS:   &corsConfigType{AllowOrigins: []string{"https://app.example.com"}},
+	}
+	desired := buildResponseHeadersPolicyConfig("example-headers", config)
+
+	// What cloudfront hands back: empty lists and blocks filled in where
+	// scarr left them out, and lists in its own order
+	current := buildResponseHeadersPolicyConfig("example-headers", config)
+	current.SecurityHeadersConfig = &cloudfront.ResponseHeadersPolicySecurityHeadersConfig{}
+	current.CorsConfig.AccessControlExposeHeaders = &cloudfront.ResponseHeadersPolicyAccessControlExposeHeaders{Quantity: aws.Int64(0), Items: []*string{}}
+	current.CorsConfig.AccessControlMaxAgeSec = aws.Int64(0)
+	items := current.CustomHeadersConfig.Items
+	items[0], items[1] = items[1], items[0]
+	if !sameResponseHeadersPolicy(current, desired) {
+		t.Errorf("expected the round-tripped policy to match, got\n%v\nvs\n%v", describeResponseHeadersPolicy(current), describeResponseHeadersPolicy(desired))
+	}
+
+	current.CorsConfig.AccessControlAllowOrigins.Items = aws.StringSlice([]string{"https://other.example.com"})
+	if sameResponseHeadersPolicy(current, desired) {
+		t.Error("expected a different cors origin not to match")
+	}
+	current = buildResponseHeadersPolicyConfig("example-headers", config)
+	*current.CustomHeadersConfig.Items[0].Value = "camera=(self)"
+	if sameResponseHeadersPolicy(current, desired) {
+		t.Error("expected a different custom header value not to match")
+	}
+}
+
+func TestSecurityHeadersConfigAcceptsPreset(t *testing.T) {
+	var config configType
+	if err := yaml.Unmarshal([]byte("securityHeaders: default\n"), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.SecurityHeaders == nil || config.SecurityHeaders.Preset != "default" {
+		t.Errorf("expected the default preset, got %v", config.SecurityHeaders)
+	}
+}
+
+func TestValidateSecurityHeadersConfig(t *testing.T) {
+	cases := []struct {
+		name   string
+		config securityHeadersConfigType
+		err    string
+	}{
+		{name: "default"},
+		{name: "unknown preset", config: securityHeadersConfigType{Preset: "strict"}, err: "unknown securityHeaders preset"},
+		{name: "frame options", config: securityHeadersConfigType{FrameOptions: "ALLOW-FROM"}, err: "unknown securityHeaders frameOptions"},
+		{name: "referrer policy", config: securityHeadersConfigType{ReferrerPolicy: "sometimes"}, err: "unknown securityHeaders referrerPolicy"},
+		{
+			name:   "reserved custom header",
+			config: securityHeadersConfigType{Custom: []customHeaderConfigType{{Name: "X-Frame-Options", Value: "DENY"}}},
+			err:    "can't be a custom header",
+		},
+		{
+			name:   "duplicate custom header",
+			config: securityHeadersConfigType{Custom: []customHeaderConfigType{{Name: "X-Robots-Tag", Value: "none"}, {Name: "x-robots-tag", Value: "noindex"}}},
+			err:    "more than once",
+		},
+		{name: "cors without origins", config: securityHeadersConfigType{CORS: &corsConfigType{}}, err: "at least one allowOrigins"},
+		{
+			name:   "cors credentials from anywhere",
+			config: securityHeadersConfigType{CORS: &corsConfigType{AllowOrigins: []string{"*"}, AllowCredentials: true}},
+			err:    "can't allow credentials",
+		},
+		{name: "nothing to send", config: securityHeadersConfigType{Preset: "none"}, err: "at least one header"},
+	}
+	for _, c := range cases {
+		err := validateSecurityHeadersConfig(&c.config)
+		if c.err == "" && err != nil {
+			t.Errorf("%v: expected no error, got %v", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%v: expected an error containing %q, got %v", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/acm"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53domains"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// The interfaces below list just the AWS operations scarr uses, so the deploy
+// logic can run against fakes (see fakes_test.go) instead of real AWS.
+
+type s3API interface {
+	HeadBucket(*s3.HeadBucketInput) (*s3.HeadBucketOutput, error)
+	GetBucketAcl(*s3.GetBucketAclInput) (*s3.GetBucketAclOutput, error)
+	GetBucketWebsite(*s3.GetBucketWebsiteInput) (*s3.GetBucketWebsiteOutput, error)
+	PutBucketWebsite(*s3.PutBucketWebsiteInput) (*s3.PutBucketWebsiteOutput, error)
+	CreateBucket(*s3.CreateBucketInput) (*s3.CreateBucketOutput, error)
+	DeleteBucket(*s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error)
+	ListObjectsV2Pages(*s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool) error
+	HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	CopyObject(*s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	DeleteObjects(*s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
+	GetPublicAccessBlock(*s3.GetPublicAccessBlockInput) (*s3.GetPublicAccessBlockOutput, error)
+	PutPublicAccessBlock(*s3.PutPublicAccessBlockInput) (*s3.PutPublicAccessBlockOutput, error)
+	GetBucketPolicy(*s3.GetBucketPolicyInput) (*s3.GetBucketPolicyOutput, error)
+	PutBucketPolicy(*s3.PutBucketPolicyInput) (*s3.PutBucketPolicyOutput, error)
+}
+
+type s3UploaderAPI interface {
+	Upload(*s3manager.UploadInput, ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
+}
+
+type cloudFrontAPI interface {
+	ListDistributionsPages(*cloudfront.ListDistributionsInput, func(*cloudfront.ListDistributionsOutput, bool) bool) error
+	GetDistribution(*cloudfront.GetDistributionInput) (*cloudfront.GetDistributionOutput, error)
+	GetDistributionConfig(*cloudfront.GetDistributionConfigInput) (*cloudfront.GetDistributionConfigOutput, error)
+	CreateDistribution(*cloudfront.CreateDistributionInput) (*cloudfront.CreateDistributionOutput, error)
+	UpdateDistribution(*cloudfront.UpdateDistributionInput) (*cloudfront.UpdateDistributionOutput, error)
+	DeleteDistribution(*cloudfront.DeleteDistributionInput) (*cloudfront.DeleteDistributionOutput, error)
+	CreateInvalidation(*cloudfront.CreateInvalidationInput) (*cloudfront.CreateInvalidationOutput, error)
+	WaitUntilDistributionDeployed(*cloudfront.GetDistributionInput) error
+	WaitUntilInvalidationCompleted(*cloudfront.GetInvalidationInput) error
+	CreateFunction(*cloudfront.CreateFunctionInput) (*cloudfront.CreateFunctionOutput, error)
+	DescribeFunction(*cloudfront.DescribeFunctionInput) (*cloudfront.DescribeFunctionOutput, error)
+	GetFunction(*cloudfront.GetFunctionInput) (*cloudfront.GetFunctionOutput, error)
+	UpdateFunction(*cloudfront.UpdateFunctionInput) (*cloudfront.UpdateFunctionOutput, error)
+	PublishFunction(*cloudfront.PublishFunctionInput) (*cloudfront.PublishFunctionOutput, error)
+	DeleteFunction(*cloudfront.DeleteFunctionInput) (*cloudfront.DeleteFunctionOutput, error)
+	ListOriginAccessControls(*cloudfront.ListOriginAccessControlsInput) (*cloudfront.ListOriginAccessControlsOutput, error)
+	CreateOriginAccessControl(*cloudfront.CreateOriginAccessControlInput) (*cloudfront.CreateOriginAccessControlOutput, error)
+	GetOriginAccessControl(*cloudfront.GetOriginAccessControlInput) (*cloudfront.GetOriginAccessControlOutput, error)
+	DeleteOriginAccessControl(*cloudfront.DeleteOriginAccessControlInput) (*cloudfront.DeleteOriginAccessControlOutput, error)
+	ListResponseHeadersPolicies(*cloudfront.ListResponseHeadersPoliciesInput) (*cloudfront.ListResponseHeadersPoliciesOutput, error)
+	CreateResponseHeadersPolicy(*cloudfront.CreateResponseHeadersPolicyInput) (*cloudfront.CreateResponseHeadersPolicyOutput, error)
+	GetResponseHeadersPolicyConfig(*cloudfront.GetResponseHeadersPolicyConfigInput) (*cloudfront.GetResponseHeadersPolicyConfigOutput, error)
+	UpdateResponseHeadersPolicy(*cloudfront.UpdateResponseHeadersPolicyInput) (*cloudfront.UpdateResponseHeadersPolicyOutput, error)
+	DeleteResponseHeadersPolicy(*cloudfront.DeleteResponseHeadersPolicyInput) (*cloudfront.DeleteResponseHeadersPolicyOutput, error)
+}
+
+type acmAPI interface {
+	ListCertificatesPages(*acm.ListCertificatesInput, func(*acm.ListCertificatesOutput, bool) bool) error
+	RequestCertificate(*acm.RequestCertificateInput) (*acm.RequestCertificateOutput, error)
+	DescribeCertificate(*acm.DescribeCertificateInput) (*acm.DescribeCertificateOutput, error)
+	DeleteCertificate(*acm.DeleteCertificateInput) (*acm.DeleteCertificateOutput, error)
+}
+
+type route53API interface {
+	ListHostedZonesPages(*route53.ListHostedZonesInput, func(*route53.ListHostedZonesOutput, bool) bool) error
+	ListResourceRecordSetsPages(*route53.ListResourceRecordSetsInput, func(*route53.ListResourceRecordSetsOutput, bool) bool) error
+	ChangeResourceRecordSets(*route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
+	CreateHostedZone(*route53.CreateHostedZoneInput) (*route53.CreateHostedZoneOutput, error)
+}
+
+type route53DomainsAPI interface {
+	RegisterDomain(*route53domains.RegisterDomainInput) (*route53domains.RegisterDomainOutput, error)
+	GetOperationDetail(*route53domains.GetOperationDetailInput) (*route53domains.GetOperationDetailOutput, error)
+	GetDomainDetail(*route53domains.GetDomainDetailInput) (*route53domains.GetDomainDetailOutput, error)
+	CheckDomainAvailability(*route53domains.CheckDomainAvailabilityInput) (*route53domains.CheckDomainAvailabilityOutput, error)
+	UpdateDomainNameservers(*route53domains.UpdateDomainNameserversInput) (*route53domains.UpdateDomainNameserversOutput, error)
+}
+
+// Overrides for where each service's API lives, eg to point scarr at a local
+// emulator.  Any service left blank falls back to SCARR_ENDPOINT_URL, and then
+// to the normal AWS endpoint.
+type endpointsConfigType struct {
+	S3             string `yaml:"s3"`
+	CloudFront     string `yaml:"cloudfront"`
+	ACM            string `yaml:"acm"`
+	Route53        string `yaml:"route53"`
+	Route53Domains string `yaml:"route53domains"`
+}
+
+const endpointEnvVar = "SCARR_ENDPOINT_URL"
+
+// Set from scarr.yml by getConfig, before any services are created.
+var endpoints endpointsConfigType
+
+func validateEndpoint(name string, endpoint string) error {
+	if endpoint == "" {
+		return nil
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return newConfigError(err, name+" endpoint must be a full http(s) URL (eg http://localhost:4566), got "+endpoint)
+	}
+	return nil
+}
+
+func validateEndpoints(config endpointsConfigType) error {
+	toCheck := []struct{ name, endpoint string }{
+		{"s3", config.S3},
+		{"cloudfront", config.CloudFront},
+		{"acm", config.ACM},
+		{"route53", config.Route53},
+		{"route53domains", config.Route53Domains},
+		{endpointEnvVar, os.Getenv(endpointEnvVar)},
+	}
+	for _, check := range toCheck {
+		if err := validateEndpoint(check.name, check.endpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func awsConfig(region string, endpoint string) *aws.Config {
+	config := &aws.Config{Region: aws.String(region)}
+	if endpoint == "" {
+		endpoint = os.Getenv(endpointEnvVar)
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	return config
+}
+
+func newSession(config *aws.Config) *session.Session {
+	return session.Must(session.NewSession(config))
+}
+
+// The service constructors are package variables so tests can swap in fakes.
+
+var s3Service = func(region string) s3API {
+	return s3.New(newSession(s3Config(region)))
+}
+
+var s3ManagerService = func(region string) s3UploaderAPI {
+	return s3manager.NewUploader(newSession(s3Config(region)))
+}
+
+func s3Config(region string) *aws.Config {
+	config := awsConfig(region, endpoints.S3)
+	// Emulators generally don't do bucket subdomains
+	if config.Endpoint != nil {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	return config
+}
+
+var cloudFrontService = func() cloudFrontAPI {
+	// CloudFront is global, but signs requests for us-east-1
+	return cloudfront.New(newSession(awsConfig("us-east-1", endpoints.CloudFront)))
+}
+
+var amcService = func() acmAPI {
+	// ACM needs to do stuff in us-east-1 for cloudfront to work
+	return acm.New(newSession(awsConfig("us-east-1", endpoints.ACM)))
+}
+
+var route53DomainsService = func() route53DomainsAPI {
+	// Route53 only has the one domain, so hardcode to us east
+	return route53domains.New(newSession(awsConfig("us-east-1", endpoints.Route53Domains)))
+}
+
+var route53Service = func() route53API {
+	// Route53 only has the one domain, so hardcode to us east
+	return route53.New(newSession(awsConfig("us-east-1", endpoints.Route53)))
+}
+
+// Used for every poll/retry wait, so tests don't actually wait.
+var sleep = time.Sleep
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAWSConfigEndpoints(t *testing.T) {
+	oldEndpoints, oldEnv := endpoints, os.Getenv(endpointEnvVar)
+	defer func() {
+		endpoints = oldEndpoints
+		os.Setenv(endpointEnvVar, oldEnv)
+	}()
+
+	os.Setenv(endpointEnvVar, "")
+	endpoints = endpointsConfigType{}
+	if config := s3Config("us-west-2"); config.Endpoint != nil || config.S3ForcePathStyle != nil {
+		t.Error("expected the default endpoint when nothing's configured")
+	}
+
+	os.Setenv(endpointEnvVar, "http://localhost:4566")
+	endpoints = endpointsConfigType{S3: "http://localhost:9000"}
+	config := s3Config("us-west-2")
+	if *config.Endpoint != "http://localhost:9000" || !*config.S3ForcePathStyle {
+		t.Errorf("expected s3 to use its own endpoint with path-style addressing, got %v", *config.Endpoint)
+	}
+	if *config.Region != "us-west-2" {
+		t.Errorf("expected the bucket's region, got %v", *config.Region)
+	}
+	if config := awsConfig("us-east-1", endpoints.Route53); *config.Endpoint != "http://localhost:4566" {
+		t.Errorf("expected route53 to fall back to %v, got %v", endpointEnvVar, *config.Endpoint)
+	}
+}
+
+func TestValidateEndpoints(t *testing.T) {
+	oldEnv := os.Getenv(endpointEnvVar)
+	defer os.Setenv(endpointEnvVar, oldEnv)
+	os.Setenv(endpointEnvVar, "")
+
+	if err := validateEndpoints(endpointsConfigType{ACM: "https://acm.example.test"}); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []string{"localhost:4566", "ftp://localhost", "http://"} {
+		if err := validateEndpoints(endpointsConfigType{S3: bad}); exitCodeFor(err) != exitCodeConfig {
+			t.Errorf("expected %q to be rejected as a config error, got %v", bad, err)
+		}
+	}
+
+	os.Setenv(endpointEnvVar, "not a url")
+	if err := validateEndpoints(endpointsConfigType{}); err == nil {
+		t.Errorf("expected a bad %v to be rejected", endpointEnvVar)
+	}
+}
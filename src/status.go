@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// One row of the status table.  Anything not ok makes status exit non-zero.
+type resourceStatus struct {
+	resource string
+	ok       bool
+	detail   string
+}
+
+func formatDate(date *time.Time) string {
+	if date == nil {
+		return "unknown"
+	}
+	return date.Format("2006-01-02")
+}
+
+func getDomainStatus(config configType) (resourceStatus, error) {
+	domain := getRootDomain(config.Domain)
+	status := resourceStatus{resource: "domain"}
+	domainDetail, err := getDomainDetails(domain)
+	if err != nil {
+		return status, err
+	}
+	if domainDetail == nil {
+		status.detail = domain + " is not registered in route53"
+		return status, nil
+	}
+	status.ok = true
+	status.detail = domain + " registered, expires " + formatDate(domainDetail.ExpirationDate)
+	return status, nil
+}
+
+func getHostedZoneStatus(domain string) (resourceStatus, error) {
+	status := resourceStatus{resource: "hosted zone"}
+	hostedZoneID, err := findHostedZone(domain)
+	if err != nil {
+		return status, err
+	}
+	if hostedZoneID == "" {
+		status.detail = "no hosted zone for " + getRootDomain(domain)
+		return status, nil
+	}
+	status.ok = true
+	status.detail = hostedZoneID
+	return status, nil
+}
+
+func getCertificateStatus(domain string) (resourceStatus, error) {
+	status := resourceStatus{resource: "certificate"}
+	certificateArn, err := getAcmCertificateARN(domain)
+	if err != nil {
+		return status, err
+	}
+	if certificateArn == nil {
+		status.detail = "no ACM certificate for " + domain
+		return status, nil
+	}
+
+	certificate, err := describeACMCertificate(*certificateArn)
+	if err != nil {
+		return status, err
+	}
+	validationStatus := "unknown"
+	if len(certificate.DomainValidationOptions) > 0 && certificate.DomainValidationOptions[0].ValidationStatus != nil {
+		validationStatus = *certificate.DomainValidationOptions[0].ValidationStatus
+	}
+	status.ok = *certificate.Status == "ISSUED"
+	status.detail = fmt.Sprintf("%v, validation %v, expires %v", *certificate.Status, validationStatus, formatDate(certificate.NotAfter))
+	return status, nil
+}
+
+func getBucketStatus(bucket string, region string, private bool, desiredWebsite *s3.WebsiteConfiguration) (resourceStatus, error) {
+	status := resourceStatus{resource: "bucket"}
+	exists, err := bucketExists(bucket, region)
+	if err != nil {
+		return status, err
+	}
+	if !exists {
+		status.detail = bucket + " does not exist"
+		return status, nil
+	}
+	if private {
+		blocked, err := bucketBlocksPublicAccess(bucket, region)
+		if err != nil {
+			return status, err
+		}
+		if !blocked {
+			status.detail = bucket + " exists but doesn't block public access"
+			return status, nil
+		}
+		status.ok = true
+		status.detail = bucket + " exists and blocks public access"
+		return status, nil
+	}
+	website, err := getBucketWebsite(bucket, region)
+	if err != nil {
+		return status, err
+	}
+	if website == nil {
+		status.detail = bucket + " exists but has no website configuration"
+		return status, nil
+	}
+	if !websiteMatches(website, desiredWebsite) {
+		status.detail = bucket + " exists but its website configuration (error document or redirects) is out of date"
+		return status, nil
+	}
+	status.ok = true
+	status.detail = bucket + " exists with website configuration"
+	return status, nil
+}
+
+func getReleaseStatus(config configType) (resourceStatus, error) {
+	status := resourceStatus{resource: "release"}
+	_, distributionID, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return status, err
+	}
+	if distributionID == nil {
+		status.detail = "no distribution to serve a release"
+		return status, nil
+	}
+	liveID, err := getLiveRelease(*distributionID)
+	if err != nil {
+		return status, err
+	}
+	if liveID == "" {
+		status.detail = "no release is live yet"
+		return status, nil
+	}
+	status.ok = true
+	status.detail = liveID + " is live"
+	return status, nil
+}
+
+func getDistributionStatus(config configType) (resourceStatus, error) {
+	status := resourceStatus{resource: "distribution"}
+	cloudfrontDomain, distributionID, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return status, err
+	}
+	if distributionID == nil {
+		status.detail = "no distribution in front of " + getOriginDomain(config)
+		return status, nil
+	}
+	deployStatus, err := getCloudfrontStatus(*distributionID)
+	if err != nil {
+		return status, err
+	}
+	// InProgress just means a change is still rolling out; it's still serving
+	status.ok = true
+	status.detail = *distributionID + " (" + *cloudfrontDomain + ") " + deployStatus
+	return status, nil
+}
+
+func getAliasStatus(domain string, recordType string) (resourceStatus, error) {
+	status := resourceStatus{resource: "alias record"}
+	hostedZoneID, err := findHostedZone(domain)
+	if err != nil {
+		return status, err
+	}
+	if hostedZoneID == "" {
+		status.detail = "no hosted zone for " + getRootDomain(domain)
+		return status, nil
+	}
+	aliasRecord, err := getDNSRecord(hostedZoneID, domain, recordType)
+	if err != nil {
+		return status, err
+	}
+	if aliasRecord == nil {
+		status.detail = "no " + recordType + " record for " + domain
+		return status, nil
+	}
+	status.ok = true
+	if aliasRecord.AliasTarget != nil {
+		status.detail = domain + " -> " + *aliasRecord.AliasTarget.DNSName
+	} else {
+		status.detail = domain + " has a (non-alias) " + recordType + " record"
+	}
+	return status, nil
+}
+
+// For -skip-dns, checks that public DNS points the domain at cloudfront.
+func getExternalDNSStatus(config configType, domain string) (resourceStatus, error) {
+	status := resourceStatus{resource: "dns record"}
+	cloudfrontDomain, _, err := getCloudfront(getOriginDomains(config))
+	if err != nil {
+		return status, err
+	}
+	if cloudfrontDomain == nil {
+		status.detail = "no distribution for " + domain + " to point at"
+		return status, nil
+	}
+	if !domainPointsAt(domain, *cloudfrontDomain) {
+		status.detail = domain + " doesn't point at " + *cloudfrontDomain + " in public DNS"
+		return status, nil
+	}
+	status.ok = true
+	status.detail = domain + " -> " + *cloudfrontDomain
+	return status, nil
+}
+
+// Prints the state of everything deploy manages.  Returns an error if anything
+// is missing or unhealthy, or couldn't be checked.  Only calls read-only AWS
+// APIs.  skipDomain and skipDNS leave out the same things they do for deploy.
+func runStatus(skipDomain bool, skipDNS bool) error {
+	config, err := getConfig()
+	if err != nil {
+		return err
+	}
+	s3Bucket := getBucketName(config)
+
+	checks := []func() (resourceStatus, error){}
+	if !skipDomain {
+		checks = append(checks, func() (resourceStatus, error) { return getDomainStatus(config) })
+	}
+	if !skipDNS {
+		checks = append(checks, func() (resourceStatus, error) { return getHostedZoneStatus(config.Domain) })
+	}
+	checks = append(checks,
+		func() (resourceStatus, error) { return getCertificateStatus(config.Domain) },
+		func() (resourceStatus, error) {
+			return getBucketStatus(s3Bucket, config.Region, usesPrivateOrigin(config), buildWebsiteConfiguration(config))
+		},
+		func() (resourceStatus, error) { return getDistributionStatus(config) },
+	)
+	if usesReleases(config) {
+		checks = append(checks, func() (resourceStatus, error) { return getReleaseStatus(config) })
+	}
+	for _, domain := range getSiteDomains(config) {
+		domain := domain
+		if skipDNS {
+			checks = append(checks, func() (resourceStatus, error) { return getExternalDNSStatus(config, domain) })
+		} else {
+			for _, recordType := range aliasRecordTypes {
+				recordType := recordType
+				checks = append(checks, func() (resourceStatus, error) { return getAliasStatus(domain, recordType) })
+			}
+		}
+	}
+
+	var firstErr error
+	healthy := true
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "RESOURCE\tSTATUS\tDETAIL")
+	for _, check := range checks {
+		status, err := check()
+		state := "ok"
+		if err != nil {
+			// Keep checking the rest; one failed lookup shouldn't hide the others
+			state = "ERROR"
+			status.detail = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if !status.ok {
+			state = "MISSING"
+			healthy = false
+		}
+		fmt.Fprintf(writer, "%v\t%v\t%v\n", status.resource, state, status.detail)
+	}
+	writer.Flush()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if !healthy {
+		return errors.New("some resources are missing or unhealthy")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The STATUS column of each row runStatus printed, by resource.
+func statusStates(output string) map[string][]string {
+	states := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n")[1:] {
+		fields := strings.Fields(line)
+		// Resource names can have spaces, but the state never does
+		for i, field := range fields {
+			if field == "ok" || field == "MISSING" || field == "ERROR" {
+				resource := strings.Join(fields[:i], " ")
+				states[resource] = append(states[resource], field)
+				break
+			}
+		}
+	}
+	return states
+}
+
+func TestStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		// Sets up the fake account before checking
+		setUp    func(fake *fakeAWS)
+		state    string
+		resource string
+	}{
+		{name: "deployed", setUp: seedInfrastructure, state: "ok"},
+		{name: "nothing deployed", setUp: func(*fakeAWS) {}, state: "MISSING", resource: "bucket"},
+		{name: "bucket without a website", setUp: func(fake *fakeAWS) {
+			seedInfrastructure(fake)
+			fake.buckets["example-bucket"].website = false
+		}, state: "MISSING", resource: "bucket"},
+		{name: "bucket owned by someone else", setUp: func(fake *fakeAWS) {
+			seedInfrastructure(fake)
+			fake.foreignBuckets["example-bucket"] = true
+		}, state: "ERROR", resource: "bucket"},
+	}
+	for _, c := range cases {
+		fake := newFakeAWS()
+		restore := fake.install()
+		c.setUp(fake)
+		removeSite := useSite(t, copySite())
+
+		output, err := captureStdout(t, func() error { return runStatus(false, false) })
+		states := statusStates(output)
+		if c.state == "ok" {
+			if err != nil {
+				t.Errorf("%v: expected status to succeed, got %v", c.name, err)
+			}
+			for resource, resourceStates := range states {
+				for _, state := range resourceStates {
+					if state != "ok" {
+						t.Errorf("%v: expected %v to be ok, got %v", c.name, resource, state)
+					}
+				}
+			}
+		} else {
+			// Anything missing or broken exits non-zero
+			if err == nil || exitCodeFor(err) == 0 {
+				t.Errorf("%v: expected status to fail, got %v", c.name, err)
+			}
+			if resourceStates := states[c.resource]; len(resourceStates) != 1 || resourceStates[0] != c.state {
+				t.Errorf("%v: expected %v to be %v, got %v in:\n%v", c.name, c.resource, c.state, resourceStates, output)
+			}
+		}
+		if len(states) == 0 {
+			t.Errorf("%v: expected a status table, got %q", c.name, output)
+		}
+
+		removeSite()
+		restore()
+	}
+}